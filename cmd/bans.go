@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hacdias/webdav/v5/lib"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	flags := bansCmd.Flags()
+	flags.StringP("config", "c", "", "config file path")
+
+	rootCmd.AddCommand(bansCmd)
+}
+
+var bansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "List the addresses and usernames banned after failed logins",
+	Long: `List the addresses and usernames that are currently banned after too many
+failed login attempts. Bans are read from the state file of the
+configuration, so "stateFile" must be set.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+
+		cfgFilename, _ := flags.GetString("config")
+
+		cfg, err := lib.ParseConfig(cfgFilename, flags)
+		if err != nil {
+			return err
+		}
+
+		if cfg.StateFile == "" {
+			return errors.New("stateFile must be set in the configuration to list bans")
+		}
+
+		state, err := lib.ReadState(cfg.StateFile)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TYPE\tVALUE\tUNTIL\tREMAINING\tCOUNT")
+		for _, ban := range state.Bans {
+			if !ban.Until.After(now) {
+				continue
+			}
+
+			kind, value := "ip", ban.IP
+			if ban.Username != "" {
+				kind, value = "username", ban.Username
+			}
+
+			remaining := ban.Until.Sub(now).Round(time.Second)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", kind, value, ban.Until.Format(time.RFC3339), remaining, ban.Count)
+		}
+
+		return w.Flush()
+	},
+}
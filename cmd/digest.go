@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hacdias/webdav/v5/lib"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	flags := digestCmd.Flags()
+	flags.StringP("algorithm", "a", lib.DigestSHA256, "digest algorithm, one of: "+lib.DigestSHA256+", "+lib.DigestMD5)
+	flags.StringP("realm", "r", lib.DefaultDigestRealm, "digest realm, as set in the configuration")
+
+	rootCmd.AddCommand(digestCmd)
+}
+
+var digestCmd = &cobra.Command{
+	Use:   "digest <username> <password>",
+	Short: "Generate a credential for Digest authentication",
+	Long: `Generate the HA1 value of a user for Digest authentication, which can be
+used in the "digest" option of the user in the configuration. The output
+includes the prefix of the algorithm, such as "{sha-256}", and can be used as
+is. Generate one value for every algorithm that the user's clients use.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+
+		algorithm, err := flags.GetString("algorithm")
+		if err != nil {
+			return err
+		}
+
+		realm, err := flags.GetString("realm")
+		if err != nil {
+			return err
+		}
+
+		if args[0] == "" || args[1] == "" {
+			return errors.New("username and password arguments must not be empty")
+		}
+
+		ha1, err := lib.DigestHA1(algorithm, args[0], realm, args[1])
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(ha1)
+		return nil
+	},
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/hacdias/webdav/v5/lib"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	flags := explainCmd.Flags()
+	flags.StringP("config", "c", "", "config file path")
+	flags.StringP("user", "u", "", "user making the request, instead of the global permissions")
+	flags.StringP("dest", "d", "", "destination of a COPY or MOVE request")
+	flags.String("from", "", "address the request is made from, for rules with sourceCIDRs")
+	flags.String("at", "", "time the request is made at, in RFC 3339, for rules with a schedule (default now)")
+
+	rootCmd.AddCommand(explainCmd)
+}
+
+var explainCmd = &cobra.Command{
+	Use:   "explain <method> <path>",
+	Short: "Explain whether the permissions allow a request",
+	Long: `Explain how the permissions of the configuration decide a request: the
+effective rules of the user, after those of its groups and the global ones have
+been applied, the rule that governs the path and, for COPY and MOVE requests,
+the destination, whether they exist, and the final decision.
+
+Paths are request paths, including the prefix. Only the permissions and rules
+are checked: app passwords, share links, the authorization hook and write-once
+rules can still deny a request that is allowed here. The same trace is logged
+for every request at the debug level.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+
+		cfgFilename, _ := flags.GetString("config")
+		username, _ := flags.GetString("user")
+		destination, _ := flags.GetString("dest")
+		from, _ := flags.GetString("from")
+		at, _ := flags.GetString("at")
+
+		request := lib.ExplainRequest{
+			Username:    username,
+			Method:      args[0],
+			Path:        args[1],
+			Destination: destination,
+			Time:        time.Now(),
+		}
+
+		if from != "" {
+			addr, err := netip.ParseAddr(from)
+			if err != nil {
+				return fmt.Errorf("invalid from address: %w", err)
+			}
+			request.RemoteAddr = addr
+		}
+
+		if at != "" {
+			t, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				return fmt.Errorf("invalid time: %w", err)
+			}
+			request.Time = t
+		}
+
+		cfg, err := lib.ParseConfig(cfgFilename, flags)
+		if err != nil {
+			return err
+		}
+
+		e, err := cfg.Explain(context.Background(), request)
+		if err != nil {
+			return err
+		}
+
+		printExplanation(cmd.OutOrStdout(), e)
+		return nil
+	},
+}
+
+func printExplanation(w io.Writer, e *lib.Explanation) {
+	fmt.Fprintf(w, "Permissions: %s\n", e.Permissions)
+
+	if len(e.Rules) == 0 {
+		fmt.Fprintln(w, "Rules: none")
+	} else {
+		fmt.Fprintln(w, "Rules, from first to last:")
+		for i, rule := range e.Rules {
+			var conditions []string
+			if len(rule.SourceCIDRs) > 0 {
+				conditions = append(conditions, "sourceCIDRs "+strings.Join(rule.SourceCIDRs, ", "))
+			}
+			if rule.Schedule != nil {
+				conditions = append(conditions, "schedule")
+			}
+			if rule.WORM {
+				conditions = append(conditions, "worm")
+			}
+			if rule.Mount != "" {
+				conditions = append(conditions, "in mount "+rule.Mount)
+			}
+
+			fmt.Fprintf(w, "  %d: %s: %s", i, rule.Rule, rule.Permissions)
+			if len(conditions) > 0 {
+				fmt.Fprintf(w, " (%s)", strings.Join(conditions, "; "))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	printDecision := func(name string, d lib.PathDecision) {
+		exists := "does not exist"
+		if d.Exists {
+			exists = "exists"
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", name, d.Path, exists)
+
+		if d.Mount != "" {
+			fmt.Fprintf(w, "  in mount %s, with permissions %s", d.Mount, d.Permissions)
+			if d.ReadOnly {
+				fmt.Fprint(w, ", read-only")
+			}
+			fmt.Fprintln(w)
+		}
+
+		for _, i := range d.Skipped {
+			fmt.Fprintf(w, "  rule %d matches, but is skipped as its conditions are not met\n", i)
+		}
+
+		switch {
+		case d.Rule < 0:
+			fmt.Fprintf(w, "  no rule matches, permissions %s apply\n", d.Permissions)
+		case d.Collection:
+			fmt.Fprintf(w, "  rule %d matches the collection it names, so both its permissions and %s apply\n", d.Rule, d.Permissions)
+		default:
+			fmt.Fprintf(w, "  rule %d matches, its permissions apply\n", d.Rule)
+		}
+
+		fmt.Fprintf(w, "  %s\n", decisionString(d.Allowed))
+	}
+
+	printDecision("Path", e.Source)
+	if e.Destination != nil {
+		printDecision("Destination", *e.Destination)
+	}
+
+	fmt.Fprintf(w, "Decision: %s %s\n", e.Method, decisionString(e.Allowed))
+}
+
+func decisionString(allowed bool) string {
+	if allowed {
+		return "allowed"
+	}
+	return "denied"
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hacdias/webdav/v5/lib"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	flags := hashCmd.Flags()
+	flags.StringP("algorithm", "a", "bcrypt", "hash algorithm, one of: "+strings.Join(lib.PasswordAlgorithms(), ", "))
+	flags.IntP("cost", "c", 0, "cost used to generate password, higher cost leads to slower verification times (0 uses the default of the algorithm)")
+
+	rootCmd.AddCommand(hashCmd)
+}
+
+var hashCmd = &cobra.Command{
+	Use:     "hash",
+	Aliases: []string{"bcrypt"},
+	Short:   "Generate a hashed password",
+	Long: `Generate a hashed password that can be used as a user password in the
+configuration. The output includes the prefix of the algorithm, such as
+"{argon2id}", and can be used as is.
+
+The cost depends on the algorithm:
+
+- bcrypt: the bcrypt cost, between 4 and 31
+- argon2id: the number of passes over the memory, up to 64
+- scrypt: the base-2 logarithm of the CPU/memory cost, up to 18
+- sha256-crypt, sha512-crypt: the number of rounds
+- ssha: not supported
+
+When called as "bcrypt", the algorithm defaults to bcrypt and the prefix is
+omitted, as in previous versions.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+
+		algorithm, err := flags.GetString("algorithm")
+		if err != nil {
+			return err
+		}
+
+		if cmd.CalledAs() == "bcrypt" && flags.Changed("algorithm") {
+			return errors.New("the bcrypt command does not support the algorithm flag, use hash instead")
+		}
+
+		cost, err := flags.GetInt("cost")
+		if err != nil {
+			return err
+		}
+
+		pwd := args[0]
+		if pwd == "" {
+			return errors.New("password argument must not be empty")
+		}
+
+		hash, err := lib.HashPassword(algorithm, pwd, cost)
+		if err != nil {
+			return err
+		}
+
+		if cmd.CalledAs() == "bcrypt" {
+			hash = strings.TrimPrefix(hash, "{bcrypt}")
+		}
+
+		fmt.Println(hash)
+		return nil
+	},
+}
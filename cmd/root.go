@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -75,6 +76,12 @@ set WD_CERT.`,
 			_ = zap.L().Sync()
 		}()
 
+		defer func() {
+			if closer, ok := handler.(io.Closer); ok {
+				_ = closer.Close()
+			}
+		}()
+
 		// Build listener
 		listener, err := getListener(cfg)
 		if err != nil {
@@ -83,6 +90,13 @@ set WD_CERT.`,
 
 		server := &http.Server{Handler: handler}
 
+		if cfg.TLS {
+			server.TLSConfig, err = cfg.GetTLSConfig()
+			if err != nil {
+				return err
+			}
+		}
+
 		// Trap exiting signals
 		quit := make(chan os.Signal, 1)
 
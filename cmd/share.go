@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hacdias/webdav/v5/lib"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	flags := shareCmd.Flags()
+	flags.StringP("config", "c", "", "config file path")
+	flags.StringP("user", "u", "", "user whose files are shared, instead of the global directory")
+	flags.DurationP("expires", "e", 24*time.Hour, "how long the link is valid for")
+	flags.Bool("upload", false, "allow creating new files instead of reading them")
+	flags.String("url", "", "base URL of the server, such as https://example.com")
+
+	rootCmd.AddCommand(shareCmd)
+}
+
+var shareCmd = &cobra.Command{
+	Use:   "share <path>",
+	Short: "Create a share link for a file or directory",
+	Long: `Create a link that grants access to a file or directory, and everything
+within it, until it expires. By default, the link allows reading; with
+--upload, it only allows creating new files. The link is signed with the
+"shares.secret" of the configuration, and only grants what the user it is
+created for is allowed to do.
+
+If --url is given, the complete link is printed. Otherwise, only the token is
+printed, to be given in the "share" query parameter. The ID of the link is
+printed to the standard error, and can be added to "shares.revoked" to revoke
+the link before it expires.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+
+		cfgFilename, _ := flags.GetString("config")
+		username, _ := flags.GetString("user")
+		expires, _ := flags.GetDuration("expires")
+		upload, _ := flags.GetBool("upload")
+		baseURL, _ := flags.GetString("url")
+
+		if expires <= 0 {
+			return errors.New("expires must be positive")
+		}
+
+		cfg, err := lib.ParseConfig(cfgFilename, flags)
+		if err != nil {
+			return err
+		}
+
+		id := rand.Text()
+		token, err := cfg.ShareToken(lib.ShareLink{
+			ID:       id,
+			Username: username,
+			Path:     args[0],
+			Upload:   upload,
+			Expires:  time.Now().Add(expires).Unix(),
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Link ID: %s\n", id)
+
+		if baseURL == "" {
+			fmt.Println(token)
+			return nil
+		}
+
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return fmt.Errorf("invalid url: %w", err)
+		}
+
+		u.Path = path.Join("/", u.Path, cfg.Prefix, args[0])
+		if strings.HasSuffix(args[0], "/") {
+			u.Path += "/"
+		}
+		u.RawQuery = url.Values{lib.ShareQueryParameter: {token}}.Encode()
+
+		fmt.Println(u.String())
+		return nil
+	},
+}
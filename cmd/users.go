@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hacdias/webdav/v5/lib"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	flags := usersCmd.Flags()
+	flags.StringP("config", "c", "", "config file path")
+
+	rootCmd.AddCommand(usersCmd)
+}
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "List the users with their status and last login",
+	Long: `List the users of the configuration, whether they can currently log in,
+and the time of their last successful login. Users that only appear in the
+state file, such as those from the users file or LDAP, are listed as well.
+Last logins are read from the state file of the configuration, and are only
+available if "stateFile" is set.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+
+		cfgFilename, _ := flags.GetString("config")
+
+		cfg, err := lib.ParseConfig(cfgFilename, flags)
+		if err != nil {
+			return err
+		}
+
+		lastLogins := map[string]time.Time{}
+		if cfg.StateFile != "" {
+			state, err := lib.ReadState(cfg.StateFile)
+			if err != nil {
+				return err
+			}
+			lastLogins = state.LastLogins
+		}
+
+		now := time.Now()
+		formatTime := func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return t.Format(time.RFC3339)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tSTATUS\tVALID FROM\tVALID UNTIL\tLAST LOGIN")
+
+		listed := map[string]bool{}
+		for _, u := range cfg.Users {
+			status := "active"
+			if err := u.CheckActive(now); err != nil {
+				status = err.Error()
+			}
+
+			listed[u.Username] = true
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.Username, status, formatTime(u.ValidFrom), formatTime(u.ValidUntil), formatTime(lastLogins[u.Username]))
+		}
+
+		var others []string
+		for username := range lastLogins {
+			if !listed[username] {
+				others = append(others, username)
+			}
+		}
+		sort.Strings(others)
+
+		for _, username := range others {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t%s\n", username, "-", formatTime(lastLogins[username]))
+		}
+
+		return w.Flush()
+	},
+}
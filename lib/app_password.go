@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// AppPassword is an additional password of a user, such as one for each
+// device, which can be revoked on its own. It can only narrow down what the
+// user is allowed to do.
+type AppPassword struct {
+	Name     string
+	Password string
+
+	// Permissions and Rules restrict the user's permissions: a request must be
+	// allowed both by the user's and by these. All permissions are granted by
+	// default.
+	Permissions *Permissions
+	Rules       []*Rule
+
+	// Path restricts the password to a part of the user's tree.
+	Path string
+
+	// Expires is the time after which the password is no longer accepted. The
+	// zero value means that the password does not expire.
+	Expires time.Time
+}
+
+func (a *AppPassword) Validate() error {
+	if a.Name == "" {
+		return errors.New("invalid app password: name must be set")
+	}
+
+	if a.Password == "" {
+		return fmt.Errorf("invalid app password %q: password must be set", a.Name)
+	} else if env, ok := strings.CutPrefix(a.Password, "{env}"); ok {
+		a.Password = os.Getenv(env)
+		if a.Password == "" {
+			return fmt.Errorf("invalid app password %q: password environment variable is empty", a.Name)
+		}
+	}
+
+	if err := validatePassword(a.Password); err != nil {
+		return fmt.Errorf("invalid app password %q: %w", a.Name, err)
+	}
+
+	for _, r := range a.Rules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("invalid app password %q: %w", a.Name, err)
+		}
+	}
+
+	if a.Path != "" {
+		a.Path = strings.TrimSuffix(cleanPath(a.Path), "/")
+	}
+
+	return nil
+}
+
+// expired returns whether the password has expired at the given time.
+func (a *AppPassword) expired(now time.Time) bool {
+	return !a.Expires.IsZero() && now.After(a.Expires)
+}
+
+// Allowed checks if the app password allows the request. It does not check
+// the permissions of the user itself.
+func (a *AppPassword) Allowed(r *request, fileExists func(string) bool) bool {
+	if !a.inPath(r.path) {
+		return false
+	}
+
+	if (r.method == "COPY" || r.method == "MOVE") && !a.inPath(r.destination) {
+		return false
+	}
+
+	p := UserPermissions{
+		Permissions: Permissions{Create: true, Read: true, Update: true, Delete: true},
+		Rules:       a.Rules,
+	}
+	if a.Permissions != nil {
+		p.Permissions = *a.Permissions
+	}
+
+	return p.Allowed(r, fileExists)
+}
+
+// inPath returns whether path is within the path of the app password.
+func (a *AppPassword) inPath(path string) bool {
+	if a.Path == "" || a.Path == "/" {
+		return true
+	}
+
+	path = strings.TrimSuffix(path, "/")
+	return path == a.Path || strings.HasPrefix(path, a.Path+"/")
+}
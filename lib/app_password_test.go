@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestUserAppPasswords(t *testing.T) {
+	t.Parallel()
+
+	cfg := writeAndParseConfig(t, `
+users:
+  - username: john
+    password: john
+    appPasswords:
+      - name: phone
+        password: "{bcrypt}$2y$10$zEP6oofmXFeHaeMfBNLnP.DO8m.H.Mwhd24/TOX2MWLxAExXi4qgi"
+        permissions: R
+        expires: 2030-01-02T15:04:05Z
+      - name: backup
+        password: backup
+        path: /backups/
+`, ".yml")
+
+	require.Len(t, cfg.Users, 1)
+	u := cfg.Users[0]
+	require.Len(t, u.AppPasswords, 2)
+	require.Equal(t, &Permissions{Read: true}, u.AppPasswords[0].Permissions)
+	require.True(t, time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC).Equal(u.AppPasswords[0].Expires))
+	require.Nil(t, u.AppPasswords[1].Permissions)
+	require.Equal(t, "/backups", u.AppPasswords[1].Path)
+
+	now := time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	app, ok := u.matchPassword("john", now, comparePassword)
+	require.True(t, ok)
+	require.Nil(t, app)
+
+	app, ok = u.matchPassword("backup", now, comparePassword)
+	require.True(t, ok)
+	require.Equal(t, "backup", app.Name)
+
+	_, ok = u.matchPassword("wrong", now, comparePassword)
+	require.False(t, ok)
+
+	require.True(t, u.checkPassword("backup"))
+	require.False(t, u.checkPassword("wrong"))
+
+	writeAndParseConfigWithError(t, `
+users:
+  - username: john
+    password: john
+    appPasswords:
+      - name: phone
+        password: one
+      - name: phone
+        password: two
+`, ".yml", "app password \"phone\" is defined more than once")
+
+	writeAndParseConfigWithError(t, `
+users:
+  - username: john
+    password: john
+    appPasswords:
+      - password: phone
+`, ".yml", "name must be set")
+}
+
+func TestAppPasswordAllowed(t *testing.T) {
+	t.Parallel()
+
+	exists := func(string) bool { return false }
+	app := AppPassword{
+		Name:        "backup",
+		Password:    "backup",
+		Permissions: &Permissions{Read: true, Create: true},
+		Rules: []*Rule{
+			{Path: "/backups/readonly/", Permissions: Permissions{Read: true}},
+		},
+		Path: "/backups/",
+	}
+	require.NoError(t, app.Validate())
+
+	testCases := []struct {
+		method      string
+		path        string
+		destination string
+		expected    bool
+	}{
+		{"GET", "/backups", "", true},
+		{"GET", "/backups/file", "", true},
+		{"PUT", "/backups/file", "", true},
+		{"DELETE", "/backups/file", "", false},
+		{"PUT", "/backups/readonly/file", "", false},
+		{"GET", "/backupsfoo/file", "", false},
+		{"GET", "/other/file", "", false},
+		{"COPY", "/backups/file", "/backups/copy", true},
+		{"COPY", "/backups/file", "/other/copy", false},
+	}
+
+	for _, tc := range testCases {
+		r := &request{method: tc.method, path: tc.path, destination: tc.destination}
+		require.Equal(t, tc.expected, app.Allowed(r, exists), "%s %s", tc.method, tc.path)
+	}
+
+	require.False(t, app.expired(time.Now()))
+	app.Expires = time.Now().Add(-time.Minute)
+	require.True(t, app.expired(time.Now()))
+}
+
+func TestServerAppPasswords(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"foo.txt":         []byte("foo"),
+		"backups/bar.txt": []byte("bar"),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+
+users:
+  - username: john
+    password: john
+    appPasswords:
+      - name: phone
+        password: phone
+        permissions: R
+      - name: backup
+        password: backup
+        path: /backups
+      - name: old
+        password: old
+        expires: 2020-01-01T00:00:00Z
+`, dir))
+	defer srv.Close()
+
+	// The password of the user has all of the user's permissions.
+	john := gowebdav.NewClient(srv.URL, "john", "john")
+	require.NoError(t, john.Write("/new.txt", []byte("new"), 0666))
+
+	// App passwords narrow them down.
+	phone := gowebdav.NewClient(srv.URL, "john", "phone")
+	data, err := phone.Read("/foo.txt")
+	require.NoError(t, err)
+	require.EqualValues(t, []byte("foo"), data)
+	require.ErrorContains(t, phone.Write("/phone.txt", []byte("phone"), 0666), "403")
+
+	backup := gowebdav.NewClient(srv.URL, "john", "backup")
+	require.NoError(t, backup.Write("/backups/new.txt", []byte("new"), 0666))
+	_, err = backup.Read("/foo.txt")
+	require.ErrorContains(t, err, "403")
+	require.ErrorContains(t, backup.Copy("/backups/new.txt", "/copy.txt", false), "403")
+
+	// Expired app passwords are rejected.
+	old := gowebdav.NewClient(srv.URL, "john", "old")
+	_, err = old.Read("/foo.txt")
+	require.ErrorContains(t, err, "401")
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAuthorizationHookTimeout  = 5 * time.Second
+	DefaultAuthorizationHookCacheTTL = 30 * time.Second
+
+	authorizationHookMaxResponse = 64 << 10
+)
+
+type AuthorizationHook struct {
+	// URL receives a POST request with an [AuthorizationRequest] for every
+	// request allowed by the permissions and rules, and answers with an
+	// [AuthorizationResponse].
+	URL     string
+	Timeout time.Duration
+
+	// CacheTTL is how long an answer is reused for identical requests. Zero
+	// uses the default, and a negative value disables the cache.
+	CacheTTL time.Duration
+}
+
+func (a *AuthorizationHook) Validate() error {
+	if a.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(a.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid authorization hook: url must be an http(s) URL")
+	}
+
+	if a.Timeout == 0 {
+		a.Timeout = DefaultAuthorizationHookTimeout
+	}
+
+	if a.Timeout < 0 {
+		return errors.New("invalid authorization hook: timeout cannot be negative")
+	}
+
+	if a.CacheTTL == 0 {
+		a.CacheTTL = DefaultAuthorizationHookCacheTTL
+	}
+
+	return nil
+}
+
+// AuthorizationRequest describes a request to the authorization hook.
+type AuthorizationRequest struct {
+	User              string `json:"user"`
+	Method            string `json:"method"`
+	Path              string `json:"path"`
+	Exists            bool   `json:"exists"`
+	Destination       string `json:"destination,omitempty"`
+	DestinationExists bool   `json:"destinationExists,omitempty"`
+
+	// Share is set for requests made with a share link of User, and ShareID
+	// is the ID of the link, if it has one.
+	Share   bool   `json:"share,omitempty"`
+	ShareID string `json:"shareId,omitempty"`
+
+	// AppPassword is the name of the app password that User authenticated
+	// with, if any.
+	AppPassword string `json:"appPassword,omitempty"`
+}
+
+// AuthorizationResponse is the answer of the authorization hook.
+type AuthorizationResponse struct {
+	Allow bool `json:"allow"`
+}
+
+type authorizationHookEntry struct {
+	allow   bool
+	expires time.Time
+}
+
+type authorizationHookClient struct {
+	AuthorizationHook
+	client *http.Client
+	now    func() time.Time
+
+	mu     sync.Mutex
+	cache  map[AuthorizationRequest]authorizationHookEntry
+	pruned time.Time
+}
+
+func newAuthorizationHookClient(a AuthorizationHook) *authorizationHookClient {
+	return &authorizationHookClient{
+		AuthorizationHook: a,
+		client:            &http.Client{Timeout: a.Timeout},
+		now:               time.Now,
+		cache:             map[AuthorizationRequest]authorizationHookEntry{},
+	}
+}
+
+// allowed asks the hook whether the request is allowed, reusing recent
+// answers for identical requests. Errors are never cached.
+func (c *authorizationHookClient) allowed(ctx context.Context, r AuthorizationRequest) (allow bool, cached bool, err error) {
+	now := c.now()
+
+	if c.CacheTTL > 0 {
+		c.mu.Lock()
+		entry, ok := c.cache[r]
+		c.mu.Unlock()
+
+		if ok && now.Before(entry.expires) {
+			return entry.allow, true, nil
+		}
+	}
+
+	allow, err = c.ask(ctx, r)
+	if err != nil {
+		return false, false, err
+	}
+
+	if c.CacheTTL > 0 {
+		c.mu.Lock()
+		if now.Sub(c.pruned) > c.CacheTTL {
+			c.pruned = now
+			for key, entry := range c.cache {
+				if !now.Before(entry.expires) {
+					delete(c.cache, key)
+				}
+			}
+		}
+		c.cache[r] = authorizationHookEntry{allow: allow, expires: now.Add(c.CacheTTL)}
+		c.mu.Unlock()
+	}
+
+	return allow, false, nil
+}
+
+func (c *authorizationHookClient) ask(ctx context.Context, r AuthorizationRequest) (bool, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var answer AuthorizationResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, authorizationHookMaxResponse)).Decode(&answer); err != nil {
+		return false, fmt.Errorf("invalid response: %w", err)
+	}
+
+	return answer.Allow, nil
+}
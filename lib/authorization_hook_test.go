@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+// fakeAuthorizationHook is a stand-in for an authorization service, which
+// allows the requests for which allow returns true, and records the requests
+// it gets.
+type fakeAuthorizationHook struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []AuthorizationRequest
+}
+
+func newFakeAuthorizationHook(t *testing.T, allow func(AuthorizationRequest) bool) *fakeAuthorizationHook {
+	f := &fakeAuthorizationHook{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AuthorizationRequest
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		f.requests = append(f.requests, req)
+		f.mu.Unlock()
+
+		if req.Path == "/broken" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(AuthorizationResponse{Allow: allow(req)})
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeAuthorizationHook) calls() []AuthorizationRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]AuthorizationRequest{}, f.requests...)
+}
+
+func TestAuthorizationHookClient(t *testing.T) {
+	t.Parallel()
+
+	hook := newFakeAuthorizationHook(t, func(r AuthorizationRequest) bool {
+		return r.User == "john"
+	})
+
+	a := AuthorizationHook{URL: hook.URL, CacheTTL: time.Minute}
+	require.NoError(t, a.Validate())
+	require.Equal(t, DefaultAuthorizationHookTimeout, a.Timeout)
+
+	now := time.Now()
+	c := newAuthorizationHookClient(a)
+	c.now = func() time.Time { return now }
+
+	john := AuthorizationRequest{User: "john", Method: "GET", Path: "/foo.txt", Exists: true}
+	jane := AuthorizationRequest{User: "jane", Method: "GET", Path: "/foo.txt", Exists: true}
+
+	allow, cached, err := c.allowed(context.Background(), john)
+	require.NoError(t, err)
+	require.True(t, allow)
+	require.False(t, cached)
+
+	allow, cached, err = c.allowed(context.Background(), jane)
+	require.NoError(t, err)
+	require.False(t, allow)
+	require.False(t, cached)
+
+	// Answers are reused for identical requests until they expire.
+	allow, cached, err = c.allowed(context.Background(), john)
+	require.NoError(t, err)
+	require.True(t, allow)
+	require.True(t, cached)
+	require.Len(t, hook.calls(), 2)
+
+	now = now.Add(time.Minute)
+	_, cached, err = c.allowed(context.Background(), john)
+	require.NoError(t, err)
+	require.False(t, cached)
+	require.Len(t, hook.calls(), 3)
+
+	// Errors are not cached.
+	broken := AuthorizationRequest{User: "john", Method: "GET", Path: "/broken"}
+	for range 2 {
+		_, _, err = c.allowed(context.Background(), broken)
+		require.ErrorContains(t, err, "unexpected status 500")
+	}
+	require.Len(t, hook.calls(), 5)
+
+	require.ErrorContains(t, (&AuthorizationHook{URL: "ftp://example.com"}).Validate(), "must be an http(s) URL")
+}
+
+func TestServerAuthorizationHook(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"projects/alpha/a.txt": []byte("a"),
+		"projects/beta/b.txt":  []byte("b"),
+	})
+
+	// Only members of a project can access it, and nobody can overwrite files.
+	hook := newFakeAuthorizationHook(t, func(r AuthorizationRequest) bool {
+		if (r.Method == "PUT" && r.Exists) || r.DestinationExists {
+			return false
+		}
+		return r.Path == "/" || r.Path == "/projects/" || strings.HasPrefix(r.Path, "/projects/alpha/")
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+rules:
+  - path: /projects/beta/readonly/
+    permissions: R
+
+authorizationHook:
+  url: %s
+  cacheTTL: -1s
+
+users:
+  - username: john
+    password: john
+`, dir, hook.URL))
+	defer srv.Close()
+
+	client := gowebdav.NewClient(srv.URL, "john", "john")
+
+	data, err := client.Read("/projects/alpha/a.txt")
+	require.NoError(t, err)
+	require.EqualValues(t, []byte("a"), data)
+
+	_, err = client.Read("/projects/beta/b.txt")
+	require.ErrorContains(t, err, "403")
+
+	require.NoError(t, client.Write("/projects/alpha/new.txt", []byte("new"), 0666))
+	require.ErrorContains(t, client.Write("/projects/alpha/new.txt", []byte("new"), 0666), "403")
+	require.ErrorContains(t, client.Copy("/projects/alpha/a.txt", "/projects/alpha/new.txt", true), "403")
+	require.NoError(t, client.Copy("/projects/alpha/a.txt", "/projects/alpha/copy.txt", false))
+
+	// The hook is only asked about requests that the permissions allow, and
+	// gets their description.
+	require.ErrorContains(t, client.Write("/projects/beta/readonly/new.txt", []byte("new"), 0666), "403")
+
+	calls := hook.calls()
+	for _, call := range calls {
+		require.Equal(t, "john", call.User)
+		require.NotEqual(t, "/projects/beta/readonly/new.txt", call.Path)
+	}
+	require.Contains(t, calls, AuthorizationRequest{
+		User:              "john",
+		Method:            "COPY",
+		Path:              "/projects/alpha/a.txt",
+		Exists:            true,
+		Destination:       "/projects/alpha/new.txt",
+		DestinationExists: true,
+	})
+
+	// Requests are denied if the hook fails.
+	_, err = client.Read("/broken")
+	require.ErrorContains(t, err, "403")
+}
+
+func TestServerAuthorizationHookCredentials(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"foo.txt": []byte("foo")})
+
+	// Share links are allowed, and app passwords can only read.
+	hook := newFakeAuthorizationHook(t, func(r AuthorizationRequest) bool {
+		return r.Share || r.Method == "GET" || r.AppPassword == ""
+	})
+
+	cfg := writeAndParseConfig(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+
+authorizationHook:
+  url: %s
+  cacheTTL: -1s
+
+shares:
+  secret: 0123456789abcdef0123
+
+users:
+  - username: john
+    password: john
+    appPasswords:
+      - name: phone
+        password: phone
+`, dir, hook.URL), ".yml")
+
+	handler, err := NewHandler(cfg)
+	require.NoError(t, err)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	token, err := cfg.Shares.Token(ShareLink{ID: "link", Username: "john", Path: "/", Expires: time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	resp, err := http.Get(srv.URL + "/foo.txt?share=" + token)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.ErrorContains(t, gowebdav.NewClient(srv.URL, "john", "phone").Write("/new.txt", []byte("new"), 0666), "403")
+	require.NoError(t, gowebdav.NewClient(srv.URL, "john", "john").Write("/new.txt", []byte("new"), 0666))
+
+	// The hook is told how the requests were authenticated.
+	calls := hook.calls()
+	require.Contains(t, calls, AuthorizationRequest{User: "john", Method: "GET", Path: "/foo.txt", Exists: true, Share: true, ShareID: "link"})
+	require.Contains(t, calls, AuthorizationRequest{User: "john", Method: "PUT", Path: "/new.txt", AppPassword: "phone"})
+	require.Contains(t, calls, AuthorizationRequest{User: "john", Method: "PUT", Path: "/new.txt"})
+}
@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultBruteForceWindow     = 15 * time.Minute
+	DefaultBruteForceBanTime    = time.Minute
+	DefaultBruteForceMaxBanTime = time.Hour
+)
+
+type BruteForce struct {
+	// MaxAttempts is the number of failed attempts from an address, within
+	// Window, after which the address is banned. Zero disables it.
+	MaxAttempts int
+
+	// MaxUsernameAttempts is the number of failed attempts for a username,
+	// within Window, after which the username is banned. Zero disables it.
+	MaxUsernameAttempts int
+
+	Window time.Duration
+
+	// BanTime is the duration of the first ban. Every following ban of the
+	// same address or username doubles it, up to MaxBanTime.
+	BanTime    time.Duration
+	MaxBanTime time.Duration
+}
+
+func (b *BruteForce) enabled() bool {
+	return b.MaxAttempts > 0 || b.MaxUsernameAttempts > 0
+}
+
+func (b *BruteForce) Validate() error {
+	if b.MaxAttempts < 0 || b.MaxUsernameAttempts < 0 {
+		return errors.New("invalid brute force: attempts cannot be negative")
+	}
+
+	if b.Window == 0 {
+		b.Window = DefaultBruteForceWindow
+	}
+
+	if b.BanTime == 0 {
+		b.BanTime = DefaultBruteForceBanTime
+	}
+
+	if b.MaxBanTime == 0 {
+		b.MaxBanTime = DefaultBruteForceMaxBanTime
+	}
+
+	if b.Window < 0 || b.BanTime < 0 || b.MaxBanTime < b.BanTime {
+		return errors.New("invalid brute force: durations must be positive, and maxBanTime at least banTime")
+	}
+
+	return nil
+}
+
+// Ban is a banned address or username.
+type Ban struct {
+	IP       string    `json:"ip,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Until    time.Time `json:"until"`
+	// Count is the number of consecutive bans, which sets the ban duration.
+	Count int `json:"count"`
+}
+
+type bruteForceKey struct {
+	ip       string
+	username string
+}
+
+type bruteForceEntry struct {
+	failures    int
+	lastFailure time.Time
+	bans        int
+	bannedUntil time.Time
+}
+
+type bruteForceLimiter struct {
+	BruteForce
+	state *stateStore
+	now   func() time.Time
+
+	mu        sync.Mutex
+	entries   map[bruteForceKey]*bruteForceEntry
+	lastPrune time.Time
+}
+
+func newBruteForceLimiter(b BruteForce, state *stateStore) *bruteForceLimiter {
+	l := &bruteForceLimiter{
+		BruteForce: b,
+		state:      state,
+		now:        time.Now,
+		entries:    map[bruteForceKey]*bruteForceEntry{},
+	}
+
+	// Restore the bans from before a restart.
+	state.get(func(s *State) {
+		for _, ban := range s.Bans {
+			l.entries[bruteForceKey{ip: ban.IP, username: ban.Username}] = &bruteForceEntry{
+				lastFailure: ban.Until,
+				bans:        ban.Count,
+				bannedUntil: ban.Until,
+			}
+		}
+	})
+
+	return l
+}
+
+// banned reports whether the address or the username is banned, and for how
+// long. An empty username is ignored.
+func (l *bruteForceLimiter) banned(ip, username string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var remaining time.Duration
+
+	for _, key := range l.keys(ip, username) {
+		if entry, ok := l.entries[key]; ok && entry.bannedUntil.After(now) {
+			remaining = max(remaining, entry.bannedUntil.Sub(now))
+		}
+	}
+
+	return remaining, remaining > 0
+}
+
+// fail records a failed attempt from the address for the username, which can
+// be empty if it is not known.
+func (l *bruteForceLimiter) fail(lZap *zap.Logger, ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	banned := false
+	for _, key := range l.keys(ip, username) {
+		maxAttempts := l.MaxAttempts
+		if key.username != "" {
+			maxAttempts = l.MaxUsernameAttempts
+		}
+
+		entry, ok := l.entries[key]
+		if !ok {
+			entry = &bruteForceEntry{}
+			l.entries[key] = entry
+		}
+
+		if now.Sub(entry.lastFailure) > l.Window {
+			entry.failures = 0
+		}
+		entry.failures++
+		entry.lastFailure = now
+
+		if entry.failures < maxAttempts {
+			continue
+		}
+
+		duration := l.BanTime << min(entry.bans, 30)
+		if duration <= 0 || duration > l.MaxBanTime {
+			duration = l.MaxBanTime
+		}
+
+		entry.failures = 0
+		entry.bans++
+		entry.bannedUntil = now.Add(duration)
+		banned = true
+
+		if key.username != "" {
+			lZap.Warn("username banned after too many failed attempts", zap.String("username", key.username), zap.Duration("duration", duration))
+		} else {
+			lZap.Warn("address banned after too many failed attempts", zap.String("ip", key.ip), zap.Duration("duration", duration))
+		}
+	}
+
+	if banned {
+		bans := l.bans(now)
+		l.state.update(func(s *State) { s.Bans = bans })
+	}
+}
+
+// succeed clears the failed attempts for the username after it was used to
+// authenticate successfully.
+func (l *bruteForceLimiter) succeed(username string) {
+	if l.MaxUsernameAttempts == 0 || username == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := bruteForceKey{username: username}
+	if entry, ok := l.entries[key]; ok && !entry.bannedUntil.After(l.now()) {
+		delete(l.entries, key)
+	}
+}
+
+func (l *bruteForceLimiter) keys(ip, username string) []bruteForceKey {
+	keys := make([]bruteForceKey, 0, 2)
+	if l.MaxAttempts > 0 && ip != "" {
+		keys = append(keys, bruteForceKey{ip: ip})
+	}
+	if l.MaxUsernameAttempts > 0 && username != "" {
+		keys = append(keys, bruteForceKey{username: username})
+	}
+	return keys
+}
+
+// bans returns the current bans, sorted by expiry.
+func (l *bruteForceLimiter) bans(now time.Time) []Ban {
+	var bans []Ban
+	for key, entry := range l.entries {
+		if entry.bannedUntil.After(now) {
+			bans = append(bans, Ban{
+				IP:       key.ip,
+				Username: key.username,
+				Until:    entry.bannedUntil,
+				Count:    entry.bans,
+			})
+		}
+	}
+
+	slices.SortFunc(bans, func(a, b Ban) int {
+		if c := a.Until.Compare(b.Until); c != 0 {
+			return c
+		}
+		return strings.Compare(a.IP+a.Username, b.IP+b.Username)
+	})
+
+	return bans
+}
+
+// prune removes the entries that no longer matter. The number of bans is
+// kept for MaxBanTime after a ban ends, so that repeated offenders are banned
+// for longer.
+func (l *bruteForceLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.Window {
+		return
+	}
+	l.lastPrune = now
+
+	for key, entry := range l.entries {
+		if entry.bannedUntil.After(now) {
+			continue
+		}
+
+		if now.Sub(entry.lastFailure) > l.Window && now.Sub(entry.bannedUntil) > l.MaxBanTime {
+			delete(l.entries, key)
+		}
+	}
+}
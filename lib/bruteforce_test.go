@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBruteForceLimiter(t *testing.T) {
+	t.Parallel()
+
+	b := BruteForce{MaxAttempts: 3, MaxUsernameAttempts: 5}
+	require.NoError(t, b.Validate())
+
+	filename := filepath.Join(t.TempDir(), "state.json")
+	state, err := newStateStore(filename)
+	require.NoError(t, err)
+
+	now := time.Now()
+	l := newBruteForceLimiter(b, state)
+	l.now = func() time.Time { return now }
+
+	fail := func(ip, username string, n int) {
+		for range n {
+			l.fail(zap.NewNop(), ip, username)
+		}
+	}
+
+	// Addresses are banned after three attempts.
+	fail("10.0.0.1", "", 2)
+	_, banned := l.banned("10.0.0.1", "")
+	require.False(t, banned)
+
+	fail("10.0.0.1", "", 1)
+	remaining, banned := l.banned("10.0.0.1", "")
+	require.True(t, banned)
+	require.Equal(t, DefaultBruteForceBanTime, remaining)
+
+	_, banned = l.banned("10.0.0.2", "")
+	require.False(t, banned)
+
+	// The next ban of the same address lasts twice as long.
+	now = now.Add(DefaultBruteForceBanTime)
+	_, banned = l.banned("10.0.0.1", "")
+	require.False(t, banned)
+
+	fail("10.0.0.1", "", 3)
+	remaining, _ = l.banned("10.0.0.1", "")
+	require.Equal(t, 2*DefaultBruteForceBanTime, remaining)
+
+	// Failures outside of the window are forgotten.
+	fail("10.0.0.3", "", 2)
+	now = now.Add(DefaultBruteForceWindow + time.Second)
+	fail("10.0.0.3", "", 2)
+	_, banned = l.banned("10.0.0.3", "")
+	require.False(t, banned)
+
+	// Usernames are banned after attempts from any address, and successful
+	// logins reset the count.
+	fail("10.0.1.1", "john", 2)
+	fail("10.0.1.2", "john", 2)
+	l.succeed("john")
+	fail("10.0.1.3", "john", 2)
+	_, banned = l.banned("10.0.9.9", "john")
+	require.False(t, banned)
+
+	fail("10.0.1.4", "john", 1)
+	fail("10.0.1.5", "john", 2)
+	remaining, banned = l.banned("10.0.9.9", "john")
+	require.True(t, banned)
+	require.Equal(t, DefaultBruteForceBanTime, remaining)
+
+	// Bans are saved and restored.
+	state.close()
+	saved, err := ReadState(filename)
+	require.NoError(t, err)
+	require.Len(t, saved.Bans, 1)
+	require.Equal(t, "john", saved.Bans[0].Username)
+	require.Equal(t, 1, saved.Bans[0].Count)
+	require.True(t, now.Add(DefaultBruteForceBanTime).Equal(saved.Bans[0].Until))
+
+	state, err = newStateStore(filename)
+	require.NoError(t, err)
+	restored := newBruteForceLimiter(b, state)
+	restored.now = l.now
+	_, banned = restored.banned("", "john")
+	require.True(t, banned)
+}
+
+func TestBruteForceMaxBanTime(t *testing.T) {
+	t.Parallel()
+
+	b := BruteForce{MaxAttempts: 1, BanTime: time.Minute, MaxBanTime: 5 * time.Minute}
+	require.NoError(t, b.Validate())
+
+	state, err := newStateStore("")
+	require.NoError(t, err)
+
+	now := time.Now()
+	l := newBruteForceLimiter(b, state)
+	l.now = func() time.Time { return now }
+
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		l.fail(zap.NewNop(), "10.0.0.1", "")
+		remaining, banned := l.banned("10.0.0.1", "")
+		require.True(t, banned)
+		require.Equal(t, expected, remaining)
+		now = now.Add(remaining)
+	}
+
+	require.ErrorContains(t, (&BruteForce{MaxAttempts: 1, BanTime: time.Hour, MaxBanTime: time.Minute}).Validate(), "maxBanTime at least banTime")
+}
+
+func TestServerBruteForce(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"foo.txt": []byte("foo")})
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+stateFile: %s
+
+bruteForce:
+  maxAttempts: 3
+  banTime: 1h
+  maxBanTime: 2h
+
+users:
+  - username: john
+    password: john
+`, dir, stateFile))
+	defer srv.Close()
+
+	do := func(username, password string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+"/foo.txt", nil)
+		require.NoError(t, err)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	// Requests without credentials are not failed attempts.
+	for range 5 {
+		require.Equal(t, http.StatusUnauthorized, do("", "").StatusCode)
+	}
+	require.Equal(t, http.StatusOK, do("john", "john").StatusCode)
+
+	for range 3 {
+		require.Equal(t, http.StatusUnauthorized, do("john", "wrong").StatusCode)
+	}
+
+	// Even valid credentials are rejected while banned.
+	resp := do("john", "john")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	require.InDelta(t, time.Hour.Seconds(), retryAfter, 5)
+
+	// The state file is written in the background.
+	var state *State
+	require.Eventually(t, func() bool {
+		state, err = ReadState(stateFile)
+		return err == nil && len(state.Bans) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, state.Bans, 1)
+	require.Equal(t, "127.0.0.1", state.Bans[0].IP)
+}
+
+func TestServerBruteForceBehindProxy(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"foo.txt": []byte("foo")})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+behindProxy: true
+
+bruteForce:
+  maxAttempts: 3
+  maxUsernameAttempts: 2
+  banTime: 1h
+
+digestAuth:
+  enabled: true
+
+users:
+  - username: john
+    password: john
+  - username: jane
+    password: jane
+`, dir))
+	defer srv.Close()
+
+	do := func(forwardedFor string, auth func(*http.Request)) int {
+		req, err := http.NewRequest("GET", srv.URL+"/foo.txt", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		auth(req)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	basic := func(username, password string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(username, password) }
+	}
+
+	// The client can choose the entries of X-Forwarded-For before the one
+	// that the proxy adds, so changing them does not avoid bans, and cannot
+	// get other addresses banned.
+	for i := range 3 {
+		forwardedFor := fmt.Sprintf("192.0.2.%d, 198.51.100.1, 203.0.113.9", i)
+		require.Equal(t, http.StatusUnauthorized, do(forwardedFor, basic(fmt.Sprintf("user%d", i), "wrong")))
+	}
+	require.Equal(t, http.StatusTooManyRequests, do("192.0.2.99, 203.0.113.9", basic("jane", "jane")))
+	require.Equal(t, http.StatusOK, do("198.51.100.1", basic("jane", "jane")))
+
+	// Failed Digest attempts count towards the username too.
+	digest := func(r *http.Request) {
+		r.Header.Set("Authorization", `Digest username="john", realm="WebDAV", nonce="invalid", uri="/foo.txt", qop=auth, nc=00000001, cnonce="x", response="invalid"`)
+	}
+	require.Equal(t, http.StatusUnauthorized, do("198.51.100.2", digest))
+	require.Equal(t, http.StatusUnauthorized, do("198.51.100.3", digest))
+	require.Equal(t, http.StatusTooManyRequests, do("198.51.100.4", basic("john", "john")))
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// ClientCertRequest asks for a client certificate, but does not require
+	// one. Certificates that cannot be verified are ignored, and the client
+	// can still authenticate with other credentials.
+	ClientCertRequest = "request"
+	// ClientCertVerifyIfGiven asks for a client certificate, but does not
+	// require one. Certificates that cannot be verified fail the handshake.
+	ClientCertVerifyIfGiven = "verify-if-given"
+	// ClientCertRequire requires a valid client certificate.
+	ClientCertRequire = "require"
+)
+
+const (
+	ClientCertUsernameCommonName = "commonName"
+	ClientCertUsernameEmail      = "email"
+	ClientCertUsernameDNS        = "dns"
+	ClientCertUsernameURI        = "uri"
+)
+
+type ClientCerts struct {
+	// CA is the bundle of certificate authorities used to verify client
+	// certificates. Client certificates are only used when it is set.
+	CA   string
+	Mode string
+
+	// Username is the field of the certificate that holds the username: the
+	// subject common name, or one of the email, DNS or URI subject alternative
+	// names. The first value that matches a user is used.
+	Username string
+
+	// RequirePassword requires the password of the user of the certificate
+	// with Basic authentication as well.
+	RequirePassword bool
+}
+
+func (c *ClientCerts) Validate(tls bool) error {
+	if c.CA == "" {
+		return nil
+	}
+
+	if !tls {
+		return errors.New("invalid client certs: tls must be enabled")
+	}
+
+	var err error
+	c.CA, err = filepath.Abs(c.CA)
+	if err != nil {
+		return fmt.Errorf("invalid client certs: %w", err)
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = ClientCertVerifyIfGiven
+	case ClientCertRequest, ClientCertVerifyIfGiven, ClientCertRequire:
+		// Good to go
+	default:
+		return fmt.Errorf("invalid client certs: invalid mode %q", c.Mode)
+	}
+
+	switch c.Username {
+	case "":
+		c.Username = ClientCertUsernameCommonName
+	case ClientCertUsernameCommonName, ClientCertUsernameEmail, ClientCertUsernameDNS, ClientCertUsernameURI:
+		// Good to go
+	default:
+		return fmt.Errorf("invalid client certs: invalid username field %q", c.Username)
+	}
+
+	return nil
+}
+
+func (c *ClientCerts) pool() (*x509.CertPool, error) {
+	data, err := os.ReadFile(c.CA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("failed to read client ca: no certificates found")
+	}
+
+	return pool, nil
+}
+
+type clientCertAuthenticator struct {
+	ClientCerts
+	roots *x509.CertPool
+}
+
+func newClientCertAuthenticator(c ClientCerts) (*clientCertAuthenticator, error) {
+	pool, err := c.pool()
+	if err != nil {
+		return nil, err
+	}
+
+	return &clientCertAuthenticator{ClientCerts: c, roots: pool}, nil
+}
+
+// certificate returns the verified client certificate of the request, if
+// any. Certificates are verified again here, as they are not verified during
+// the handshake in [ClientCertRequest] mode.
+func (a *clientCertAuthenticator) certificate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+
+	if len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0], nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := r.TLS.PeerCertificates[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return leaf, nil
+}
+
+// usernames returns the candidate usernames of the certificate.
+func (a *clientCertAuthenticator) usernames(cert *x509.Certificate) []string {
+	switch a.Username {
+	case ClientCertUsernameEmail:
+		return cert.EmailAddresses
+	case ClientCertUsernameDNS:
+		return cert.DNSNames
+	case ClientCertUsernameURI:
+		usernames := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			usernames = append(usernames, u.String())
+		}
+		return usernames
+	default:
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+		return []string{cert.Subject.CommonName}
+	}
+}
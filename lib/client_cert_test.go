@@ -0,0 +1,292 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return testCA{cert: cert, key: key}
+}
+
+func (ca testCA) writePEM(t *testing.T) string {
+	filename := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	require.NoError(t, os.WriteFile(filename, data, 0666))
+	return filename
+}
+
+func (ca testCA) issue(t *testing.T, commonName string, emails ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: commonName},
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func makeTestTLSServer(t *testing.T, yamlConfig string) *httptest.Server {
+	cfg := writeAndParseConfig(t, yamlConfig, ".yml")
+
+	handler, err := NewHandler(cfg)
+	require.NoError(t, err)
+
+	tlsConfig, err := cfg.GetTLSConfig()
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	return srv
+}
+
+func testTLSGet(t *testing.T, srv *httptest.Server, cert *tls.Certificate, username, password string) (int, error) {
+	// Use a new transport every time, so that connections with a different
+	// certificate are not reused.
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	client := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequest("GET", srv.URL+"/foo.txt", nil)
+	require.NoError(t, err)
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	require.NoError(t, resp.Body.Close())
+	return resp.StatusCode, nil
+}
+
+func TestServerAuthenticationClientCerts(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"foo.txt": []byte("foo")})
+
+	ca := newTestCA(t)
+	caFile := ca.writePEM(t)
+	other := newTestCA(t)
+
+	backup := ca.issue(t, "backup")
+	admin := ca.issue(t, "admin")
+	unknown := ca.issue(t, "unknown")
+	untrusted := other.issue(t, "backup")
+
+	config := func(mode string, requirePassword bool) string {
+		return fmt.Sprintf(`
+directory: %s
+tls: true
+
+clientCerts:
+  ca: %s
+  mode: %s
+  requirePassword: %t
+
+users:
+  - username: backup
+    password: backup
+  - username: admin
+    password: admin
+`, dir, caFile, mode, requirePassword)
+	}
+
+	t.Run("Verify If Given", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestTLSServer(t, config(ClientCertVerifyIfGiven, false))
+		defer srv.Close()
+
+		status, err := testTLSGet(t, srv, &backup, "", "")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+
+		status, err = testTLSGet(t, srv, &unknown, "", "")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, status)
+
+		// Without a certificate, other credentials can be used.
+		status, err = testTLSGet(t, srv, nil, "admin", "admin")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+
+		_, err = testTLSGet(t, srv, &untrusted, "", "")
+		require.Error(t, err)
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestTLSServer(t, config(ClientCertRequest, false))
+		defer srv.Close()
+
+		status, err := testTLSGet(t, srv, &backup, "", "")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+
+		// Untrusted certificates are ignored.
+		status, err = testTLSGet(t, srv, &untrusted, "", "")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, status)
+
+		status, err = testTLSGet(t, srv, &untrusted, "admin", "admin")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Require", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestTLSServer(t, config(ClientCertRequire, false))
+		defer srv.Close()
+
+		status, err := testTLSGet(t, srv, &backup, "", "")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+
+		_, err = testTLSGet(t, srv, nil, "admin", "admin")
+		require.Error(t, err)
+	})
+
+	t.Run("Require Password", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestTLSServer(t, config(ClientCertVerifyIfGiven, true))
+		defer srv.Close()
+
+		for _, tc := range []struct {
+			cert     *tls.Certificate
+			username string
+			password string
+			status   int
+		}{
+			{&admin, "admin", "admin", http.StatusOK},
+			{&admin, "", "", http.StatusUnauthorized},
+			{&admin, "admin", "wrong", http.StatusUnauthorized},
+			{&backup, "admin", "admin", http.StatusUnauthorized},
+		} {
+			status, err := testTLSGet(t, srv, tc.cert, tc.username, tc.password)
+			require.NoError(t, err)
+			require.Equal(t, tc.status, status)
+		}
+	})
+
+	t.Run("Email", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestTLSServer(t, fmt.Sprintf(`
+directory: %s
+tls: true
+
+clientCerts:
+  ca: %s
+  username: email
+
+users:
+  - username: backup@example.org
+`, dir, caFile))
+		defer srv.Close()
+
+		cert := ca.issue(t, "backup", "other@example.org", "backup@example.org")
+		status, err := testTLSGet(t, srv, &cert, "", "")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, status)
+
+		status, err = testTLSGet(t, srv, &backup, "", "")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, status)
+
+		// Users without a password can only use certificates.
+		status, err = testTLSGet(t, srv, nil, "backup@example.org", "")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusUnauthorized, status)
+	})
+}
+
+func TestConfigClientCerts(t *testing.T) {
+	t.Parallel()
+
+	writeAndParseConfigWithError(t, `
+clientCerts:
+  ca: ca.pem
+`, ".yml", "tls must be enabled")
+
+	writeAndParseConfigWithError(t, `
+tls: true
+clientCerts:
+  ca: ca.pem
+  mode: always
+`, ".yml", `invalid mode "always"`)
+
+	writeAndParseConfigWithError(t, `
+tls: true
+clientCerts:
+  ca: ca.pem
+  requirePassword: true
+users:
+  - username: backup
+`, ".yml", "password must be set")
+
+	cfg := writeAndParseConfig(t, `
+tls: true
+clientCerts:
+  ca: ca.pem
+`, ".yml")
+	require.Equal(t, ClientCertVerifyIfGiven, cfg.ClientCerts.Mode)
+	require.Equal(t, ClientCertUsernameCommonName, cfg.ClientCerts.Username)
+}
@@ -1,12 +1,15 @@
 package lib
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/pflag"
@@ -27,20 +30,37 @@ const (
 var errDirectoryConflict = errors.New("directory and directories cannot both be defined")
 
 type Config struct {
-	UserPermissions `mapstructure:",squash"`
-	Debug           bool
-	Address         string
-	Port            int
-	TLS             bool
-	Cert            string
-	Key             string
-	Prefix          string
-	NoSniff         bool
-	NoPassword      bool
-	BehindProxy     bool
-	Log             Log
-	CORS            CORS
-	Users           []User
+	UserPermissions   `mapstructure:",squash"`
+	Debug             bool
+	Address           string
+	Port              int
+	TLS               bool
+	Cert              string
+	Key               string
+	ClientCerts       ClientCerts
+	Prefix            string
+	NoSniff           bool
+	HideUnreadable    bool
+	NoPassword        bool
+	BehindProxy       bool
+	TrustedProxies    []string
+	trustedProxies    []netip.Prefix
+	Log               Log
+	CORS              CORS
+	Users             []User
+	Groups            []Group
+	UsersFile         string
+	LDAP              LDAP
+	JWT               JWT
+	ProxyAuth         ProxyAuth
+	BruteForce        BruteForce
+	DigestAuth        DigestAuth
+	Anonymous         *UserPermissions
+	Shares            Shares
+	PasswordCache     PasswordCache
+	StateFile         string
+	Homes             Homes
+	AuthorizationHook AuthorizationHook
 }
 
 func ParseConfig(filename string, flags *pflag.FlagSet) (*Config, error) {
@@ -85,7 +105,9 @@ func ParseConfig(filename string, flags *pflag.FlagSet) (*Config, error) {
 	v.SetDefault("Permissions", "R")
 	v.SetDefault("Debug", false)
 	v.SetDefault("NoSniff", false)
+	v.SetDefault("HideUnreadable", false)
 	v.SetDefault("NoPassword", false)
+	v.SetDefault("Homes.Mode", DefaultHomeMode)
 	v.SetDefault("Log.Format", "console")
 	v.SetDefault("Log.Outputs", []string{"stderr"})
 	v.SetDefault("Log.Colors", true)
@@ -104,9 +126,7 @@ func ParseConfig(filename string, flags *pflag.FlagSet) (*Config, error) {
 	cfg := &Config{}
 	err = v.Unmarshal(cfg, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
 		directoryMountsDecodeHook(),
-		mapstructure.StringToTimeDurationHookFunc(),
-		mapstructure.StringToSliceHookFunc(","),
-		mapstructure.TextUnmarshallerHookFunc(),
+		valuesDecodeHook(),
 	)))
 	if err != nil {
 		return nil, err
@@ -117,43 +137,90 @@ func ParseConfig(filename string, flags *pflag.FlagSet) (*Config, error) {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
+	// Cascade group settings, keeping the settings as written to apply them
+	// on top of each other for the users that reference several groups.
+	groups := map[string]int{}
+	ownGroups := make([]UserPermissions, len(cfg.Groups))
+	for i := range cfg.Groups {
+		if _, ok := groups[cfg.Groups[i].Name]; ok {
+			return nil, fmt.Errorf("invalid config: group %q is defined more than once", cfg.Groups[i].Name)
+		}
+		groups[cfg.Groups[i].Name] = i
+		ownGroups[i] = cfg.Groups[i].UserPermissions
+
+		err := cascadeUserPermissions(v, flags, fmt.Sprintf("Groups.%d", i), &cfg.Groups[i].UserPermissions, &cfg.UserPermissions)
+		if err != nil {
+			if errors.Is(err, errDirectoryConflict) {
+				return nil, fmt.Errorf("invalid config: group %q cannot define both directory and directories", cfg.Groups[i].Name)
+			}
+			return nil, fmt.Errorf("invalid config: group %q: %w", cfg.Groups[i].Name, err)
+		}
+	}
+
 	// Cascade user settings
 	for i := range cfg.Users {
-		userDirectoryKey := fmt.Sprintf("Users.%d.Directory", i)
-		userDirectoriesKey := fmt.Sprintf("Users.%d.Directories", i)
+		inherited := &cfg.UserPermissions
+		for _, name := range cfg.Users[i].Groups {
+			j, ok := groups[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid config: user %q: unknown group %q", cfg.Users[i].Username, name)
+			}
 
-		if !v.IsSet(userDirectoryKey) {
-			cfg.Users[i].Directory = cfg.Directory
+			group := ownGroups[j]
+			err := cascadeUserPermissions(v, flags, fmt.Sprintf("Groups.%d", j), &group, inherited)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config: user %q: group %q: %w", cfg.Users[i].Username, name, err)
+			}
+			inherited = &group
 		}
 
-		err := applyDirectoryConfig(v, flags, &cfg.Users[i].UserPermissions, userDirectoryKey, userDirectoriesKey, &cfg.UserPermissions)
+		err := cascadeUserPermissions(v, flags, fmt.Sprintf("Users.%d", i), &cfg.Users[i].UserPermissions, inherited)
 		if err != nil {
 			if errors.Is(err, errDirectoryConflict) {
 				return nil, fmt.Errorf("invalid config: user %q cannot define both directory and directories", cfg.Users[i].Username)
 			}
 			return nil, fmt.Errorf("invalid config: user %q: %w", cfg.Users[i].Username, err)
 		}
+	}
+
+	// Cascade LDAP group settings
+	for i := range cfg.LDAP.Groups {
+		err := cascadeUserPermissions(v, flags, fmt.Sprintf("LDAP.Groups.%d", i), &cfg.LDAP.Groups[i].UserPermissions, &cfg.UserPermissions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: ldap group %q: %w", cfg.LDAP.Groups[i].DN, err)
+		}
+	}
 
-		if !v.IsSet(fmt.Sprintf("Users.%d.Permissions", i)) {
-			cfg.Users[i].Permissions = cfg.Permissions
+	// Cascade JWT template user settings
+	if cfg.JWT.Template != nil {
+		err := cascadeUserPermissions(v, flags, "JWT.Template", cfg.JWT.Template, &cfg.UserPermissions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: jwt template: %w", err)
 		}
+	}
 
-		if !v.IsSet(fmt.Sprintf("Users.%d.RulesBehavior", i)) {
-			cfg.Users[i].RulesBehavior = cfg.RulesBehavior
+	// Cascade proxy authentication template user settings
+	if cfg.ProxyAuth.Template != nil {
+		err := cascadeUserPermissions(v, flags, "ProxyAuth.Template", cfg.ProxyAuth.Template, &cfg.UserPermissions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: proxy auth template: %w", err)
 		}
+	}
 
-		if v.IsSet(fmt.Sprintf("Users.%d.Rules", i)) {
-			switch cfg.Users[i].RulesBehavior {
-			case RulesOverwrite:
-				// Do nothing
-			case RulesAppend:
-				rules := append([]*Rule{}, cfg.Rules...)
-				rules = append(rules, cfg.Users[i].Rules...)
+	// Cascade anonymous user settings. Unlike other users, anonymous requests
+	// only get the permissions and rules that are explicitly given to them.
+	if cfg.Anonymous != nil {
+		err := cascadeUserPermissions(v, flags, "Anonymous", cfg.Anonymous, &cfg.UserPermissions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: anonymous: %w", err)
+		}
 
-				cfg.Users[i].Rules = rules
-			}
-		} else {
-			cfg.Users[i].Rules = cfg.Rules
+		if !v.IsSet("Anonymous.Permissions") {
+			cfg.Anonymous.Permissions = Permissions{}
+		}
+
+		if !v.IsSet("Anonymous.Rules") {
+			cfg.Anonymous.Rules = nil
 		}
 	}
 
@@ -162,9 +229,64 @@ func ParseConfig(filename string, flags *pflag.FlagSet) (*Config, error) {
 		return nil, err
 	}
 
+	// Expand the {username} placeholders of users. Those of users that are
+	// only known once they log in are expanded then.
+	for i := range cfg.Users {
+		cfg.Users[i].UserPermissions, err = cfg.Users[i].UserPermissions.forUser(cfg.Users[i].Username)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: user %q: %w", cfg.Users[i].Username, err)
+		}
+	}
+
 	return cfg, nil
 }
 
+// cascadeUserPermissions sets the settings of p that are not defined under
+// key to the ones in global, such as for a user that defines no directory.
+func cascadeUserPermissions(v *viper.Viper, flags *pflag.FlagSet, key string, p *UserPermissions, global *UserPermissions) error {
+	directoryKey := key + ".Directory"
+	directoriesKey := key + ".Directories"
+
+	if !v.IsSet(directoryKey) {
+		p.Directory = global.Directory
+	}
+
+	err := applyDirectoryConfig(v, flags, p, directoryKey, directoriesKey, global)
+	if err != nil {
+		return err
+	}
+
+	if !v.IsSet(key + ".Permissions") {
+		p.Permissions = global.Permissions
+	}
+
+	if !v.IsSet(key + ".Quota") {
+		p.Quota = global.Quota
+	}
+
+	p.UploadFilter.cascade(v, key, global.UploadFilter)
+
+	if !v.IsSet(key + ".RulesBehavior") {
+		p.RulesBehavior = global.RulesBehavior
+	}
+
+	if v.IsSet(key + ".Rules") {
+		switch p.RulesBehavior {
+		case RulesOverwrite:
+			// Do nothing
+		case RulesAppend:
+			rules := append([]*Rule{}, global.Rules...)
+			rules = append(rules, p.Rules...)
+
+			p.Rules = rules
+		}
+	} else {
+		p.Rules = global.Rules
+	}
+
+	return nil
+}
+
 func applyDirectoryConfig(v *viper.Viper, flags *pflag.FlagSet, permissions *UserPermissions, directoryKey, directoriesKey string, inherited *UserPermissions) error {
 	permissions.directoryExplicit = isExplicitlySet(v, flags, directoryKey)
 	permissions.directoriesExplicit = isExplicitlySet(v, flags, directoriesKey)
@@ -238,8 +360,109 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid config: %w", err)
 	}
 
+	if c.UsersFile != "" {
+		c.UsersFile, err = filepath.Abs(c.UsersFile)
+		if err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+
+	if len(c.TrustedProxies) > 0 && !c.BehindProxy {
+		return errors.New("invalid config: trustedProxies requires behindProxy")
+	}
+
+	c.trustedProxies = make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for _, value := range c.TrustedProxies {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return fmt.Errorf("invalid config: trustedProxies: %w", err)
+		}
+		c.trustedProxies = append(c.trustedProxies, prefix)
+	}
+
+	err = c.ClientCerts.Validate(c.TLS)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	// Users can omit their password when LDAP, JWT, client certificates or a
+	// proxy authenticate them.
+	noPassword := c.NoPassword || c.LDAP.URL != "" || c.JWT.JWKS != "" ||
+		(c.ClientCerts.CA != "" && !c.ClientCerts.RequirePassword) || c.ProxyAuth.Header != ""
+
+	for i := range c.Groups {
+		err := c.Groups[i].Validate()
+		if err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+
 	for i := range c.Users {
-		err := c.Users[i].Validate(c.NoPassword)
+		err := c.Users[i].Validate(noPassword)
+		if err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+
+	if c.Anonymous != nil {
+		err = c.Anonymous.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid config: anonymous: %w", err)
+		}
+
+		// Anonymous requests have no username to replace the placeholders with.
+		if c.Anonymous.hasUsernamePlaceholder() {
+			return fmt.Errorf("invalid config: anonymous: %s cannot be used, give anonymous requests their own directory", UsernamePlaceholder)
+		}
+	}
+
+	err = c.LDAP.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	err = c.JWT.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	err = c.ProxyAuth.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	err = c.DigestAuth.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	err = c.AuthorizationHook.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	err = c.Shares.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	err = c.PasswordCache.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	err = c.BruteForce.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	err = c.Homes.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	if c.StateFile != "" {
+		c.StateFile, err = filepath.Abs(c.StateFile)
 		if err != nil {
 			return fmt.Errorf("invalid config: %w", err)
 		}
@@ -248,6 +471,17 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// valuesDecodeHook decodes the values of the configuration that are given as
+// strings, such as durations, times and permissions.
+func valuesDecodeHook() mapstructure.DecodeHookFunc {
+	return mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+		mapstructure.StringToSliceHookFunc(","),
+		mapstructure.TextUnmarshallerHookFunc(),
+	)
+}
+
 func directoryMountsDecodeHook() mapstructure.DecodeHookFunc {
 	mountsType := reflect.TypeOf(DirectoryMounts{})
 
@@ -338,12 +572,29 @@ func decodeDirectoryMountMap(data map[string]any) (DirectoryMount, error) {
 	_, hasName := data["name"]
 	_, hasPath := data["path"]
 	if hasName || hasPath {
-		name, nameOK := data["name"].(string)
-		path, pathOK := data["path"].(string)
-		if !nameOK || !pathOK || len(data) != 2 {
+		// Mounts that are not local directories have no path.
+		_, nameOK := data["name"].(string)
+		_, pathOK := data["path"].(string)
+		if !nameOK || (!pathOK && data["type"] == nil) {
 			return DirectoryMount{}, errors.New("invalid directories: explicit mount objects must define name and path")
 		}
-		return DirectoryMount{Name: name, Path: path}, nil
+
+		// Explicit mount objects can also have the settings of the mount.
+		var mount DirectoryMount
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			DecodeHook:       valuesDecodeHook(),
+			WeaklyTypedInput: true,
+			ErrorUnused:      true,
+			Result:           &mount,
+		})
+		if err != nil {
+			return DirectoryMount{}, err
+		}
+
+		if err := decoder.Decode(data); err != nil {
+			return DirectoryMount{}, fmt.Errorf("invalid directories: %w", err)
+		}
+		return mount, nil
 	}
 
 	if len(data) != 1 {
@@ -376,6 +627,33 @@ func (cfg *Config) GetLogger() (*zap.Logger, error) {
 	return loggerConfig.Build()
 }
 
+// GetTLSConfig returns the TLS configuration of the server, which requests
+// client certificates if they are configured.
+func (cfg *Config) GetTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.ClientCerts.CA == "" {
+		return tlsConfig, nil
+	}
+
+	pool, err := cfg.ClientCerts.pool()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.ClientCAs = pool
+	switch cfg.ClientCerts.Mode {
+	case ClientCertRequest:
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	case ClientCertVerifyIfGiven:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientCertRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
 type Log struct {
 	Format  string
 	Colors  bool
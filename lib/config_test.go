@@ -173,6 +173,40 @@ rules = []
 	})
 }
 
+func TestConfigAnonymous(t *testing.T) {
+	t.Parallel()
+
+	publicDirectory, err := filepath.Abs("/public")
+	require.NoError(t, err)
+
+	cfg := writeAndParseConfig(t, `
+directory: /public
+permissions: CRUD
+rules:
+  - path: /private/
+    permissions: none
+
+anonymous: {}
+`, ".yml")
+
+	// Anonymous requests get the directory, but not the permissions and rules
+	// of the other users.
+	require.NotNil(t, cfg.Anonymous)
+	require.Equal(t, publicDirectory, cfg.Anonymous.Directory)
+	require.Equal(t, Permissions{}, cfg.Anonymous.Permissions)
+	require.Empty(t, cfg.Anonymous.Rules)
+
+	cfg = writeAndParseConfig(t, `
+directory: /public
+anonymous:
+  permissions: R
+`, ".yml")
+	require.Equal(t, Permissions{Read: true}, cfg.Anonymous.Permissions)
+
+	cfg = writeAndParseConfig(t, "directory: /public", ".yml")
+	require.Nil(t, cfg.Anonymous)
+}
+
 func TestConfigDirectories(t *testing.T) {
 	t.Parallel()
 
@@ -395,6 +429,49 @@ rules:
 		writeAndParseConfigWithError(t, content, ".yaml", "must either define a path of a regex")
 	})
 
+	t.Run("Only One of Glob, Regex or Path", func(t *testing.T) {
+		content := `
+directory: /
+rules:
+  - glob: '/**/*.js'
+    path: /public/access/`
+
+		writeAndParseConfigWithError(t, content, ".yaml", "cannot define a glob with a path or a regex")
+	})
+
+	t.Run("Invalid Glob", func(t *testing.T) {
+		writeAndParseConfigWithError(t, `
+rules:
+  - glob: '/{a,b'`, ".yaml", "invalid glob")
+
+		writeAndParseConfigWithError(t, `
+rules:
+  - glob: '/secret/'`, ".yaml", `use "/secret/**"`)
+	})
+
+	t.Run("Parse Glob", func(t *testing.T) {
+		cfg := writeAndParseConfig(t, `
+rules:
+  - glob: '/secret/**'`, ".yaml")
+
+		require.Len(t, cfg.Rules, 1)
+		rule := cfg.Rules[0]
+		require.Equal(t, "/secret/**", rule.Glob)
+
+		for path, expected := range map[string][2]bool{
+			// Path: {Matches, matchesCollection}
+			"/secret":       {false, true},
+			"/secret/":      {true, false},
+			"/secret/a/b":   {true, false},
+			"/secret/a/b/":  {true, false},
+			"/secretive":    {false, false},
+			"/other/secret": {false, false},
+		} {
+			require.Equal(t, expected[0], rule.Matches(path), path)
+			require.Equal(t, expected[1], rule.matchesCollection(path), path)
+		}
+	})
+
 	t.Run("Parse", func(t *testing.T) {
 		content := `
 directory: /
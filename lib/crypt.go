@@ -0,0 +1,452 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// cryptAlphabet is the alphabet used by crypt(3) to encode salts and hashes.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptEncoding is only used to turn random bytes into valid salt characters.
+// The hashes themselves use the byte order of [cryptEncode].
+var cryptEncoding = base64.NewEncoding(cryptAlphabet).WithPadding(base64.NoPadding)
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSaltLength = 16
+)
+
+// shaCryptVariant implements the SHA-crypt scheme by Ulrich Drepper, as used
+// by glibc for the "$5$" and "$6$" hashes.
+type shaCryptVariant struct {
+	magic string
+	hash  func() hash.Hash
+	// order lists the digest bytes in the order they are encoded, in groups
+	// of three.
+	order []int
+}
+
+var sha256Crypt = shaCryptVariant{
+	magic: "$5$",
+	hash:  sha256.New,
+	order: []int{
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14, 15, 25, 5, 6, 16, 26,
+		27, 7, 17, 18, 28, 8, 9, 19, 29, 31, 30,
+	},
+}
+
+var sha512Crypt = shaCryptVariant{
+	magic: "$6$",
+	hash:  sha512.New,
+	order: []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4, 47, 5, 26, 6, 27, 48,
+		28, 49, 7, 50, 8, 29, 9, 30, 51, 31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55,
+		13, 56, 14, 35, 15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41, 63,
+	},
+}
+
+// parse splits a "$6$rounds=N$salt$hash" string into its rounds and salt. The
+// hash itself is optional, so that parse accepts a bare setting too.
+func (v shaCryptVariant) parse(setting string) (rounds int, customRounds bool, salt string, err error) {
+	if !strings.HasPrefix(setting, v.magic) {
+		return 0, false, "", errors.New("expected " + v.magic + " prefix")
+	}
+
+	rest := strings.TrimPrefix(setting, v.magic)
+	rounds = shaCryptDefaultRounds
+
+	if strings.HasPrefix(rest, "rounds=") {
+		value, after, ok := strings.Cut(strings.TrimPrefix(rest, "rounds="), "$")
+		if !ok {
+			return 0, false, "", errors.New("invalid rounds")
+		}
+
+		rounds, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, false, "", errors.New("invalid rounds")
+		}
+
+		rounds = min(max(rounds, shaCryptMinRounds), shaCryptMaxRounds)
+		customRounds = true
+		rest = after
+	}
+
+	salt, _, _ = strings.Cut(rest, "$")
+	if len(salt) > shaCryptMaxSaltLength {
+		salt = salt[:shaCryptMaxSaltLength]
+	}
+
+	return rounds, customRounds, salt, nil
+}
+
+// crypt hashes password with the rounds and salt from setting, returning the
+// full "$6$...$hash" string.
+func (v shaCryptVariant) crypt(password []byte, setting string) (string, error) {
+	rounds, customRounds, saltString, err := v.parse(setting)
+	if err != nil {
+		return "", err
+	}
+	salt := []byte(saltString)
+
+	b := v.hash()
+	b.Write(password)
+	b.Write(salt)
+	b.Write(password)
+	digestB := b.Sum(nil)
+
+	a := v.hash()
+	a.Write(password)
+	a.Write(salt)
+	for i := len(password); i > 0; i -= len(digestB) {
+		a.Write(digestB[:min(i, len(digestB))])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(password)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := v.hash()
+	for range password {
+		dp.Write(password)
+	}
+	p := repeatBytes(dp.Sum(nil), len(password))
+
+	ds := v.hash()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeatBytes(ds.Sum(nil), len(salt))
+
+	c := digestA
+	for i := range rounds {
+		h := v.hash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(v.magic)
+	if customRounds {
+		sb.WriteString("rounds=")
+		sb.WriteString(strconv.Itoa(rounds))
+		sb.WriteString("$")
+	}
+	sb.Write(salt)
+	sb.WriteString("$")
+	sb.WriteString(cryptEncode(c, v.order))
+	return sb.String(), nil
+}
+
+// md5CryptOrder lists the digest bytes in the order they are encoded by
+// [md5Crypt].
+var md5CryptOrder = []int{0, 6, 12, 1, 7, 13, 2, 8, 14, 3, 9, 15, 4, 10, 5, 11}
+
+// md5Crypt implements the MD5-crypt scheme by Poul-Henning Kamp, as used by
+// crypt(3) for "$1$" hashes and by Apache for "$apr1$" hashes, which only
+// differ in their magic. It returns the full "$1$salt$hash" string.
+func md5Crypt(password []byte, setting string) (string, error) {
+	var magic string
+	switch {
+	case strings.HasPrefix(setting, "$1$"):
+		magic = "$1$"
+	case strings.HasPrefix(setting, "$apr1$"):
+		magic = "$apr1$"
+	default:
+		return "", errors.New("expected $1$ or $apr1$ prefix")
+	}
+
+	salt, _, _ := strings.Cut(strings.TrimPrefix(setting, magic), "$")
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.New()
+	alternate.Write(password)
+	alternate.Write([]byte(salt))
+	alternate.Write(password)
+	digest := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(password)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(password); i > 0; i -= md5.Size {
+		ctx.Write(digest[:min(i, md5.Size)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(password[:1])
+		}
+	}
+	digest = ctx.Sum(nil)
+
+	for i := range 1000 {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(digest)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(password)
+		}
+		if i&1 != 0 {
+			h.Write(digest)
+		} else {
+			h.Write(password)
+		}
+		digest = h.Sum(nil)
+	}
+
+	return magic + salt + "$" + cryptEncode(digest, md5CryptOrder), nil
+}
+
+// repeatBytes returns the first n bytes of data repeated as often as needed.
+func repeatBytes(data []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, data[:min(len(data), n-len(out))]...)
+	}
+	return out
+}
+
+// cryptEncode encodes the digest bytes in the given order with the crypt(3)
+// alphabet. Every group of three bytes is encoded as four characters, least
+// significant bits first, and a trailing partial group uses fewer characters.
+func cryptEncode(digest []byte, order []int) string {
+	var sb strings.Builder
+	for i := 0; i < len(order); i += 3 {
+		group := order[i:min(i+3, len(order))]
+
+		var w uint
+		for _, index := range group {
+			w = w<<8 | uint(digest[index])
+		}
+
+		for range len(group) + 1 {
+			sb.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return sb.String()
+}
+
+// The tables below are the standard DES tables from FIPS 46-3, numbered from
+// one. They are only used by [desCrypt], which works on one bit per byte for
+// clarity rather than speed.
+var (
+	desInitialPermutation = [64]byte{
+		58, 50, 42, 34, 26, 18, 10, 2, 60, 52, 44, 36, 28, 20, 12, 4,
+		62, 54, 46, 38, 30, 22, 14, 6, 64, 56, 48, 40, 32, 24, 16, 8,
+		57, 49, 41, 33, 25, 17, 9, 1, 59, 51, 43, 35, 27, 19, 11, 3,
+		61, 53, 45, 37, 29, 21, 13, 5, 63, 55, 47, 39, 31, 23, 15, 7,
+	}
+	desFinalPermutation = [64]byte{
+		40, 8, 48, 16, 56, 24, 64, 32, 39, 7, 47, 15, 55, 23, 63, 31,
+		38, 6, 46, 14, 54, 22, 62, 30, 37, 5, 45, 13, 53, 21, 61, 29,
+		36, 4, 44, 12, 52, 20, 60, 28, 35, 3, 43, 11, 51, 19, 59, 27,
+		34, 2, 42, 10, 50, 18, 58, 26, 33, 1, 41, 9, 49, 17, 57, 25,
+	}
+	desExpansion = [48]byte{
+		32, 1, 2, 3, 4, 5, 4, 5, 6, 7, 8, 9,
+		8, 9, 10, 11, 12, 13, 12, 13, 14, 15, 16, 17,
+		16, 17, 18, 19, 20, 21, 20, 21, 22, 23, 24, 25,
+		24, 25, 26, 27, 28, 29, 28, 29, 30, 31, 32, 1,
+	}
+	desPermutation = [32]byte{
+		16, 7, 20, 21, 29, 12, 28, 17, 1, 15, 23, 26, 5, 18, 31, 10,
+		2, 8, 24, 14, 32, 27, 3, 9, 19, 13, 30, 6, 22, 11, 4, 25,
+	}
+	desPermutedChoice1 = [56]byte{
+		57, 49, 41, 33, 25, 17, 9, 1, 58, 50, 42, 34, 26, 18,
+		10, 2, 59, 51, 43, 35, 27, 19, 11, 3, 60, 52, 44, 36,
+		63, 55, 47, 39, 31, 23, 15, 7, 62, 54, 46, 38, 30, 22,
+		14, 6, 61, 53, 45, 37, 29, 21, 13, 5, 28, 20, 12, 4,
+	}
+	desPermutedChoice2 = [48]byte{
+		14, 17, 11, 24, 1, 5, 3, 28, 15, 6, 21, 10,
+		23, 19, 12, 4, 26, 8, 16, 7, 27, 20, 13, 2,
+		41, 52, 31, 37, 47, 55, 30, 40, 51, 45, 33, 48,
+		44, 49, 39, 56, 34, 53, 46, 42, 50, 36, 29, 32,
+	}
+	desRotations = [16]int{1, 1, 2, 2, 2, 2, 2, 2, 1, 2, 2, 2, 2, 2, 2, 1}
+	desSBoxes    = [8][64]byte{{
+		14, 4, 13, 1, 2, 15, 11, 8, 3, 10, 6, 12, 5, 9, 0, 7,
+		0, 15, 7, 4, 14, 2, 13, 1, 10, 6, 12, 11, 9, 5, 3, 8,
+		4, 1, 14, 8, 13, 6, 2, 11, 15, 12, 9, 7, 3, 10, 5, 0,
+		15, 12, 8, 2, 4, 9, 1, 7, 5, 11, 3, 14, 10, 0, 6, 13,
+	}, {
+		15, 1, 8, 14, 6, 11, 3, 4, 9, 7, 2, 13, 12, 0, 5, 10,
+		3, 13, 4, 7, 15, 2, 8, 14, 12, 0, 1, 10, 6, 9, 11, 5,
+		0, 14, 7, 11, 10, 4, 13, 1, 5, 8, 12, 6, 9, 3, 2, 15,
+		13, 8, 10, 1, 3, 15, 4, 2, 11, 6, 7, 12, 0, 5, 14, 9,
+	}, {
+		10, 0, 9, 14, 6, 3, 15, 5, 1, 13, 12, 7, 11, 4, 2, 8,
+		13, 7, 0, 9, 3, 4, 6, 10, 2, 8, 5, 14, 12, 11, 15, 1,
+		13, 6, 4, 9, 8, 15, 3, 0, 11, 1, 2, 12, 5, 10, 14, 7,
+		1, 10, 13, 0, 6, 9, 8, 7, 4, 15, 14, 3, 11, 5, 2, 12,
+	}, {
+		7, 13, 14, 3, 0, 6, 9, 10, 1, 2, 8, 5, 11, 12, 4, 15,
+		13, 8, 11, 5, 6, 15, 0, 3, 4, 7, 2, 12, 1, 10, 14, 9,
+		10, 6, 9, 0, 12, 11, 7, 13, 15, 1, 3, 14, 5, 2, 8, 4,
+		3, 15, 0, 6, 10, 1, 13, 8, 9, 4, 5, 11, 12, 7, 2, 14,
+	}, {
+		2, 12, 4, 1, 7, 10, 11, 6, 8, 5, 3, 15, 13, 0, 14, 9,
+		14, 11, 2, 12, 4, 7, 13, 1, 5, 0, 15, 10, 3, 9, 8, 6,
+		4, 2, 1, 11, 10, 13, 7, 8, 15, 9, 12, 5, 6, 3, 0, 14,
+		11, 8, 12, 7, 1, 14, 2, 13, 6, 15, 0, 9, 10, 4, 5, 3,
+	}, {
+		12, 1, 10, 15, 9, 2, 6, 8, 0, 13, 3, 4, 14, 7, 5, 11,
+		10, 15, 4, 2, 7, 12, 9, 5, 6, 1, 13, 14, 0, 11, 3, 8,
+		9, 14, 15, 5, 2, 8, 12, 3, 7, 0, 4, 10, 1, 13, 11, 6,
+		4, 3, 2, 12, 9, 5, 15, 10, 11, 14, 1, 7, 6, 0, 8, 13,
+	}, {
+		4, 11, 2, 14, 15, 0, 8, 13, 3, 12, 9, 7, 5, 10, 6, 1,
+		13, 0, 11, 7, 4, 9, 1, 10, 14, 3, 5, 12, 2, 15, 8, 6,
+		1, 4, 11, 13, 12, 3, 7, 14, 10, 15, 6, 8, 0, 5, 9, 2,
+		6, 11, 13, 8, 1, 4, 10, 7, 9, 5, 0, 15, 14, 2, 3, 12,
+	}, {
+		13, 2, 8, 4, 6, 15, 11, 1, 10, 9, 3, 14, 5, 0, 12, 7,
+		1, 15, 13, 8, 10, 3, 7, 4, 12, 5, 6, 11, 0, 14, 9, 2,
+		7, 11, 4, 1, 9, 12, 14, 2, 0, 6, 10, 13, 15, 3, 5, 8,
+		2, 1, 14, 7, 4, 10, 8, 13, 15, 12, 9, 0, 3, 5, 6, 11,
+	}}
+)
+
+// desCrypt implements the traditional crypt(3) scheme from Version 7 Unix,
+// with a two character salt and passwords truncated to eight characters. It
+// returns the full thirteen character hash.
+func desCrypt(password []byte, setting string) (string, error) {
+	if len(setting) < 2 || !strings.ContainsRune(cryptAlphabet, rune(setting[0])) || !strings.ContainsRune(cryptAlphabet, rune(setting[1])) {
+		return "", errors.New("invalid salt")
+	}
+
+	// The key uses the seven low bits of each of the first eight characters,
+	// leaving the parity bits unset.
+	var key [64]byte
+	for i := 0; i < 8 && i < len(password); i++ {
+		for j := range 7 {
+			key[i*8+j] = (password[i] >> (6 - j)) & 1
+		}
+	}
+
+	var cd [56]byte
+	for i, bit := range desPermutedChoice1 {
+		cd[i] = key[bit-1]
+	}
+
+	var subkeys [16][48]byte
+	for round, rotation := range desRotations {
+		for range rotation {
+			c0, d0 := cd[0], cd[28]
+			copy(cd[0:27], cd[1:28])
+			copy(cd[28:55], cd[29:56])
+			cd[27], cd[55] = c0, d0
+		}
+		for i, bit := range desPermutedChoice2 {
+			subkeys[round][i] = cd[bit-1]
+		}
+	}
+
+	// Each set bit of the salt swaps a pair of bits in the expansion, which
+	// is what makes the hash incompatible with plain DES.
+	expansion := desExpansion
+	for i := range 2 {
+		salt := strings.IndexByte(cryptAlphabet, setting[i])
+		for j := range 6 {
+			if (salt>>j)&1 != 0 {
+				k := 6*i + j
+				expansion[k], expansion[k+24] = expansion[k+24], expansion[k]
+			}
+		}
+	}
+
+	var block [64]byte
+	for range 25 {
+		var lr [64]byte
+		for i, bit := range desInitialPermutation {
+			lr[i] = block[bit-1]
+		}
+
+		for round := range 16 {
+			var f [48]byte
+			for i, bit := range expansion {
+				f[i] = lr[32+int(bit)-1] ^ subkeys[round][i]
+			}
+
+			var s [32]byte
+			for box := range 8 {
+				b := f[box*6 : box*6+6]
+				row := b[0]<<1 | b[5]
+				col := b[1]<<3 | b[2]<<2 | b[3]<<1 | b[4]
+				value := desSBoxes[box][int(row)*16+int(col)]
+				for j := range 4 {
+					s[box*4+j] = (value >> (3 - j)) & 1
+				}
+			}
+
+			var right [32]byte
+			for i, bit := range desPermutation {
+				right[i] = lr[i] ^ s[bit-1]
+			}
+			copy(lr[0:32], lr[32:64])
+			copy(lr[32:64], right[:])
+		}
+
+		// The halves are swapped once more after the last round.
+		var preoutput [64]byte
+		copy(preoutput[0:32], lr[32:64])
+		copy(preoutput[32:64], lr[0:32])
+		for i, bit := range desFinalPermutation {
+			block[i] = preoutput[bit-1]
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(setting[:2])
+	for i := range 11 {
+		var c byte
+		for j := range 6 {
+			c <<= 1
+			if k := i*6 + j; k < 64 {
+				c |= block[k]
+			}
+		}
+		sb.WriteByte(cryptAlphabet[c])
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,387 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DigestMD5    = "MD5"
+	DigestSHA256 = "SHA-256"
+
+	DefaultDigestRealm         = "Restricted"
+	DefaultDigestNonceLifetime = 5 * time.Minute
+)
+
+var (
+	errDigestStaleNonce      = errors.New("stale nonce")
+	errInvalidDigestResponse = errors.New("invalid response")
+)
+
+var digestHashes = map[string]func() hash.Hash{
+	DigestMD5:    md5.New,
+	DigestSHA256: sha256.New,
+}
+
+type DigestAuth struct {
+	Enabled bool
+	// Realm is part of the HA1 values of the users, so changing it requires
+	// generating them again.
+	Realm         string
+	Algorithms    []string
+	NonceLifetime time.Duration
+}
+
+func (d *DigestAuth) Validate() error {
+	if !d.Enabled {
+		return nil
+	}
+
+	if d.Realm == "" {
+		d.Realm = DefaultDigestRealm
+	}
+
+	if strings.ContainsAny(d.Realm, `"\`) {
+		return errors.New("invalid digest auth: realm cannot contain quotes or backslashes")
+	}
+
+	if len(d.Algorithms) == 0 {
+		d.Algorithms = []string{DigestSHA256, DigestMD5}
+	}
+
+	for i, algorithm := range d.Algorithms {
+		algorithm = strings.ToUpper(algorithm)
+		if _, ok := digestHashes[algorithm]; !ok {
+			return fmt.Errorf("invalid digest auth: unsupported algorithm %q", algorithm)
+		}
+		d.Algorithms[i] = algorithm
+	}
+
+	if d.NonceLifetime == 0 {
+		d.NonceLifetime = DefaultDigestNonceLifetime
+	}
+
+	return nil
+}
+
+// DigestHA1 returns the HA1 value of a user for Digest authentication, as
+// used in the digest option of users.
+func DigestHA1(algorithm, username, realm, password string) (string, error) {
+	newHash, ok := digestHashes[strings.ToUpper(algorithm)]
+	if !ok {
+		return "", fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+
+	return "{" + strings.ToLower(algorithm) + "}" + digestHash(newHash, username, realm, password), nil
+}
+
+func digestHash(newHash func() hash.Hash, values ...string) string {
+	h := newHash()
+	h.Write([]byte(strings.Join(values, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// validateDigestCredential validates a Digest credential of a user, which is
+// either an HA1 value prefixed with the algorithm, or a plaintext password.
+func validateDigestCredential(credential string) error {
+	name, ha1 := splitPasswordHash(credential)
+	if name == "" {
+		return nil
+	}
+
+	newHash, ok := digestHashes[strings.ToUpper(name)]
+	if !ok {
+		return fmt.Errorf("unknown digest algorithm %q", name)
+	}
+
+	if _, err := hex.DecodeString(ha1); err != nil || len(ha1) != newHash().Size()*2 {
+		return fmt.Errorf("invalid %s digest: expected %d hexadecimal characters", name, newHash().Size()*2)
+	}
+
+	return nil
+}
+
+// digestHA1 returns the HA1 value of the user for the algorithm, if the user
+// has a Digest credential for it. Users without Digest credentials can use
+// their password if it is in plaintext.
+func (u User) digestHA1(algorithm, realm string) (string, bool) {
+	credentials := u.Digest
+	if len(credentials) == 0 {
+		if name, _ := splitPasswordHash(u.Password); name != "" || u.Password == "" {
+			return "", false
+		}
+		credentials = []string{u.Password}
+	}
+
+	for _, credential := range credentials {
+		name, ha1 := splitPasswordHash(credential)
+		switch {
+		case name == "":
+			return digestHash(digestHashes[algorithm], u.Username, realm, credential), true
+		case strings.EqualFold(name, algorithm):
+			return strings.ToLower(ha1), true
+		}
+	}
+
+	return "", false
+}
+
+type digestAuthenticator struct {
+	DigestAuth
+	secret []byte
+	now    func() time.Time
+
+	// counts holds the last nonce count of the nonces in use, to detect
+	// replayed requests.
+	mu     sync.Mutex
+	counts map[string]uint64
+	pruned time.Time
+}
+
+func newDigestAuthenticator(d DigestAuth) (*digestAuthenticator, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &digestAuthenticator{
+		DigestAuth: d,
+		secret:     secret,
+		now:        time.Now,
+		counts:     map[string]uint64{},
+	}, nil
+}
+
+// nonce returns a new nonce. Nonces hold their creation time, and are signed
+// so that they do not need to be stored until they are used.
+func (a *digestAuthenticator) nonce() string {
+	data := make([]byte, 8+16, 8+16+sha256.Size)
+	binary.BigEndian.PutUint64(data, uint64(a.now().UnixNano()))
+	_, _ = rand.Read(data[8:])
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(data)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(data))
+}
+
+// checkNonce verifies the nonce, returning [errDigestStaleNonce] if it has
+// expired.
+func (a *digestAuthenticator) checkNonce(nonce string) (time.Time, error) {
+	data, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(data) != 8+16+sha256.Size {
+		return time.Time{}, errors.New("invalid nonce")
+	}
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(data[:8+16])
+	if !hmac.Equal(mac.Sum(nil), data[8+16:]) {
+		return time.Time{}, errors.New("invalid nonce")
+	}
+
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	if a.now().Sub(created) > a.NonceLifetime {
+		return created, errDigestStaleNonce
+	}
+
+	return created, nil
+}
+
+// useCount records the nonce count of a request, returning false if it is
+// not higher than the previous one for the same nonce.
+func (a *digestAuthenticator) useCount(nonce string, created time.Time, count uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	if now.Sub(a.pruned) > a.NonceLifetime {
+		a.pruned = now
+		for nonce := range a.counts {
+			if created, err := a.checkNonce(nonce); err != nil || now.Sub(created) > a.NonceLifetime {
+				delete(a.counts, nonce)
+			}
+		}
+	}
+
+	if count <= a.counts[nonce] {
+		return false
+	}
+
+	a.counts[nonce] = count
+	return true
+}
+
+// challenges sets the Digest challenges in w, one for each algorithm.
+func (a *digestAuthenticator) challenges(w http.ResponseWriter, stale bool) {
+	nonce := a.nonce()
+	for _, algorithm := range a.Algorithms {
+		challenge := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s"`, a.Realm, algorithm, nonce)
+		if stale {
+			challenge += ", stale=true"
+		}
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+}
+
+// staleDigestNonce reports whether the challenges in w tell the client to
+// retry with a new nonce.
+func staleDigestNonce(w http.ResponseWriter) bool {
+	for _, challenge := range w.Header().Values("WWW-Authenticate") {
+		if strings.HasSuffix(challenge, ", stale=true") {
+			return true
+		}
+	}
+	return false
+}
+
+type digestCredentials struct {
+	username  string
+	algorithm string
+	session   bool
+	nonce     string
+	uri       string
+	qop       string
+	nc        string
+	cnonce    string
+	response  string
+}
+
+// parseDigestCredentials parses the Digest credentials of a request.
+func parseDigestCredentials(r *http.Request) (*digestCredentials, bool) {
+	scheme, params, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Digest") {
+		return nil, false
+	}
+
+	values := parseAuthParams(params)
+	c := &digestCredentials{
+		username:  values["username"],
+		algorithm: strings.ToUpper(values["algorithm"]),
+		nonce:     values["nonce"],
+		uri:       values["uri"],
+		qop:       values["qop"],
+		nc:        values["nc"],
+		cnonce:    values["cnonce"],
+		response:  strings.ToLower(values["response"]),
+	}
+
+	if c.algorithm == "" {
+		c.algorithm = DigestMD5
+	}
+
+	if algorithm, ok := strings.CutSuffix(c.algorithm, "-SESS"); ok {
+		c.algorithm = algorithm
+		c.session = true
+	}
+
+	return c, true
+}
+
+// parseAuthParams parses the comma-separated list of parameters of an
+// Authorization header, whose values can be tokens or quoted strings.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			s = rest[end:]
+		}
+
+		params[name] = value.String()
+	}
+}
+
+// authenticate checks the Digest response of the request against the HA1
+// value of the user. It returns [errDigestStaleNonce] if the response is
+// correct but the nonce has expired, so that clients can retry without asking
+// for the credentials again.
+func (a *digestAuthenticator) authenticate(r *http.Request, c *digestCredentials, u User) error {
+	if !slices.Contains(a.Algorithms, c.algorithm) {
+		return fmt.Errorf("unsupported algorithm %q", c.algorithm)
+	}
+	newHash := digestHashes[c.algorithm]
+
+	ha1, ok := u.digestHA1(c.algorithm, a.Realm)
+	if !ok {
+		return fmt.Errorf("user has no %s digest credentials", c.algorithm)
+	}
+
+	if c.qop != "auth" || c.nc == "" || c.cnonce == "" {
+		return errors.New("unsupported quality of protection")
+	}
+
+	if c.uri != r.RequestURI {
+		return errors.New("uri does not match the request")
+	}
+
+	count, err := strconv.ParseUint(c.nc, 16, 64)
+	if err != nil {
+		return errors.New("invalid nonce count")
+	}
+
+	created, nonceErr := a.checkNonce(c.nonce)
+	if nonceErr != nil && !errors.Is(nonceErr, errDigestStaleNonce) {
+		return nonceErr
+	}
+
+	if c.session {
+		ha1 = digestHash(newHash, ha1, c.nonce, c.cnonce)
+	}
+
+	ha2 := digestHash(newHash, r.Method, c.uri)
+	expected := digestHash(newHash, ha1, c.nonce, c.nc, c.cnonce, c.qop, ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(c.response)) != 1 {
+		return errInvalidDigestResponse
+	}
+
+	if nonceErr != nil {
+		return nonceErr
+	}
+
+	if !a.useCount(c.nonce, created, count) {
+		return errors.New("nonce count was already used")
+	}
+
+	return nil
+}
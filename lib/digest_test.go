@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestHA1(t *testing.T) {
+	t.Parallel()
+
+	ha1, err := DigestHA1("md5", "Mufasa", "testrealm@host.com", "Circle Of Life")
+	require.NoError(t, err)
+	require.Equal(t, "{md5}939e7578ed9e3c518a452acee763bce9", ha1)
+	require.NoError(t, validateDigestCredential(ha1))
+
+	ha1, err = DigestHA1(DigestSHA256, "Mufasa", "http-auth@example.org", "Circle of Life")
+	require.NoError(t, err)
+	require.Equal(t, "{sha-256}7987c64c30e25f1b74be53f966b49b90f2808aa92faf9a00262392d7b4794232", ha1)
+	require.NoError(t, validateDigestCredential(ha1))
+
+	_, err = DigestHA1("SHA-512-256", "Mufasa", "testrealm@host.com", "Circle Of Life")
+	require.ErrorContains(t, err, "unsupported algorithm")
+
+	require.NoError(t, validateDigestCredential("plaintext"))
+	require.ErrorContains(t, validateDigestCredential("{md5}abc"), "expected 32 hexadecimal characters")
+	require.ErrorContains(t, validateDigestCredential("{sha-512}abc"), "unknown digest algorithm")
+}
+
+func TestParseAuthParams(t *testing.T) {
+	t.Parallel()
+
+	params := parseAuthParams(`username="Mufasa", realm="a \"quoted\", realm",nc=00000001 ,  qop=auth, uri="/dir/index.html"`)
+	require.Equal(t, map[string]string{
+		"username": "Mufasa",
+		"realm":    `a "quoted", realm`,
+		"nc":       "00000001",
+		"qop":      "auth",
+		"uri":      "/dir/index.html",
+	}, params)
+}
+
+func TestServerAuthenticationDigest(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"foo.txt": []byte("foo")})
+
+	ha1, err := DigestHA1(DigestSHA256, "bob", "WebDAV", "bob")
+	require.NoError(t, err)
+
+	cfg := writeAndParseConfig(t, fmt.Sprintf(`
+directory: %s
+
+digestAuth:
+  enabled: true
+  realm: WebDAV
+
+users:
+  - username: alice
+    password: alice
+  - username: bob
+    digest:
+      - "%s"
+  - username: carol
+    password: "{bcrypt}$2y$10$zEP6oofmXFeHaeMfBNLnP.DO8m.H.sJgLWN8xPQPxH/Xr8N6KMYEm"
+`, dir, ha1), ".yml")
+	require.NoError(t, cfg.Validate())
+
+	handler, err := NewHandler(cfg)
+	require.NoError(t, err)
+
+	now := time.Now()
+	handler.(*Handler).digest.now = func() time.Time { return now }
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	challenge := func() string {
+		resp, err := http.Get(srv.URL + "/foo.txt")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		challenges := resp.Header.Values("WWW-Authenticate")
+		require.Len(t, challenges, 3)
+		require.Equal(t, `Basic realm="Restricted"`, challenges[0])
+		require.True(t, strings.HasPrefix(challenges[1], `Digest realm="WebDAV", qop="auth", algorithm=SHA-256`))
+		require.True(t, strings.HasPrefix(challenges[2], `Digest realm="WebDAV", qop="auth", algorithm=MD5`))
+
+		params := parseAuthParams(strings.TrimPrefix(challenges[1], "Digest "))
+		return params["nonce"]
+	}
+
+	do := func(newHash func() hash.Hash, algorithm, username, password, nonce, nc string) *http.Response {
+		const uri, cnonce = "/foo.txt", "0a4f113b"
+		ha1 := digestHash(newHash, username, "WebDAV", password)
+		ha2 := digestHash(newHash, "GET", uri)
+		response := digestHash(newHash, ha1, nonce, nc, cnonce, "auth", ha2)
+
+		req, err := http.NewRequest("GET", srv.URL+uri, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", fmt.Sprintf(
+			`Digest username="%s", realm="WebDAV", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+			username, nonce, uri, algorithm, nc, cnonce, response,
+		))
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	// Users with a plaintext password can use any algorithm.
+	nonce := challenge()
+	require.Equal(t, http.StatusOK, do(sha256.New, DigestSHA256, "alice", "alice", nonce, "00000001").StatusCode)
+	require.Equal(t, http.StatusOK, do(md5.New, DigestMD5, "alice", "alice", nonce, "00000002").StatusCode)
+
+	// Nonce counts cannot be reused.
+	require.Equal(t, http.StatusUnauthorized, do(sha256.New, DigestSHA256, "alice", "alice", nonce, "00000002").StatusCode)
+
+	// Wrong passwords and unknown users are rejected.
+	require.Equal(t, http.StatusUnauthorized, do(sha256.New, DigestSHA256, "alice", "wrong", nonce, "00000003").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do(sha256.New, DigestSHA256, "mallory", "mallory", nonce, "00000004").StatusCode)
+
+	// Users with HA1 values can only use the algorithms they have values for,
+	// and cannot use Basic authentication.
+	require.Equal(t, http.StatusOK, do(sha256.New, DigestSHA256, "bob", "bob", nonce, "00000005").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do(md5.New, DigestMD5, "bob", "bob", nonce, "00000006").StatusCode)
+
+	req, err := http.NewRequest("GET", srv.URL+"/foo.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("bob", "bob")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Users with hashed passwords cannot use Digest authentication.
+	require.Equal(t, http.StatusUnauthorized, do(sha256.New, DigestSHA256, "carol", "carol", nonce, "00000007").StatusCode)
+
+	// Expired nonces are stale when the response is correct.
+	now = now.Add(DefaultDigestNonceLifetime + time.Second)
+	resp = do(sha256.New, DigestSHA256, "alice", "alice", nonce, "00000008")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	for _, challenge := range resp.Header.Values("WWW-Authenticate")[1:] {
+		require.True(t, strings.HasSuffix(challenge, ", stale=true"))
+	}
+
+	resp = do(sha256.New, DigestSHA256, "alice", "wrong", nonce, "00000009")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	for _, challenge := range resp.Header.Values("WWW-Authenticate") {
+		require.NotContains(t, challenge, "stale")
+	}
+
+	nonce = challenge()
+	require.Equal(t, http.StatusOK, do(sha256.New, DigestSHA256, "alice", "alice", nonce, "00000001").StatusCode)
+}
@@ -0,0 +1,271 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+)
+
+// Explanation is a trace of how the permissions of a user decide a request.
+type Explanation struct {
+	Method string
+
+	// Permissions and Rules are the effective permissions and rules of the
+	// user, after those of the groups and the global ones have been applied.
+	// The rules of directory mounts come after those of the user.
+	Permissions Permissions
+	Rules       []ExplainedRule
+
+	// Source is how the request path was decided, and Destination how the
+	// destination of a COPY or MOVE request was, if any.
+	Source      PathDecision
+	Destination *PathDecision
+
+	Allowed bool
+}
+
+// ExplainedRule is one of the effective rules of a user.
+type ExplainedRule struct {
+	*Rule
+
+	// Mount is the name of the directory mount that the rule belongs to, if
+	// any. Such rules are matched against paths within the mount.
+	Mount string
+}
+
+// PathDecision is how the permissions for a single path were decided.
+type PathDecision struct {
+	Path   string
+	Exists bool
+
+	// Mount is the name of the directory mount that Path is in, if any, and
+	// Permissions are those that apply to Path when no rule governs it: the
+	// ones of the user, narrowed to those of the mount if it defines them. If
+	// ReadOnly is set, the mount denies all changes.
+	Mount       string
+	Permissions Permissions
+	ReadOnly    bool
+
+	// Rule is the index in the effective rules of the rule that governs Path,
+	// or -1 if the permissions of the user apply. If Collection is set, the
+	// rule governs Path as the collection it names, and the permissions of the
+	// user must allow the request too.
+	Rule       int
+	Collection bool
+
+	// Skipped are the indexes of the rules that match Path, but were skipped
+	// because their conditions are not met.
+	Skipped []int
+
+	Allowed bool
+}
+
+// explain decides r the same way as [UserPermissions.Allowed] does, and
+// returns how.
+func (p UserPermissions) explain(r *request, fileExists func(string) bool) Explanation {
+	var rules []ExplainedRule
+	for _, rule := range p.Rules {
+		rules = append(rules, ExplainedRule{Rule: rule})
+	}
+	if p.useDirectories {
+		for _, mount := range p.Directories {
+			for _, rule := range mount.Rules {
+				rules = append(rules, ExplainedRule{Rule: rule, Mount: mount.Name})
+			}
+		}
+	}
+
+	index := func(rule *Rule) int {
+		return slices.IndexFunc(rules, func(e ExplainedRule) bool { return e.Rule == rule })
+	}
+
+	decide := func(path string, check func(Permissions) bool) PathDecision {
+		rule, collection := p.ruleAt(r, path)
+		d := PathDecision{
+			Path:        path,
+			Exists:      fileExists(path),
+			Permissions: p.Permissions,
+			Rule:        index(rule),
+			Collection:  collection,
+			Allowed:     p.allowedAt(r, path, check),
+		}
+
+		if mount, _, ok := p.mountAt(path); ok {
+			d.Mount = mount.Name
+			d.ReadOnly = mount.ReadOnly
+			d.Permissions = mount.narrow(d.Permissions)
+		}
+
+		for _, rule := range p.rulesAt(path) {
+			if (rule.Matches(rule.path) || rule.matchesCollection(rule.path)) && !rule.conditionsMet(r) {
+				d.Skipped = append(d.Skipped, index(rule.Rule))
+			}
+		}
+
+		return d
+	}
+
+	e := Explanation{
+		Method:      r.method,
+		Permissions: p.Permissions,
+		Rules:       rules,
+		Source: decide(r.path, func(perms Permissions) bool {
+			return perms.Allowed(r, fileExists)
+		}),
+	}
+	e.Allowed = e.Source.Allowed
+
+	if r.method == "COPY" || r.method == "MOVE" {
+		destination := decide(r.destination, func(perms Permissions) bool {
+			return perms.AllowedDestination(r, fileExists)
+		})
+		e.Destination = &destination
+		e.Allowed = e.Allowed && destination.Allowed
+	}
+
+	return e
+}
+
+// fields returns the explanation as fields of a log entry.
+func (e Explanation) fields() []zap.Field {
+	decisionFields := func(prefix string, d PathDecision) []zap.Field {
+		fields := []zap.Field{
+			zap.String(prefix, d.Path),
+			zap.Bool(prefix+"_exists", d.Exists),
+			zap.Bool(prefix+"_allowed", d.Allowed),
+		}
+		if d.Mount != "" {
+			fields = append(fields,
+				zap.String(prefix+"_mount", d.Mount),
+				zap.Stringer(prefix+"_mount_permissions", d.Permissions),
+				zap.Bool(prefix+"_mount_read_only", d.ReadOnly),
+			)
+		}
+		if len(d.Skipped) > 0 {
+			fields = append(fields, zap.Ints(prefix+"_skipped_rules", d.Skipped))
+		}
+		if d.Rule >= 0 {
+			fields = append(fields,
+				zap.Int(prefix+"_rule", d.Rule),
+				zap.Stringer(prefix+"_rule_match", e.Rules[d.Rule].Rule),
+				zap.Bool(prefix+"_rule_collection", d.Collection),
+			)
+		}
+		return fields
+	}
+
+	fields := []zap.Field{
+		zap.String("method", e.Method),
+		zap.Stringer("permissions", e.Permissions),
+		zap.Int("rules", len(e.Rules)),
+	}
+	fields = append(fields, decisionFields("path", e.Source)...)
+	if e.Destination != nil {
+		fields = append(fields, decisionFields("destination", *e.Destination)...)
+	}
+	return append(fields, zap.Bool("allowed", e.Allowed))
+}
+
+// ExplainRequest is a request to explain with [Config.Explain].
+type ExplainRequest struct {
+	// Username is the user making the request. If empty, the global
+	// permissions are used.
+	Username string
+
+	Method      string
+	Path        string
+	Destination string
+
+	// RemoteAddr and Time are checked against the conditions of rules.
+	RemoteAddr netip.Addr
+	Time       time.Time
+}
+
+// Explain returns how the request would be decided by the permissions of the
+// configuration. Paths are request paths, including the prefix. Users are
+// looked up in the configuration, and then in the users file, if any.
+func (c *Config) Explain(ctx context.Context, er ExplainRequest) (*Explanation, error) {
+	p := c.UserPermissions
+	if er.Username != "" {
+		user, err := c.findUser(er.Username)
+		if err != nil {
+			return nil, err
+		}
+		p, err = user.UserPermissions.forUser(user.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, strings.ToUpper(er.Method), er.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if er.Destination != "" {
+		httpRequest.Header.Set("Destination", er.Destination)
+	}
+
+	r, err := newRequest(httpRequest, c.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	r.remoteAddr = er.RemoteAddr
+	r.time = er.Time
+
+	fs := p.fileSystem(c.NoSniff)
+	fileExists := func(filename string) bool {
+		_, err := fs.Stat(ctx, filename)
+		return !os.IsNotExist(err)
+	}
+
+	e := p.explain(r, fileExists)
+	return &e, nil
+}
+
+// findUser returns the user with the given username from the configuration or
+// the users file. Users from LDAP are not known until they log in.
+func (c *Config) findUser(username string) (User, error) {
+	for _, u := range c.Users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+
+	if c.UsersFile != "" {
+		users, err := readUsersFile(c.UsersFile, c.UserPermissions)
+		if err != nil {
+			return User{}, err
+		}
+
+		for _, u := range users {
+			if u.Username == username {
+				return u, nil
+			}
+		}
+	}
+
+	return User{}, fmt.Errorf("user %q is not defined in the configuration", username)
+}
+
+// fileSystem returns the file system with the files of the user.
+func (p UserPermissions) fileSystem(noSniff bool) webdav.FileSystem {
+	if p.useDirectories {
+		return multiDir{
+			mounts:  p.Directories,
+			noSniff: noSniff,
+		}
+	}
+
+	return Dir{
+		Dir:     webdav.Dir(p.Directory),
+		noSniff: noSniff,
+	}
+}
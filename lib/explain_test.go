@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigExplain(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"a/x.txt": []byte("x"),
+		"b/y.txt": []byte("y"),
+	})
+
+	cfg := writeAndParseConfig(t, fmt.Sprintf(`
+directory: %s
+permissions: R
+rules:
+  - path: /a/
+    permissions: CRUD
+  - glob: "/b/**"
+    permissions: CRUD
+    sourceCIDRs: [10.0.0.0/8]
+users:
+  - username: alice
+    password: alice
+    rulesBehavior: append
+    rules:
+      - path: /c/
+        permissions: none
+`, dir), ".yml")
+
+	explain := func(r ExplainRequest) *Explanation {
+		r.Time = time.Now()
+		e, err := cfg.Explain(context.Background(), r)
+		require.NoError(t, err)
+		return e
+	}
+
+	// The destination is decided by the permissions of the user, since the
+	// rule for it is skipped.
+	e := explain(ExplainRequest{Username: "alice", Method: "move", Path: "/a/x.txt", Destination: "/b/x.txt"})
+	require.Equal(t, "MOVE", e.Method)
+	require.Equal(t, "R", e.Permissions.String())
+	require.Len(t, e.Rules, 3)
+	require.Equal(t, PathDecision{Path: "/a/x.txt", Exists: true, Permissions: Permissions{Read: true}, Rule: 0, Allowed: true}, e.Source)
+	require.Equal(t, &PathDecision{Path: "/b/x.txt", Permissions: Permissions{Read: true}, Rule: -1, Skipped: []int{1}}, e.Destination)
+	require.False(t, e.Allowed)
+
+	e = explain(ExplainRequest{Username: "alice", Method: "MOVE", Path: "/a/x.txt", Destination: "/b/x.txt", RemoteAddr: netip.MustParseAddr("10.0.0.1")})
+	require.Equal(t, &PathDecision{Path: "/b/x.txt", Permissions: Permissions{Read: true}, Rule: 1, Allowed: true}, e.Destination)
+	require.True(t, e.Allowed)
+
+	// Rules with a trailing slash govern the collection they name together
+	// with the permissions of the user.
+	e = explain(ExplainRequest{Username: "alice", Method: "PROPFIND", Path: "/c"})
+	require.Equal(t, PathDecision{Path: "/c", Permissions: Permissions{Read: true}, Rule: 2, Collection: true}, e.Source)
+	require.Nil(t, e.Destination)
+	require.False(t, e.Allowed)
+
+	e = explain(ExplainRequest{Method: "DELETE", Path: "/b/y.txt"})
+	require.Len(t, e.Rules, 2)
+	require.False(t, e.Allowed)
+
+	_, err := cfg.Explain(context.Background(), ExplainRequest{Username: "bob", Method: "GET", Path: "/"})
+	require.ErrorContains(t, err, `user "bob" is not defined`)
+}
+
+func TestPermissionsString(t *testing.T) {
+	t.Parallel()
+
+	for text, expected := range map[string]string{
+		"none": "none",
+		"rc":   "CR",
+		"DURC": "CRUD",
+	} {
+		var p Permissions
+		require.NoError(t, p.UnmarshalText([]byte(text)))
+		require.Equal(t, expected, p.String())
+	}
+}
@@ -0,0 +1,28 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Group holds settings shared by the users that reference it. Users get the
+// global settings first, then those of their groups, in order, and then their
+// own. Rules are combined in the same order, following the rules behavior of
+// each of them, so that the rules of users take precedence over those of their
+// groups, and those of later groups over those of earlier ones.
+type Group struct {
+	UserPermissions `mapstructure:",squash"`
+	Name            string
+}
+
+func (g *Group) Validate() error {
+	if g.Name == "" {
+		return errors.New("invalid group: name must be set")
+	}
+
+	if err := g.UserPermissions.Validate(); err != nil {
+		return fmt.Errorf("invalid group %q: %w", g.Name, err)
+	}
+
+	return nil
+}
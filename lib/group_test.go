@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestConfigGroups(t *testing.T) {
+	t.Parallel()
+
+	teamDirectory, err := filepath.Abs("/team")
+	require.NoError(t, err)
+	ownDirectory, err := filepath.Abs("/own")
+	require.NoError(t, err)
+
+	cfg := writeAndParseConfig(t, `
+directory: /
+permissions: R
+rulesBehavior: append
+rules:
+  - path: /global/
+
+groups:
+  - name: staff
+    permissions: RU
+    rules:
+      - path: /staff/
+  - name: team
+    directory: /team
+    rules:
+      - path: /team/
+  - name: isolated
+    rulesBehavior: overwrite
+    rules:
+      - path: /isolated/
+
+users:
+  - username: alice
+    password: alice
+    groups: [staff, team]
+    rules:
+      - path: /alice/
+  - username: bob
+    password: bob
+    groups: [team, staff]
+    permissions: CRUD
+    directory: /own
+  - username: carol
+    password: carol
+    groups: [staff, isolated]
+  - username: dave
+    password: dave
+`, ".yml")
+
+	paths := func(rules []*Rule) []string {
+		var paths []string
+		for _, rule := range rules {
+			paths = append(paths, rule.Path)
+		}
+		return paths
+	}
+
+	require.Len(t, cfg.Groups, 3)
+	require.Equal(t, Permissions{Read: true, Update: true}, cfg.Groups[0].Permissions)
+	require.Equal(t, []string{"/global/", "/staff/"}, paths(cfg.Groups[0].Rules))
+
+	// Settings are applied from the global ones, through the groups in order,
+	// to the user's own.
+	alice := cfg.Users[0]
+	require.Equal(t, Permissions{Read: true, Update: true}, alice.Permissions)
+	require.Equal(t, teamDirectory, alice.Directory)
+	require.Equal(t, []string{"/global/", "/staff/", "/team/", "/alice/"}, paths(alice.Rules))
+
+	bob := cfg.Users[1]
+	require.Equal(t, Permissions{Create: true, Read: true, Update: true, Delete: true}, bob.Permissions)
+	require.Equal(t, ownDirectory, bob.Directory)
+	require.Equal(t, []string{"/global/", "/team/", "/staff/"}, paths(bob.Rules))
+
+	// Groups can discard the rules that come before them.
+	carol := cfg.Users[2]
+	require.Equal(t, []string{"/isolated/"}, paths(carol.Rules))
+	require.Equal(t, RulesOverwrite, carol.RulesBehavior)
+
+	dave := cfg.Users[3]
+	require.Equal(t, Permissions{Read: true}, dave.Permissions)
+	require.Equal(t, []string{"/global/"}, paths(dave.Rules))
+
+	writeAndParseConfigWithError(t, `
+users:
+  - username: alice
+    password: alice
+    groups: [missing]
+`, ".yml", `user "alice": unknown group "missing"`)
+
+	writeAndParseConfigWithError(t, `
+groups:
+  - name: staff
+  - name: staff
+`, ".yml", `group "staff" is defined more than once`)
+
+	writeAndParseConfigWithError(t, `
+groups:
+  - permissions: R
+`, ".yml", "name must be set")
+}
+
+func TestServerGroups(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"shared/foo.txt":  []byte("foo"),
+		"private/bar.txt": []byte("bar"),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: R
+rulesBehavior: append
+
+groups:
+  - name: editors
+    rules:
+      - path: /shared/
+        permissions: CRUD
+      - path: /private/
+        permissions: none
+
+users:
+  - username: alice
+    password: alice
+    groups: [editors]
+    rules:
+      - path: /private/
+        permissions: R
+  - username: bob
+    password: bob
+    groups: [editors]
+`, dir))
+	defer srv.Close()
+
+	// Both get the rules of the group, and the rules of the user are checked
+	// before those of the group.
+	alice := gowebdav.NewClient(srv.URL, "alice", "alice")
+	require.NoError(t, alice.Write("/shared/new.txt", []byte("new"), 0666))
+	data, err := alice.Read("/private/bar.txt")
+	require.NoError(t, err)
+	require.EqualValues(t, []byte("bar"), data)
+
+	bob := gowebdav.NewClient(srv.URL, "bob", "bob")
+	require.NoError(t, bob.Write("/shared/other.txt", []byte("other"), 0666))
+	_, err = bob.Read("/private/bar.txt")
+	require.ErrorContains(t, err, "403")
+}
@@ -1,63 +1,236 @@
 package lib
 
 import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/cors"
 	"go.uber.org/zap"
 	"golang.org/x/net/webdav"
 )
 
+// lastLoginResolution is how often the last login time of a user is updated.
+const lastLoginResolution = time.Minute
+
 type handlerUser struct {
 	User
 	webdav.Handler
+
+	// appPassword is the app password the user authenticated with, if any,
+	// which restricts the user's permissions.
+	appPassword *AppPassword
+
+	// share holds the permissions of the share link of the request, if any,
+	// which restrict the user's permissions, and shareID the ID of the link.
+	share   *UserPermissions
+	shareID string
+
+	// quotas keeps the usage of the directories with quotas.
+	quotas *quotaTracker
+}
+
+// withAppPassword returns a copy of u restricted by the given app password.
+func (u *handlerUser) withAppPassword(app *AppPassword) *handlerUser {
+	if app == nil {
+		return u
+	}
+
+	return &handlerUser{User: u.User, Handler: u.Handler, appPassword: app, quotas: u.quotas}
+}
+
+// Allowed checks if the user, and its app password if any, allow the request.
+func (u *handlerUser) Allowed(r *request, fileExists func(string) bool) bool {
+	if u.appPassword != nil && !u.appPassword.Allowed(r, fileExists) {
+		return false
+	}
+
+	if u.share != nil && !u.share.Allowed(r, fileExists) {
+		return false
+	}
+
+	return u.User.Allowed(r, fileExists)
 }
 
 type Handler struct {
-	noPassword  bool
-	behindProxy bool
-	user        *handlerUser
+	noPassword     bool
+	proxies        reverseProxies
+	authentication bool
+	prefix         string
+	noSniff        bool
+	hideUnreadable bool
+	lockSystem     webdav.LockSystem
+	logFunc        func(*http.Request, error)
+	user           *handlerUser
+	anonymous      *handlerUser
+
+	// usersMu guards users, which can change when the users file is reloaded.
+	usersMu     sync.RWMutex
 	users       map[string]*handlerUser
+	configUsers []User
+	usersFile   string
+	watcher     *usersFileWatcher
+	permissions UserPermissions
+	ldap        *ldapAuthenticator
+	jwt         *jwtAuthenticator
+	clientCerts *clientCertAuthenticator
+	proxyAuth   *ProxyAuth
+	digest      *digestAuthenticator
+	shares      *Shares
+	authorizer  *authorizationHookClient
+	passwords   *passwordCache
+	quotas      *quotaTracker
+	homes       *homeCreator
+	state       *stateStore
+	bruteForce  *bruteForceLimiter
 }
 
+// NewHandler returns the handler for the configuration. The handler implements
+// [io.Closer], and must be closed once it is no longer used.
 func NewHandler(c *Config) (http.Handler, error) {
 	ls := webdav.NewMemLS()
+	proxies := reverseProxies{enabled: c.BehindProxy, trusted: c.trustedProxies}
 
 	logFunc := func(r *http.Request, err error) {
-		lZap := getRequestLogger(r, c.BehindProxy)
+		lZap := getRequestLogger(r, proxies)
 		lZap.Debug("handle webdav request", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(err))
 	}
 
 	h := &Handler{
-		noPassword:  c.NoPassword,
-		behindProxy: c.BehindProxy,
-		user: &handlerUser{
-			User:    User{UserPermissions: c.UserPermissions},
-			Handler: buildWebdavHandler(c.UserPermissions, c.Prefix, c.NoSniff, ls, logFunc),
-		},
-		users: map[string]*handlerUser{},
+		noPassword:     c.NoPassword,
+		proxies:        proxies,
+		authentication: len(c.Users) > 0 || c.UsersFile != "" || c.LDAP.URL != "" || c.JWT.JWKS != "" || c.ClientCerts.CA != "" || c.ProxyAuth.Header != "" || c.Anonymous != nil,
+		prefix:         c.Prefix,
+		noSniff:        c.NoSniff,
+		hideUnreadable: c.HideUnreadable,
+		lockSystem:     ls,
+		logFunc:        logFunc,
+		configUsers:    c.Users,
+		usersFile:      c.UsersFile,
+		permissions:    c.UserPermissions,
+		quotas:         newQuotaTracker(),
+	}
+
+	// Without authentication, requests use the global settings, which have no
+	// username to replace the placeholders with.
+	if !h.authentication && c.UserPermissions.hasUsernamePlaceholder() {
+		return nil, fmt.Errorf("invalid config: %s requires users", UsernamePlaceholder)
+	}
+
+	var err error
+	h.user, err = h.newHandlerUser(User{UserPermissions: c.UserPermissions})
+	if err != nil {
+		return nil, err
 	}
 
-	for _, u := range c.Users {
-		h.users[u.Username] = &handlerUser{
-			User:    u,
-			Handler: buildWebdavHandler(u.UserPermissions, c.Prefix, c.NoSniff, ls, logFunc),
+	if c.Anonymous != nil {
+		h.anonymous, err = h.newHandlerUser(User{UserPermissions: *c.Anonymous})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Homes.Create {
+		h.homes = newHomeCreator(c.Homes)
+	}
+
+	h.state, err = newStateStore(c.StateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.BruteForce.enabled() {
+		h.bruteForce = newBruteForceLimiter(c.BruteForce, h.state)
+	}
+
+	if c.LDAP.URL != "" {
+		h.ldap, err = newLDAPAuthenticator(c.LDAP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.JWT.JWKS != "" {
+		h.jwt, err = newJWTAuthenticator(c.JWT)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ClientCerts.CA != "" {
+		h.clientCerts, err = newClientCertAuthenticator(c.ClientCerts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ProxyAuth.Header != "" {
+		h.proxyAuth = &c.ProxyAuth
+	}
+
+	if c.PasswordCache.enabled() {
+		h.passwords, err = newPasswordCache(c.PasswordCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.AuthorizationHook.URL != "" {
+		h.authorizer = newAuthorizationHookClient(c.AuthorizationHook)
+	}
+
+	if c.Shares.enabled() {
+		h.shares = &c.Shares
+	}
+
+	if c.DigestAuth.Enabled {
+		h.digest, err = newDigestAuthenticator(c.DigestAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := h.loadUsers(); err != nil {
+		return nil, err
+	}
+
+	if c.UsersFile != "" {
+		h.watcher, err = watchUsersFile(c.UsersFile, func() {
+			if err := h.loadUsers(); err != nil {
+				zap.L().Error("failed to reload users file, keeping the previous users", zap.String("path", c.UsersFile), zap.Error(err))
+				return
+			}
+			zap.L().Info("reloaded users file", zap.String("path", c.UsersFile))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch users file: %w", err)
 		}
 	}
 
 	if c.CORS.Enabled {
-		return cors.New(cors.Options{
-			AllowCredentials:   c.CORS.Credentials,
-			AllowedOrigins:     c.CORS.AllowedHosts,
-			AllowedMethods:     c.CORS.AllowedMethods,
-			AllowedHeaders:     c.CORS.AllowedHeaders,
-			ExposedHeaders:     c.CORS.ExposedHeaders,
-			OptionsPassthrough: false,
-		}).Handler(h), nil
+		return closingHandler{
+			Handler: cors.New(cors.Options{
+				AllowCredentials:   c.CORS.Credentials,
+				AllowedOrigins:     c.CORS.AllowedHosts,
+				AllowedMethods:     c.CORS.AllowedMethods,
+				AllowedHeaders:     c.CORS.AllowedHeaders,
+				ExposedHeaders:     c.CORS.ExposedHeaders,
+				OptionsPassthrough: false,
+			}).Handler(h),
+			close: h.Close,
+		}, nil
 	}
 
-	if len(c.Users) == 0 {
+	if !h.authentication {
 		zap.L().Warn("unprotected config: no users have been set, so no authentication will be used")
 	}
 
@@ -68,66 +241,534 @@ func NewHandler(c *Config) (http.Handler, error) {
 	return h, nil
 }
 
+// Close stops the background work of the handler, such as watching the users
+// file.
+func (h *Handler) Close() error {
+	h.state.close()
+
+	if h.watcher != nil {
+		return h.watcher.Close()
+	}
+	return nil
+}
+
+// closingHandler is a handler that wraps a [Handler], and closes it.
+type closingHandler struct {
+	http.Handler
+	close func() error
+}
+
+func (c closingHandler) Close() error {
+	return c.close()
+}
+
+// newHandlerUser creates the [handlerUser] for u, sharing the lock system
+// with all other users. The {username} placeholders of u are replaced with
+// its name.
+func (h *Handler) newHandlerUser(u User) (*handlerUser, error) {
+	var err error
+	u.UserPermissions, err = u.UserPermissions.forUser(u.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Quota.enabled() {
+		h.quotas.prefetch(u.quotaRoots())
+	}
+
+	return &handlerUser{
+		User:    u,
+		Handler: buildWebdavHandler(u.UserPermissions, h.prefix, h.noSniff, h.lockSystem, h.logFunc, h.quotas),
+		quotas:  h.quotas,
+	}, nil
+}
+
+// loadUsers builds the users from the configuration and, if set, from the
+// users file. Users from the configuration take precedence over users with
+// the same name from the users file.
+func (h *Handler) loadUsers() error {
+	users := map[string]*handlerUser{}
+
+	if h.usersFile != "" {
+		fileUsers, err := readUsersFile(h.usersFile, h.permissions)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range fileUsers {
+			users[u.Username], err = h.newHandlerUser(u)
+			if err != nil {
+				return fmt.Errorf("invalid users file %q: %w", h.usersFile, err)
+			}
+		}
+	}
+
+	for _, u := range h.configUsers {
+		if _, ok := users[u.Username]; ok {
+			zap.L().Warn("user is defined in both the configuration and the users file, using the configuration", zap.String("username", u.Username))
+		}
+		user, err := h.newHandlerUser(u)
+		if err != nil {
+			return err
+		}
+		users[u.Username] = user
+	}
+
+	h.usersMu.Lock()
+	h.users = users
+	h.usersMu.Unlock()
+	return nil
+}
+
+// getUser returns the user with the given username, if any.
+func (h *Handler) getUser(username string) (*handlerUser, bool) {
+	h.usersMu.RLock()
+	defer h.usersMu.RUnlock()
+
+	user, ok := h.users[username]
+	return user, ok
+}
+
+// authenticateBasic returns the user for the given Basic credentials. Users
+// from the configuration and the users file are checked first, and then the
+// LDAP directory, if configured.
+func (h *Handler) authenticateBasic(lZap *zap.Logger, username, password string) (*handlerUser, bool) {
+	user, found := h.getUser(username)
+	if found && h.noPassword {
+		return user, true
+	}
+
+	if found {
+		now := time.Now()
+		compare := comparePassword
+		if h.passwords != nil {
+			// Any of the passwords of the user can be the one the client uses, so
+			// all of them are looked up in the cache before any is hashed.
+			if app, ok := user.matchPassword(password, now, func(stored, input string) bool {
+				return h.passwords.cached(lZap, username, stored, input)
+			}); ok {
+				return user.withAppPassword(app), true
+			}
+
+			compare = func(stored, input string) bool {
+				return h.passwords.compare(lZap, username, stored, input)
+			}
+		}
+
+		if app, ok := user.matchPassword(password, now, compare); ok {
+			return user.withAppPassword(app), true
+		}
+	}
+
+	if h.ldap == nil {
+		if found {
+			lZap.Info("invalid password", zap.String("username", username))
+		} else {
+			lZap.Info("invalid username", zap.String("username", username))
+		}
+		return nil, false
+	}
+
+	memberOf, err := h.ldap.authenticate(username, password)
+	if err != nil {
+		if errors.Is(err, errLDAPInvalidCredentials) {
+			lZap.Info("invalid password", zap.String("username", username))
+		} else {
+			lZap.Error("ldap authentication failed", zap.String("username", username), zap.Error(err))
+		}
+		return nil, false
+	}
+
+	// A user in the configuration with the same name defines the permissions
+	// of the directory user. Otherwise, they come from the first matching group
+	// or, failing that, from the global permissions.
+	if found {
+		return user, true
+	}
+
+	u := User{UserPermissions: h.permissions, Username: username}
+	if group, ok := h.ldap.group(memberOf); ok {
+		u.UserPermissions = group.UserPermissions
+	}
+
+	user, err = h.newHandlerUser(u)
+	if err != nil {
+		lZap.Info("invalid username", zap.String("username", username), zap.Error(err))
+		return nil, false
+	}
+
+	return user, true
+}
+
+// authenticateBearer returns the user for the given Bearer token. The
+// username claim of the token selects a user from the configuration and the
+// users file or, if there is none, the JWT template user.
+func (h *Handler) authenticateBearer(lZap *zap.Logger, token string) (*handlerUser, string, bool) {
+	username, err := h.jwt.authenticate(token)
+	if err != nil {
+		if errors.Is(err, errJWTInvalidToken) {
+			lZap.Info("invalid token", zap.Error(err))
+		} else {
+			lZap.Error("jwt authentication failed", zap.Error(err))
+		}
+		return nil, "", false
+	}
+
+	user, ok := h.getUserOrTemplate(lZap, username, h.jwt.Template)
+	return user, username, ok
+}
+
+// getUserOrTemplate returns the user with the given username or, if there is
+// none, a user with the permissions of template, if set. It is used for users
+// authenticated by other services.
+func (h *Handler) getUserOrTemplate(lZap *zap.Logger, username string, template *UserPermissions) (*handlerUser, bool) {
+	if user, ok := h.getUser(username); ok {
+		return user, true
+	}
+
+	if template == nil {
+		lZap.Info("invalid username", zap.String("username", username))
+		return nil, false
+	}
+
+	user, err := h.newHandlerUser(User{UserPermissions: *template, Username: username})
+	if err != nil {
+		lZap.Info("invalid username", zap.String("username", username), zap.Error(err))
+		return nil, false
+	}
+
+	return user, true
+}
+
+// authenticate returns the user of the request and its username. The header
+// set by a trusted proxy is used first, then the client certificate, if any,
+// and then the Bearer, Digest or Basic credentials. It sets the authentication
+// challenges in w.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request, lZap *zap.Logger) (*handlerUser, string, bool) {
+	h.setChallenges(w, false)
+
+	if h.proxyAuth != nil {
+		if username, ok := h.proxyAuth.username(r); ok {
+			user, ok := h.getUserOrTemplate(lZap, username, h.proxyAuth.Template)
+			return user, username, ok
+		} else if r.Header.Get(h.proxyAuth.Header) != "" {
+			lZap.Warn("ignoring proxy authentication header from untrusted address", zap.String("header", h.proxyAuth.Header))
+		}
+	}
+
+	if h.clientCerts != nil {
+		cert, err := h.clientCerts.certificate(r)
+		if err != nil {
+			lZap.Info("invalid client certificate", zap.Error(err))
+		} else if cert != nil {
+			return h.authenticateClientCert(lZap, r, cert)
+		}
+	}
+
+	if token, ok := bearerToken(r); ok && h.jwt != nil {
+		user, username, ok := h.authenticateBearer(lZap, token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Restricted", error="invalid_token"`)
+		}
+		return user, username, ok
+	}
+
+	if credentials, ok := parseDigestCredentials(r); ok && h.digest != nil {
+		return h.authenticateDigest(w, r, lZap, credentials)
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, "", false
+	}
+
+	user, ok := h.authenticateBasic(lZap, username, password)
+	return user, username, ok
+}
+
+// credentialsUsername returns the username of the Basic or Digest credentials
+// of r, if any, before they are checked.
+func credentialsUsername(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+
+	if credentials, ok := parseDigestCredentials(r); ok {
+		return credentials.username
+	}
+
+	return ""
+}
+
+// setChallenges sets the challenges of the enabled authentication schemes in
+// w. If staleNonce is set, the Digest challenges tell the client to retry with
+// a new nonce.
+func (h *Handler) setChallenges(w http.ResponseWriter, staleNonce bool) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+	if h.jwt != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="Restricted"`)
+	}
+	if h.digest != nil {
+		h.digest.challenges(w, staleNonce)
+	}
+}
+
+// authenticateDigest returns the user for the given Digest credentials. Only
+// users from the configuration and the users file can use Digest.
+func (h *Handler) authenticateDigest(w http.ResponseWriter, r *http.Request, lZap *zap.Logger, credentials *digestCredentials) (*handlerUser, string, bool) {
+	user, found := h.getUser(credentials.username)
+	if !found {
+		lZap.Info("invalid username", zap.String("username", credentials.username))
+		return nil, "", false
+	}
+
+	err := h.digest.authenticate(r, credentials, user.User)
+	switch {
+	case err == nil:
+		return user, credentials.username, true
+	case errors.Is(err, errDigestStaleNonce):
+		// The credentials are correct, so let the client retry with a new nonce.
+		h.setChallenges(w, true)
+	case errors.Is(err, errInvalidDigestResponse):
+		lZap.Info("invalid password", zap.String("username", credentials.username))
+	default:
+		lZap.Info("invalid digest credentials", zap.String("username", credentials.username), zap.Error(err))
+	}
+
+	return nil, "", false
+}
+
+// authenticateClientCert returns the user of a verified client certificate.
+// If passwords are required as well, the Basic credentials must be the ones
+// of that same user.
+func (h *Handler) authenticateClientCert(lZap *zap.Logger, r *http.Request, cert *x509.Certificate) (*handlerUser, string, bool) {
+	usernames := h.clientCerts.usernames(cert)
+
+	var (
+		user  *handlerUser
+		found bool
+	)
+	for _, username := range usernames {
+		if user, found = h.getUser(username); found {
+			break
+		}
+	}
+
+	if !found {
+		lZap.Info("invalid username", zap.Strings("certificate", usernames))
+		return nil, "", false
+	}
+
+	if h.clientCerts.RequirePassword {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, "", false
+		}
+
+		if username != user.Username {
+			lZap.Info("invalid username", zap.String("username", username), zap.String("certificate", user.Username))
+			return nil, "", false
+		}
+
+		user, ok = h.authenticateBasic(lZap, username, password)
+		return user, username, ok
+	}
+
+	return user, user.Username, true
+}
+
+// authorize asks the authorization hook whether the request is allowed. The
+// request is denied if the hook cannot be reached.
+func (h *Handler) authorize(r *http.Request, lZap *zap.Logger, user *handlerUser, req *request, fileExists func(string) bool) bool {
+	hookRequest := AuthorizationRequest{
+		User:    user.Username,
+		Method:  req.method,
+		Path:    req.path,
+		Exists:  fileExists(req.path),
+		Share:   user.share != nil,
+		ShareID: user.shareID,
+	}
+
+	if user.appPassword != nil {
+		hookRequest.AppPassword = user.appPassword.Name
+	}
+
+	if req.destination != "" {
+		hookRequest.Destination = req.destination
+		hookRequest.DestinationExists = fileExists(req.destination)
+	}
+
+	allow, cached, err := h.authorizer.allowed(r.Context(), hookRequest)
+	if err != nil {
+		lZap.Error("authorization hook failed", zap.Error(err))
+		return false
+	}
+
+	lZap.Debug("authorization hook", zap.Bool("allow", allow), zap.Bool("cached", cached))
+	return allow
+}
+
+// recordLogin records the time of a successful login of the user in the
+// state. To avoid writing the state file with every request, the time is only
+// updated once it is lastLoginResolution old.
+func (h *Handler) recordLogin(username string) {
+	now := time.Now()
+
+	var last time.Time
+	h.state.get(func(s *State) { last = s.LastLogins[username] })
+	if now.Sub(last) < lastLoginResolution {
+		return
+	}
+
+	h.state.update(func(s *State) {
+		if s.LastLogins == nil {
+			s.LastLogins = map[string]time.Time{}
+		}
+		s.LastLogins[username] = now
+	})
+}
+
+// authenticateShare returns the user for a share link, restricted to what
+// the link allows.
+func (h *Handler) authenticateShare(lZap *zap.Logger, token string) (*handlerUser, bool) {
+	link, err := h.shares.parseToken(token, time.Now())
+	if err != nil {
+		lZap.Info("invalid share link", zap.Error(err))
+		return nil, false
+	}
+
+	owner := h.user
+	if link.Username != "" {
+		var found bool
+		owner, found = h.getUser(link.Username)
+		if !found {
+			lZap.Info("invalid share link", zap.String("username", link.Username), zap.Error(errors.New("user does not exist")))
+			return nil, false
+		}
+	} else if owner.hasUsernamePlaceholder() {
+		// The placeholders of the global settings are never expanded.
+		lZap.Info("invalid share link", zap.Error(fmt.Errorf("links without a user cannot use %s", UsernamePlaceholder)))
+		return nil, false
+	}
+
+	if err := owner.CheckActive(time.Now()); err != nil {
+		lZap.Info("invalid share link", zap.String("username", link.Username), zap.Error(err))
+		return nil, false
+	}
+
+	lZap.Info("share link authorized", zap.String("id", link.ID), zap.String("username", link.Username), zap.String("path", link.Path), zap.Bool("upload", link.Upload))
+
+	permissions := link.permissions()
+	return &handlerUser{User: owner.User, Handler: owner.Handler, share: &permissions, shareID: link.ID, quotas: owner.quotas}, true
+}
+
 // buildWebdavHandler creates the [webdav.Handler] for a set of user permissions,
 // selecting between single-directory and multi-directory backing depending on
 // whether directories are configured.
-func buildWebdavHandler(p UserPermissions, prefix string, noSniff bool, ls webdav.LockSystem, logFunc func(*http.Request, error)) webdav.Handler {
+func buildWebdavHandler(p UserPermissions, prefix string, noSniff bool, ls webdav.LockSystem, logFunc func(*http.Request, error), quotas *quotaTracker) webdav.Handler {
 	h := webdav.Handler{
 		Prefix: prefix,
 		Logger: logFunc,
 	}
 
 	if p.useDirectories {
-		h.FileSystem = multiDir{
-			mounts:  p.Directories,
-			noSniff: noSniff,
-		}
 		h.LockSystem = newMultiDirLockSystem(ls, p.Directories)
 	} else {
-		h.FileSystem = Dir{
-			Dir:     webdav.Dir(p.Directory),
-			noSniff: noSniff,
-		}
 		h.LockSystem = newLockSystem(ls, p.Directory)
 	}
 
+	h.FileSystem = stagedFileSystem{FileSystem: filteredFileSystem{FileSystem: p.fileSystem(noSniff)}}
+	if p.Quota.enabled() {
+		h.FileSystem = quotaFileSystem{FileSystem: h.FileSystem, permissions: p, quotas: quotas}
+	}
+
 	return h
 }
 
 // ServeHTTP determines if the request is for this plugin, and if all prerequisites are met.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	user := h.user
+	anonymous := false
 
-	lZap := getRequestLogger(r, h.behindProxy)
-
-	// Authentication
-	if len(h.users) > 0 {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+	lZap := getRequestLogger(r, h.proxies)
 
-		// Gets the correct user for this request.
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
+	// Share links are checked before any credentials, and only give access
+	// to what they were created for.
+	shared := false
+	if token := r.URL.Query().Get(ShareQueryParameter); token != "" && h.shares != nil {
+		user, shared = h.authenticateShare(lZap, token)
+		if !shared {
+			http.Error(w, "Invalid share link", http.StatusForbidden)
 			return
 		}
+	}
 
-		user, ok = h.users[username]
-		if !ok {
-			// Log invalid username
-			lZap.Info("invalid username", zap.String("username", username))
-			http.Error(w, "Not authorized", http.StatusUnauthorized)
-			return
+	// Authentication
+	if h.authentication && !shared {
+		remoteIP := getRemoteIP(r, h.proxies)
+		attemptedUsername := credentialsUsername(r)
+
+		if h.bruteForce != nil {
+			if retryAfter, banned := h.bruteForce.banned(remoteIP, attemptedUsername); banned {
+				lZap.Info("too many failed attempts", zap.String("username", attemptedUsername), zap.Duration("retry_after", retryAfter))
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+				return
+			}
 		}
 
-		if !h.noPassword && !user.checkPassword(password) {
-			// Log invalid password
-			lZap.Info("invalid password", zap.String("username", username))
+		// Gets the correct user for this request.
+		var (
+			username string
+			ok       bool
+		)
+
+		user, username, ok = h.authenticate(w, r, lZap)
+		switch {
+		case ok:
+			// Users that cannot log in at this time are rejected even though
+			// their credentials are correct.
+			if err := user.CheckActive(time.Now()); err != nil {
+				lZap.Info("inactive user", zap.String("username", username), zap.Error(err))
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+
+			if h.bruteForce != nil {
+				h.bruteForce.succeed(username)
+			}
+
+			h.recordLogin(username)
+
+			if h.homes != nil {
+				if err := h.homes.create(user); err != nil {
+					lZap.Error("failed to create home directory", zap.String("username", username), zap.Error(err))
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			if user.appPassword != nil {
+				lZap = lZap.With(zap.String("app_password", user.appPassword.Name))
+			}
+
+			// Log successful authorization
+			lZap.Info("user authorized", zap.String("username", username))
+		case h.anonymous != nil && r.Header.Get("Authorization") == "":
+			// Requests without credentials use the anonymous user, and are only
+			// asked for credentials if it is not allowed to make them.
+			user, anonymous = h.anonymous, true
+		default:
+			// Requests without credentials, and correct Digest credentials with
+			// a stale nonce, are part of the normal flow of clients, and are not
+			// counted as failed attempts.
+			if h.bruteForce != nil && r.Header.Get("Authorization") != "" && !staleDigestNonce(w) {
+				h.bruteForce.fail(lZap, remoteIP, attemptedUsername)
+			}
+
 			http.Error(w, "Not authorized", http.StatusUnauthorized)
 			return
 		}
-
-		// Log successful authorization
-		lZap.Info("user authorized", zap.String("username", username))
 	}
 
 	// Convert the HTTP request into an internal request type
@@ -138,19 +779,96 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Checks for user permissions relatively to this PATH.
-	allowed := user.Allowed(req, func(filename string) bool {
+	// An address that cannot be parsed does not meet any source condition.
+	req.remoteAddr, _ = netip.ParseAddr(getRemoteIP(r, h.proxies))
+	req.time = time.Now()
+
+	fileExists := func(filename string) bool {
 		_, err := user.FileSystem.Stat(r.Context(), filename)
 		return !os.IsNotExist(err)
-	})
+	}
+
+	// Checks for user permissions relatively to this PATH.
+	allowed := user.Allowed(req, fileExists)
+
+	// The authorization hook can only deny what the permissions allow.
+	if allowed && h.authorizer != nil {
+		allowed = h.authorize(r, lZap, user, req, fileExists)
+	}
 
 	lZap.Debug("allowed & method & path", zap.Bool("allowed", allowed), zap.String("method", r.Method), zap.String("path", r.URL.Path))
 
+	// The trace of the decision of the user's permissions, which app passwords,
+	// share links and the authorization hook can only restrict further.
+	if ce := lZap.Check(zap.DebugLevel, "permission decision"); ce != nil {
+		ce.Write(user.explain(req, fileExists).fields()...)
+	}
+
 	if !allowed {
+		if anonymous {
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
+	if anonymous {
+		lZap.Debug("anonymous request")
+		w.Header().Del("WWW-Authenticate")
+	}
+
+	// Files protected by write-once rules cannot be changed by anyone.
+	unchanged, err := user.checkWORM(r.Context(), req, r.Header.Get("Overwrite") != "F")
+	if err != nil {
+		lZap.Error("failed to check write-once rules", zap.Error(err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !unchanged {
+		lZap.Info("write-once file", zap.String("method", r.Method), zap.String("path", req.path))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Uploads are checked against the constraints of the user.
+	w, status, err := user.checkUpload(w, r, req)
+	if err != nil {
+		lZap.Error("failed to check upload", zap.Error(err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if status != 0 {
+		lZap.Info("upload not allowed", zap.String("method", r.Method), zap.String("path", req.path), zap.Int("status", status))
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// Writes that go beyond the quota of the user are rejected, and the usage
+	// of the affected directories is kept up to date.
+	w, fits, err := user.checkQuota(w, r, req)
+	if err != nil {
+		lZap.Error("failed to check quota", zap.Error(err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !fits {
+		lZap.Info("quota exceeded", zap.String("method", r.Method), zap.String("path", req.path))
+		http.Error(w, "Insufficient storage", http.StatusInsufficientStorage)
+		return
+	}
+
+	if done := user.trackQuota(r.Context(), req); done != nil {
+		defer done()
+	}
+
+	// Uploads whose bodies are limited only replace the file once they are
+	// complete.
+	if limited, ok := w.(*limitedResponseWriter); ok && r.Method == "PUT" {
+		r = r.WithContext(withStagedUpload(r.Context(), limited.body))
+	}
+
 	if r.Method == "HEAD" {
 		w = responseWriterNoBody{w}
 	}
@@ -177,13 +895,30 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Listings only include the entries the user could read.
+	if r.Method == "PROPFIND" && h.hideUnreadable {
+		r = r.WithContext(withListingFilter(r.Context(), func(name string, isDir bool) bool {
+			if isDir {
+				name += "/"
+			}
+
+			entry := *req
+			entry.method, entry.path, entry.destination = "PROPFIND", name, ""
+			return user.Allowed(&entry, fileExists)
+		}))
+	}
+
+	if r.Method == "PROPFIND" && user.Quota.enabled() {
+		r = withRequestedQuotaProps(r)
+	}
+
 	if r.Method == "OPTIONS" {
 		user.handleOptions(w, r, req.path)
 		return
 	}
 
 	if r.Method == "PATCH" || (r.Method == "PUT" && r.Header.Get("Content-Range") != "") {
-		user.handlePartialUpdate(w, r, req.path)
+		user.handlePartialUpdate(w, r, req.path, user.uploadFilterAt(req, req.path))
 		return
 	}
 
@@ -192,23 +927,56 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // getRequestLogger creates a zap.Logger using the request remote ip.
-func getRequestLogger(r *http.Request, behindProxy bool) *zap.Logger {
+func getRequestLogger(r *http.Request, proxies reverseProxies) *zap.Logger {
 	// Retrieve the real client IP address using the updated helper function
-	remoteAddr := getRealRemoteIP(r, behindProxy)
+	remoteAddr := getRealRemoteIP(r, proxies)
 
 	return zap.L().With(zap.String("remote_address", remoteAddr))
 }
 
-// getRealRemoteIP retrieves the client's actual IP address, considering reverse proxies.
-func getRealRemoteIP(r *http.Request, behindProxy bool) string {
-	if behindProxy {
-		if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-			return ip
+// reverseProxies are the reverse proxies that the server runs behind, if
+// enabled. If none are trusted, the one that connects to the server is.
+type reverseProxies struct {
+	enabled bool
+	trusted []netip.Prefix
+}
+
+// getRealRemoteIP retrieves the client's actual IP address, considering reverse
+// proxies. Every proxy appends the address it got the request from to
+// X-Forwarded-For, and the client can set the entries before those to anything,
+// so the client is the rightmost entry that was not added by a trusted proxy.
+func getRealRemoteIP(r *http.Request, proxies reverseProxies) string {
+	if !proxies.enabled {
+		return r.RemoteAddr
+	}
+
+	// Requests that do not come from a trusted proxy did not go through one.
+	if len(proxies.trusted) > 0 && !containsAddr(proxies.trusted, r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+
+	entries := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" || (i > 0 && containsAddr(proxies.trusted, entry)) {
+			continue
 		}
+		return entry
 	}
+
 	return r.RemoteAddr
 }
 
+// getRemoteIP returns the client's IP address, without the port.
+func getRemoteIP(r *http.Request, proxies reverseProxies) string {
+	addr := getRealRemoteIP(r, proxies)
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 type responseWriterNoBody struct {
 	http.ResponseWriter
 }
@@ -11,6 +11,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/studio-b12/gowebdav"
@@ -43,10 +44,26 @@ func makeTestServer(t *testing.T, yamlConfig string) *httptest.Server {
 
 	handler, err := NewHandler(cfg)
 	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, handler.(io.Closer).Close()) })
 
 	return httptest.NewServer(handler)
 }
 
+// doTestRequest sends a request with the given headers to srv, and returns the
+// status of the response.
+func doTestRequest(t *testing.T, srv *httptest.Server, method, path string, body io.Reader, headers map[string]string) int {
+	req, err := http.NewRequest(method, srv.URL+path, body)
+	require.NoError(t, err)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp.StatusCode
+}
+
 func TestServerDefaults(t *testing.T) {
 	t.Parallel()
 
@@ -543,6 +560,8 @@ users:
     password: basic
   - username: bcrypt
     password: "{bcrypt}$2a$12$222dfz8Nweoyvy8OwI8.me9nfaRfuz8lqGkiiYSMH1lLMHO26qWom"
+  - username: sha512
+    password: "{sha512-crypt}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
 `, dir))
 
 	t.Run("Basic Auth (Plaintext)", func(t *testing.T) {
@@ -564,6 +583,15 @@ users:
 		require.Len(t, files, 2)
 	})
 
+	t.Run("Basic Auth (SHA-512 Crypt)", func(t *testing.T) {
+		t.Parallel()
+		client := gowebdav.NewClient(srv.URL, "sha512", "Hello world!")
+
+		files, err := client.ReadDir("/")
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+	})
+
 	t.Run("Unauthorized (No Credentials)", func(t *testing.T) {
 		t.Parallel()
 		client := gowebdav.NewClient(srv.URL, "", "")
@@ -620,6 +648,198 @@ users:
 	})
 }
 
+func TestServerAuthenticationUsersFile(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"foo.txt": []byte("foo"),
+	})
+
+	usersFile := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(usersFile, []byte("apr1:$apr1$abcdefgh$/cesMUEGhga5MgaTGywaW0\n"), 0666)
+	require.NoError(t, err)
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: R
+usersFile: %s
+
+users:
+  - username: inline
+    password: inline
+    permissions: CRUD
+`, dir, usersFile))
+	defer srv.Close()
+
+	// Users from the file inherit the global permissions.
+	client := gowebdav.NewClient(srv.URL, "apr1", "test")
+	data, err := client.Read("/foo.txt")
+	require.NoError(t, err)
+	require.EqualValues(t, []byte("foo"), data)
+	require.ErrorContains(t, client.Write("/new.txt", []byte("new"), 0666), "403")
+
+	_, err = gowebdav.NewClient(srv.URL, "apr1", "wrong").Read("/foo.txt")
+	require.ErrorContains(t, err, "401")
+
+	_, err = gowebdav.NewClient(srv.URL, "inline", "inline").Read("/foo.txt")
+	require.NoError(t, err)
+
+	// Replacing the file, as most tools do, reloads the users.
+	tmpFile := usersFile + ".tmp"
+	err = os.WriteFile(tmpFile, []byte("sha:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n"), 0666)
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(tmpFile, usersFile))
+
+	require.Eventually(t, func() bool {
+		_, err := gowebdav.NewClient(srv.URL, "sha", "test").Read("/foo.txt")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err = client.Read("/foo.txt")
+	require.ErrorContains(t, err, "401")
+
+	// An invalid file keeps the previous users.
+	require.NoError(t, os.WriteFile(usersFile, []byte("invalid\n"), 0666))
+	time.Sleep(4 * usersFileReloadDelay)
+
+	_, err = gowebdav.NewClient(srv.URL, "sha", "test").Read("/foo.txt")
+	require.NoError(t, err)
+}
+
+func TestServerAuthenticationAnonymous(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"public/foo.txt": []byte("foo"),
+		"private.txt":    []byte("private"),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+
+anonymous:
+  rules:
+    - path: /public/
+      permissions: R
+
+users:
+  - username: basic
+    password: basic
+`, dir))
+	defer srv.Close()
+
+	baseURL := srv.URL
+	do := func(method, path, username, password string) *http.Response {
+		req, err := http.NewRequest(method, baseURL+path, nil)
+		require.NoError(t, err)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	// Anonymous requests only get the permissions given to them, and are not
+	// challenged when they are allowed.
+	resp := do("GET", "/public/foo.txt", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Values("WWW-Authenticate"))
+
+	// Otherwise, they are asked for credentials.
+	for _, tc := range []struct{ method, path string }{
+		{"PUT", "/public/bar.txt"},
+		{"GET", "/private.txt"},
+		{"PROPFIND", "/"},
+	} {
+		resp := do(tc.method, tc.path, "", "")
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode, tc.path)
+		require.Equal(t, `Basic realm="Restricted"`, resp.Header.Get("WWW-Authenticate"))
+	}
+
+	// Users get their own permissions, and wrong credentials are not
+	// downgraded to anonymous access.
+	require.Equal(t, http.StatusOK, do("GET", "/private.txt", "basic", "basic").StatusCode)
+	require.Equal(t, http.StatusCreated, do("PUT", "/public/bar.txt", "basic", "basic").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/public/foo.txt", "basic", "wrong").StatusCode)
+
+	// Without users, anonymous requests still only get the permissions given
+	// to them, and not the global ones.
+	anonymousOnly := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+
+anonymous:
+  rules:
+    - path: /public/
+      permissions: R
+`, dir))
+	defer anonymousOnly.Close()
+	baseURL = anonymousOnly.URL
+
+	require.Equal(t, http.StatusOK, do("GET", "/public/foo.txt", "", "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/private.txt", "", "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do("PUT", "/public/bar.txt", "", "").StatusCode)
+}
+
+func TestServerRulesGlob(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"projects/a/server.key":     []byte("key"),
+		"projects/a/deep/other.key": []byte("key"),
+		"projects/a/readme.md":      []byte("readme"),
+		"projects/b/notes.txt":      []byte("notes"),
+		"server.key":                []byte("key"),
+		"archive/2024/report.pdf":   []byte("report"),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+rules:
+  - glob: "/projects/**/*.key"
+    permissions: none
+  - glob: "/projects/{a,c}/*.md"
+    permissions: R
+  - glob: "/archive/**"
+    permissions: R
+`, dir))
+	defer srv.Close()
+
+	do := func(method, path string) int {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	// "**" matches at any depth, but only under /projects.
+	require.Equal(t, http.StatusForbidden, do("GET", "/projects/a/server.key"))
+	require.Equal(t, http.StatusForbidden, do("GET", "/projects/a/deep/other.key"))
+	require.Equal(t, http.StatusOK, do("GET", "/server.key"))
+	require.Equal(t, http.StatusOK, do("GET", "/projects/b/notes.txt"))
+
+	// Alternatives and single-segment wildcards.
+	require.Equal(t, http.StatusOK, do("GET", "/projects/a/readme.md"))
+	require.Equal(t, http.StatusForbidden, do("DELETE", "/projects/a/readme.md"))
+	require.Equal(t, http.StatusNoContent, do("DELETE", "/projects/b/notes.txt"))
+
+	// A glob ending in "/**" covers the collection like a path with a trailing
+	// slash: the contents get the rule's permissions, and the collection itself
+	// needs the permissions outside of the rule too.
+	require.Equal(t, http.StatusForbidden, do("DELETE", "/archive/2024/report.pdf"))
+	require.Equal(t, http.StatusForbidden, do("DELETE", "/archive"))
+	require.Equal(t, http.StatusForbidden, do("DELETE", "/archive/"))
+	require.Equal(t, http.StatusMultiStatus, do("PROPFIND", "/archive"))
+}
+
 func TestServerRulesRestrictive(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,283 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// UsernamePlaceholder is replaced with the name of the user in directories,
+// the paths and S3 prefixes of directory mounts and the paths, globs and
+// regular expressions of rules.
+const UsernamePlaceholder = "{username}"
+
+// DefaultHomeMode is the default mode of created home directories.
+const DefaultHomeMode os.FileMode = 0700
+
+type Homes struct {
+	// Create enables creating the missing home directories of users the first
+	// time they log in. Home directories are the directories, and the paths
+	// of directory mounts, that contain the {username} placeholder.
+	Create bool
+
+	// Skeleton is a directory whose contents are copied into created home
+	// directories. Default is none, which creates them empty.
+	Skeleton string
+
+	// Mode is the mode of created home directories. Default is 0700.
+	Mode os.FileMode
+}
+
+func (h *Homes) Validate() error {
+	if h.Skeleton != "" {
+		var err error
+		h.Skeleton, err = filepath.Abs(h.Skeleton)
+		if err != nil {
+			return fmt.Errorf("invalid homes: %w", err)
+		}
+	}
+
+	if h.Mode&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid homes: invalid mode %o", h.Mode)
+	}
+
+	return nil
+}
+
+// forUser returns p with the {username} placeholders replaced with username.
+// Users without a name, such as the global and anonymous ones, keep them, so
+// those cannot be used where the placeholders are.
+func (p UserPermissions) forUser(username string) (UserPermissions, error) {
+	if username == "" || !p.hasUsernamePlaceholder() {
+		return p, nil
+	}
+
+	// The name becomes a path segment, and must not be able to leave it.
+	if !validPathSegment(username) {
+		return p, fmt.Errorf("invalid username %q for %s", username, UsernamePlaceholder)
+	}
+
+	expand := func(s string) string {
+		return strings.ReplaceAll(s, UsernamePlaceholder, username)
+	}
+
+	if strings.Contains(p.Directory, UsernamePlaceholder) {
+		p.Directory = expand(p.Directory)
+		p.homes = append(p.homes, p.Directory)
+	}
+
+	var err error
+	mounts := make(DirectoryMounts, len(p.Directories))
+	for i, mount := range p.Directories {
+		if strings.Contains(mount.Path, UsernamePlaceholder) {
+			mount.Path = expand(mount.Path)
+			p.homes = append(p.homes, mount.Path)
+		}
+		mount.Name = expand(mount.Name)
+		mount.S3.Prefix = expand(mount.S3.Prefix)
+		mount.Rules, err = expandRules(mount.Rules, username)
+		if err != nil {
+			return p, err
+		}
+		mounts[i] = mount
+	}
+	p.Directories = mounts
+
+	p.Rules, err = expandRules(p.Rules, username)
+	return p, err
+}
+
+// expandRules returns rules with the placeholders in their paths, globs and
+// regular expressions replaced with username, which only matches itself in
+// them. The rules are copied, since they are shared between users.
+func expandRules(rules []*Rule, username string) ([]*Rule, error) {
+	if rules == nil {
+		return nil, nil
+	}
+
+	expanded := make([]*Rule, len(rules))
+	for i, rule := range rules {
+		if rule.hasUsernamePlaceholder() {
+			copied := *rule
+			copied.Path = strings.ReplaceAll(rule.Path, UsernamePlaceholder, username)
+			copied.Glob = strings.ReplaceAll(rule.Glob, UsernamePlaceholder, escapeGlob(username))
+			if rule.Regex != nil {
+				regex, err := regexp.Compile(strings.ReplaceAll(rule.Regex.String(), UsernamePlaceholder, regexp.QuoteMeta(username)))
+				if err != nil {
+					return nil, fmt.Errorf("invalid rule %s for user %q: %w", rule, username, err)
+				}
+				copied.Regex = regex
+			}
+			rule = &copied
+		}
+		expanded[i] = rule
+	}
+	return expanded, nil
+}
+
+// escapeGlob escapes the characters of s that have a meaning in globs.
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]{}\`, c) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// validPathSegment returns whether name can be used as a single segment of a
+// path without referring to another directory.
+func validPathSegment(name string) bool {
+	return name != "." && filepath.IsLocal(name) && !strings.ContainsAny(name, "/\\\x00")
+}
+
+func (p UserPermissions) hasUsernamePlaceholder() bool {
+	if strings.Contains(p.Directory, UsernamePlaceholder) {
+		return true
+	}
+
+	for _, mount := range p.Directories {
+		if strings.Contains(mount.Path, UsernamePlaceholder) || strings.Contains(mount.Name, UsernamePlaceholder) ||
+			strings.Contains(mount.S3.Prefix, UsernamePlaceholder) {
+			return true
+		}
+	}
+
+	return slices.ContainsFunc(p.allRules(), (*Rule).hasUsernamePlaceholder)
+}
+
+func (r *Rule) hasUsernamePlaceholder() bool {
+	return strings.Contains(r.Path, UsernamePlaceholder) || strings.Contains(r.Glob, UsernamePlaceholder) ||
+		(r.Regex != nil && strings.Contains(r.Regex.String(), UsernamePlaceholder))
+}
+
+// homeCreator creates the missing home directories of users.
+type homeCreator struct {
+	Homes
+
+	mu sync.Mutex
+	// checked has the users whose home directories exist.
+	checked map[string]struct{}
+}
+
+func newHomeCreator(h Homes) *homeCreator {
+	return &homeCreator{Homes: h, checked: map[string]struct{}{}}
+}
+
+// create creates the missing home directories of u. They are only checked the
+// first time u logs in, so directories that are removed afterwards are not
+// created again until the server restarts.
+func (c *homeCreator) create(u *handlerUser) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.checked[u.Username]; ok {
+		return nil
+	}
+
+	for _, home := range u.homes {
+		if err := c.createHome(home); err != nil {
+			return err
+		}
+	}
+
+	c.checked[u.Username] = struct{}{}
+	return nil
+}
+
+// createHome creates the home directory at name, if missing. It is filled in
+// a temporary directory first, so that it is never seen half-copied.
+func (c *homeCreator) createHome(name string) error {
+	if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	parent := filepath.Dir(name)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+
+	err = c.copySkeleton(tmp)
+	if err == nil {
+		err = os.Chmod(tmp, c.Mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// copySkeleton copies the directories and regular files in the skeleton into
+// dir, with their modes. Anything else, such as symbolic links, is skipped.
+func (c *homeCreator) copySkeleton(dir string) error {
+	if c.Skeleton == "" {
+		return nil
+	}
+
+	// The modes of directories are set once they have been filled, so that
+	// read-only ones can be copied too.
+	type dirMode struct {
+		name string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+
+	err := filepath.WalkDir(c.Skeleton, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(c.Skeleton, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, dirMode{target, info.Mode().Perm()})
+			return os.Mkdir(target, 0700)
+		case d.Type().IsRegular():
+			if err := copyRegularFile(name, target); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].name, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
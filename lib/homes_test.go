@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestConfigUsernamePlaceholder(t *testing.T) {
+	t.Parallel()
+
+	cfg := writeAndParseConfig(t, `
+directory: /data/homes/{username}
+rules:
+  - path: /shared/{username}/
+    permissions: CRUD
+homes:
+  mode: "0750"
+users:
+  - username: john
+    password: john
+  - username: jane
+    password: jane
+    directories:
+      - name: home
+        path: /data/homes/{username}
+      - /data/public
+`, ".yml")
+
+	require.Equal(t, filepath.FromSlash("/data/homes/{username}"), cfg.Directory)
+	require.Equal(t, "/shared/{username}/", cfg.Rules[0].Path)
+	require.Equal(t, os.FileMode(0750), cfg.Homes.Mode)
+
+	require.Equal(t, filepath.FromSlash("/data/homes/john"), cfg.Users[0].Directory)
+	require.Equal(t, "/shared/john/", cfg.Users[0].Rules[0].Path)
+	require.Equal(t, []string{filepath.FromSlash("/data/homes/john")}, cfg.Users[0].homes)
+
+	require.Equal(t, filepath.FromSlash("/data/homes/jane"), cfg.Users[1].Directories[0].Path)
+	require.Equal(t, filepath.FromSlash("/data/public"), cfg.Users[1].Directories[1].Path)
+	require.Equal(t, "/shared/jane/", cfg.Users[1].Rules[0].Path)
+
+	cfg = writeAndParseConfig(t, `
+homes:
+  mode: 0755
+`, ".yml")
+	require.Equal(t, os.FileMode(0755), cfg.Homes.Mode)
+
+	// Names must be a single path segment to be used in placeholders.
+	for _, username := range []string{"..", ".", "a/b", `a\\b`, `a\0b`} {
+		writeAndParseConfigWithError(t, fmt.Sprintf(`
+directory: /data/homes/{username}
+users:
+  - username: "%s"
+    password: john
+`, username), ".yml", "invalid username")
+	}
+
+	// Anonymous requests and requests without authentication have no name to
+	// replace the placeholders with.
+	writeAndParseConfigWithError(t, `
+directory: /data/homes/{username}
+anonymous: {}
+users:
+  - username: john
+    password: john
+`, ".yml", "anonymous: {username} cannot be used")
+
+	cfg = writeAndParseConfig(t, "directory: /data/homes/{username}", ".yml")
+	_, err := NewHandler(cfg)
+	require.ErrorContains(t, err, "{username} requires users")
+}
+
+func TestConfigUsernamePlaceholderPatterns(t *testing.T) {
+	t.Parallel()
+
+	cfg := writeAndParseConfig(t, `
+rules:
+  - glob: "/glob/{username}/**"
+    permissions: CRUD
+  - regex: "^/regex/{username}/"
+    permissions: CRUD
+users:
+  - username: "a*.b"
+    password: john
+`, ".yml")
+
+	// The name only matches itself in globs and regular expressions.
+	glob, regex := cfg.Users[0].Rules[0], cfg.Users[0].Rules[1]
+	require.True(t, glob.Matches("/glob/a*.b/c.txt"))
+	require.False(t, glob.Matches("/glob/ax.b/c.txt"))
+	require.False(t, glob.Matches("/glob/username/c.txt"))
+	require.True(t, regex.Matches("/regex/a*.b/c.txt"))
+	require.False(t, regex.Matches("/regex/aa.b/c.txt"))
+	require.False(t, regex.Matches("/regex/a*xb/c.txt"))
+
+	// The rules of the global settings are not changed.
+	require.Equal(t, "/glob/{username}/**", cfg.Rules[0].Glob)
+	require.Equal(t, "^/regex/{username}/", cfg.Rules[1].Regex.String())
+}
+
+func TestServerHomes(t *testing.T) {
+	t.Parallel()
+
+	skeleton := makeTestDirectory(t, map[string][]byte{
+		"README.txt":    []byte("welcome"),
+		"Documents/":    nil,
+		"Photos/a.jpeg": []byte("a"),
+	})
+	homes := filepath.Join(t.TempDir(), "homes")
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+homes:
+  create: true
+  skeleton: %s
+  mode: "0750"
+users:
+  - username: john
+    password: john
+  - username: jane
+    password: jane
+`, filepath.Join(homes, "{username}"), skeleton))
+	defer srv.Close()
+
+	// Home directories are created when users first log in.
+	client := gowebdav.NewClient(srv.URL, "john", "john")
+	data, err := client.Read("/README.txt")
+	require.NoError(t, err)
+	require.Equal(t, "welcome", string(data))
+
+	infos, err := client.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, infos, 3)
+
+	info, err := os.Stat(filepath.Join(homes, "john"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	_, err = os.Stat(filepath.Join(homes, "jane"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// Existing home directories are left untouched.
+	require.NoError(t, os.MkdirAll(filepath.Join(homes, "jane"), 0700))
+	client = gowebdav.NewClient(srv.URL, "jane", "jane")
+	infos, err = client.ReadDir("/")
+	require.NoError(t, err)
+	require.Empty(t, infos)
+}
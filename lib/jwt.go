@@ -0,0 +1,321 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	DefaultJWTClaim   = "sub"
+	DefaultJWTLeeway  = time.Minute
+	DefaultJWTRefresh = time.Hour
+
+	// jwksMinRefresh is the minimum time between two loads of the key set
+	// caused by tokens signed with an unknown key, so that such tokens cannot
+	// be used to flood the key set provider.
+	jwksMinRefresh = 30 * time.Second
+	jwksMaxSize    = 1 << 20
+)
+
+var errJWTInvalidToken = errors.New("invalid token")
+
+// jwtAlgorithms are the signature algorithms accepted for tokens. Symmetric
+// algorithms are not accepted, as the keys are public.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+type JWT struct {
+	// JWKS is the path or the http(s) URL of the JSON Web Key Set used to
+	// verify the tokens.
+	JWKS     string
+	Issuer   string
+	Audience []string
+	Claim    string
+	Leeway   time.Duration
+	Refresh  time.Duration
+
+	// Template defines the permissions of the users that are not in the
+	// configuration. If it is not set, such users are rejected.
+	Template *UserPermissions
+}
+
+func (j *JWT) Validate() error {
+	if j.JWKS == "" {
+		if j.Template != nil {
+			return errors.New("invalid jwt: template requires jwks to be set")
+		}
+		return nil
+	}
+
+	if !isURL(j.JWKS) {
+		var err error
+		j.JWKS, err = filepath.Abs(j.JWKS)
+		if err != nil {
+			return fmt.Errorf("invalid jwt: %w", err)
+		}
+	}
+
+	if j.Issuer == "" {
+		return errors.New("invalid jwt: issuer must be set")
+	}
+
+	if len(j.Audience) == 0 {
+		return errors.New("invalid jwt: audience must be set")
+	}
+
+	if j.Claim == "" {
+		j.Claim = DefaultJWTClaim
+	}
+
+	if j.Leeway == 0 {
+		j.Leeway = DefaultJWTLeeway
+	}
+
+	if j.Refresh == 0 {
+		j.Refresh = DefaultJWTRefresh
+	}
+
+	if j.Template != nil {
+		if err := j.Template.Validate(); err != nil {
+			return fmt.Errorf("invalid jwt: template: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+type jwtAuthenticator struct {
+	JWT
+	client *http.Client
+	now    func() time.Time
+
+	mu       sync.Mutex
+	keys     *jose.JSONWebKeySet
+	loadedAt time.Time
+	loading  chan struct{}
+	loadErr  error
+}
+
+func newJWTAuthenticator(j JWT) (*jwtAuthenticator, error) {
+	a := &jwtAuthenticator{
+		JWT:    j,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+
+	// Load the key set upfront so that configuration errors show at startup.
+	if _, err := a.keySet(false); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// keySet returns the key set, loading it again if it is older than the
+// refresh interval or, when reload is set, older than [jwksMinRefresh]. If
+// loading fails, the previous key set is returned, if any.
+//
+// The key set is loaded by one request at a time, without holding the lock.
+// Meanwhile, other requests use the previous key set, and only wait for the
+// new one if there is none yet, or if reload is set.
+func (a *jwtAuthenticator) keySet(reload bool) (*jose.JSONWebKeySet, error) {
+	a.mu.Lock()
+
+	age := a.now().Sub(a.loadedAt)
+	if a.keys != nil && age < a.Refresh && (!reload || age < jwksMinRefresh) {
+		defer a.mu.Unlock()
+		return a.keys, nil
+	}
+
+	if loading := a.loading; loading != nil {
+		keys := a.keys
+		a.mu.Unlock()
+
+		if keys != nil && !reload {
+			return keys, nil
+		}
+
+		<-loading
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if a.keys == nil {
+			return nil, fmt.Errorf("failed to load jwks: %w", a.loadErr)
+		}
+		return a.keys, nil
+	}
+
+	loading := make(chan struct{})
+	a.loading = loading
+	a.mu.Unlock()
+
+	keys, err := a.loadKeySet()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.loading = nil
+	a.loadErr = err
+	close(loading)
+
+	if err != nil {
+		if a.keys != nil {
+			return a.keys, nil
+		}
+		return nil, fmt.Errorf("failed to load jwks: %w", err)
+	}
+
+	a.keys = keys
+	a.loadedAt = a.now()
+	return keys, nil
+}
+
+func (a *jwtAuthenticator) loadKeySet() (*jose.JSONWebKeySet, error) {
+	var data []byte
+
+	if isURL(a.JWKS) {
+		resp, err := a.client.Get(a.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		data, err = io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(a.JWKS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(data, keys); err != nil {
+		return nil, err
+	}
+
+	if len(keys.Keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+
+	return keys, nil
+}
+
+// authenticate verifies the token and returns the value of the username
+// claim. It returns an error wrapping [errJWTInvalidToken] if the token is
+// not valid.
+func (a *jwtAuthenticator) authenticate(token string) (string, error) {
+	tok, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errJWTInvalidToken, err)
+	}
+
+	var kid string
+	if len(tok.Headers) > 0 {
+		kid = tok.Headers[0].KeyID
+	}
+
+	keys, err := a.keySet(false)
+	if err != nil {
+		return "", err
+	}
+
+	candidates := keysFor(keys, kid)
+	if len(candidates) == 0 {
+		// The key may have been rotated since the key set was loaded.
+		keys, err = a.keySet(true)
+		if err != nil {
+			return "", err
+		}
+		candidates = keysFor(keys, kid)
+	}
+
+	var (
+		claims jwt.Claims
+		custom map[string]any
+	)
+
+	err = fmt.Errorf("%w: no matching key", errJWTInvalidToken)
+	for _, key := range candidates {
+		if err = tok.Claims(key.Public(), &claims, &custom); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errJWTInvalidToken, err)
+	}
+
+	if claims.Expiry == nil {
+		return "", fmt.Errorf("%w: missing exp claim", errJWTInvalidToken)
+	}
+
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      a.Issuer,
+		AnyAudience: a.Audience,
+		Time:        a.now(),
+	}, a.Leeway)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errJWTInvalidToken, err)
+	}
+
+	username, ok := custom[a.Claim].(string)
+	if !ok || username == "" {
+		return "", fmt.Errorf("%w: missing %s claim", errJWTInvalidToken, a.Claim)
+	}
+
+	return username, nil
+}
+
+// keysFor returns the keys with the given key ID or, if kid is empty, all
+// the signing keys.
+func keysFor(keys *jose.JSONWebKeySet, kid string) []jose.JSONWebKey {
+	if kid != "" {
+		return keys.Key(kid)
+	}
+
+	var candidates []jose.JSONWebKey
+	for _, key := range keys.Keys {
+		if key.Use == "" || key.Use == "sig" {
+			candidates = append(candidates, key)
+		}
+	}
+	return candidates
+}
+
+// bearerToken returns the token of a request with Bearer authorization.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
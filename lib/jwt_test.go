@@ -0,0 +1,350 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+type testJWTKey struct {
+	kid string
+	key *ecdsa.PrivateKey
+}
+
+func newTestJWTKey(t *testing.T, kid string) testJWTKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return testJWTKey{kid: kid, key: key}
+}
+
+func writeTestJWKS(t *testing.T, filename string, keys ...testJWTKey) {
+	data, err := json.Marshal(testJWKS(keys...))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filename, data, 0666))
+}
+
+func testJWKS(keys ...testJWTKey) jose.JSONWebKeySet {
+	set := jose.JSONWebKeySet{}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, jose.JSONWebKey{
+			Key:       &k.key.PublicKey,
+			KeyID:     k.kid,
+			Algorithm: string(jose.ES256),
+			Use:       "sig",
+		})
+	}
+	return set
+}
+
+func signTestJWT(t *testing.T, k testJWTKey, claims jwt.Claims, custom map[string]any) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: k.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader(jose.HeaderKey("kid"), k.kid),
+	)
+	require.NoError(t, err)
+
+	token, err := jwt.Signed(signer).Claims(claims).Claims(custom).Serialize()
+	require.NoError(t, err)
+	return token
+}
+
+func testJWTClaims(subject string) jwt.Claims {
+	return jwt.Claims{
+		Issuer:   "https://issuer.example.org",
+		Audience: jwt.Audience{"webdav"},
+		Subject:  subject,
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	key := newTestJWTKey(t, "one")
+	other := newTestJWTKey(t, "two")
+
+	filename := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, filename, key)
+
+	j := JWT{
+		JWKS:     filename,
+		Issuer:   "https://issuer.example.org",
+		Audience: []string{"webdav", "other"},
+	}
+	require.NoError(t, j.Validate())
+
+	a, err := newJWTAuthenticator(j)
+	require.NoError(t, err)
+
+	username, err := a.authenticate(signTestJWT(t, key, testJWTClaims("alice"), nil))
+	require.NoError(t, err)
+	require.Equal(t, "alice", username)
+
+	expired := testJWTClaims("alice")
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+	noExpiry := testJWTClaims("alice")
+	noExpiry.Expiry = nil
+
+	wrongIssuer := testJWTClaims("alice")
+	wrongIssuer.Issuer = "https://evil.example.org"
+
+	wrongAudience := testJWTClaims("alice")
+	wrongAudience.Audience = jwt.Audience{"files"}
+
+	for name, token := range map[string]string{
+		"expired":        signTestJWT(t, key, expired, nil),
+		"no expiry":      signTestJWT(t, key, noExpiry, nil),
+		"wrong issuer":   signTestJWT(t, key, wrongIssuer, nil),
+		"wrong audience": signTestJWT(t, key, wrongAudience, nil),
+		"no subject":     signTestJWT(t, key, testJWTClaims(""), nil),
+		"unknown key":    signTestJWT(t, other, testJWTClaims("alice"), nil),
+		"malformed":      "not.a.token",
+	} {
+		_, err := a.authenticate(token)
+		require.ErrorIs(t, err, errJWTInvalidToken, name)
+	}
+
+	// Custom claims can be used for the username.
+	a.Claim = "preferred_username"
+	username, err = a.authenticate(signTestJWT(t, key, testJWTClaims("alice"), map[string]any{"preferred_username": "bob"}))
+	require.NoError(t, err)
+	require.Equal(t, "bob", username)
+}
+
+func TestJWTAuthenticatorKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	key := newTestJWTKey(t, "one")
+	rotated := newTestJWTKey(t, "two")
+
+	var (
+		keys     atomic.Value
+		requests atomic.Int32
+	)
+	keys.Store(testJWKS(key))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_ = json.NewEncoder(w).Encode(keys.Load())
+	}))
+	defer srv.Close()
+
+	j := JWT{
+		JWKS:     srv.URL,
+		Issuer:   "https://issuer.example.org",
+		Audience: []string{"webdav"},
+	}
+	require.NoError(t, j.Validate())
+
+	a, err := newJWTAuthenticator(j)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, requests.Load())
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	keys.Store(testJWKS(key, rotated))
+	token := signTestJWT(t, rotated, testJWTClaims("alice"), nil)
+
+	// Unknown keys only cause the key set to be loaded again after a while.
+	_, err = a.authenticate(token)
+	require.ErrorIs(t, err, errJWTInvalidToken)
+	require.EqualValues(t, 1, requests.Load())
+
+	now = now.Add(jwksMinRefresh)
+	username, err := a.authenticate(token)
+	require.NoError(t, err)
+	require.Equal(t, "alice", username)
+	require.EqualValues(t, 2, requests.Load())
+}
+
+func TestJWTAuthenticatorSlowRefresh(t *testing.T) {
+	t.Parallel()
+
+	key := newTestJWTKey(t, "one")
+
+	var (
+		slow     atomic.Bool
+		requests atomic.Int32
+	)
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if slow.Load() {
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(testJWKS(key))
+	}))
+	defer srv.Close()
+
+	j := JWT{
+		JWKS:     srv.URL,
+		Issuer:   "https://issuer.example.org",
+		Audience: []string{"webdav"},
+	}
+	require.NoError(t, j.Validate())
+
+	a, err := newJWTAuthenticator(j)
+	require.NoError(t, err)
+
+	now := time.Now().Add(j.Refresh)
+	a.now = func() time.Time { return now }
+	slow.Store(true)
+
+	done := make(chan error)
+	go func() {
+		_, err := a.keySet(false)
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return requests.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// Other requests use the previous key set while it is loaded again.
+	username, err := a.authenticate(signTestJWT(t, key, testJWTClaims("alice"), nil))
+	require.NoError(t, err)
+	require.Equal(t, "alice", username)
+	require.EqualValues(t, 2, requests.Load())
+
+	close(release)
+	require.NoError(t, <-done)
+}
+
+func TestServerAuthenticationJWT(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"foo.txt":       []byte("foo"),
+		"admin/bar.txt": []byte("bar"),
+	})
+
+	key := newTestJWTKey(t, "one")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, jwks, key)
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: R
+
+jwt:
+  jwks: %s
+  issuer: https://issuer.example.org
+  audience: webdav
+  template:
+    permissions: none
+    rules:
+      - path: /foo.txt
+        permissions: R
+
+users:
+  - username: admin
+    password: admin
+    directory: %s/admin
+    permissions: CRUD
+`, dir, jwks, dir))
+	defer srv.Close()
+
+	do := func(method, path, authorization string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	// Tokens for users in the configuration use their permissions.
+	admin := "Bearer " + signTestJWT(t, key, testJWTClaims("admin"), nil)
+	require.Equal(t, http.StatusOK, do("GET", "/bar.txt", admin).StatusCode)
+	require.Equal(t, http.StatusCreated, do("PUT", "/new.txt", admin).StatusCode)
+
+	// Other users get the template permissions.
+	alice := "Bearer " + signTestJWT(t, key, testJWTClaims("alice"), nil)
+	require.Equal(t, http.StatusOK, do("GET", "/foo.txt", alice).StatusCode)
+	require.Equal(t, http.StatusForbidden, do("GET", "/admin/bar.txt", alice).StatusCode)
+	require.Equal(t, http.StatusForbidden, do("PUT", "/new.txt", alice).StatusCode)
+
+	// Basic authentication still works.
+	req, err := http.NewRequest("GET", srv.URL+"/bar.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "admin")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do("GET", "/foo.txt", "")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, []string{`Basic realm="Restricted"`, `Bearer realm="Restricted"`}, resp.Header.Values("WWW-Authenticate"))
+
+	expired := testJWTClaims("admin")
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	resp = do("GET", "/bar.txt", "Bearer "+signTestJWT(t, key, expired, nil))
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, `Bearer realm="Restricted", error="invalid_token"`, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestServerAuthenticationJWTNoTemplate(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"foo.txt": []byte("foo")})
+
+	key := newTestJWTKey(t, "one")
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, jwks, key)
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+
+jwt:
+  jwks: %s
+  issuer: https://issuer.example.org
+  audience: webdav
+  claim: email
+
+users:
+  - username: admin@example.org
+`, dir, jwks))
+	defer srv.Close()
+
+	for token, status := range map[string]int{
+		signTestJWT(t, key, testJWTClaims("x"), map[string]any{"email": "admin@example.org"}): http.StatusOK,
+		signTestJWT(t, key, testJWTClaims("x"), map[string]any{"email": "alice@example.org"}): http.StatusUnauthorized,
+		signTestJWT(t, key, testJWTClaims("admin@example.org"), nil):                          http.StatusUnauthorized,
+	} {
+		req, err := http.NewRequest("GET", srv.URL+"/foo.txt", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, status, resp.StatusCode)
+	}
+
+	// Users without a password cannot use Basic authentication.
+	req, err := http.NewRequest("GET", srv.URL+"/foo.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("admin@example.org", "")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
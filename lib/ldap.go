@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	DefaultLDAPTimeout        = 10 * time.Second
+	DefaultLDAPSearchFilter   = "(uid={username})"
+	DefaultLDAPGroupAttribute = "memberOf"
+	DefaultLDAPGroupFilter    = "(|(member={dn})(uniqueMember={dn}))"
+)
+
+var errLDAPInvalidCredentials = errors.New("invalid credentials")
+
+type LDAP struct {
+	URL      string
+	StartTLS bool
+	CA       string
+	Timeout  time.Duration
+
+	// BindDN is the DN template used to bind as the user directly, such as
+	// "uid={username},ou=people,dc=example,dc=org". If it is not set, the user
+	// is first searched for in SearchBase with SearchFilter, binding with
+	// SearchBindDN and SearchBindPassword if they are set.
+	BindDN             string
+	SearchBase         string
+	SearchFilter       string
+	SearchBindDN       string
+	SearchBindPassword string
+
+	// GroupAttribute is the attribute of the user entry that lists the DNs of
+	// the groups the user is a member of. If GroupSearchBase is set, groups
+	// are instead searched for there with GroupFilter.
+	GroupAttribute  string
+	GroupSearchBase string
+	GroupFilter     string
+	Groups          []LDAPGroup
+}
+
+// LDAPGroup maps the members of a directory group to a set of permissions.
+type LDAPGroup struct {
+	UserPermissions `mapstructure:",squash"`
+	DN              string
+}
+
+func (l *LDAP) Validate() error {
+	if l.URL == "" {
+		if len(l.Groups) > 0 {
+			return errors.New("invalid ldap: groups require url to be set")
+		}
+		return nil
+	}
+
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return fmt.Errorf("invalid ldap: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ldap":
+	case "ldaps":
+		if l.StartTLS {
+			return errors.New("invalid ldap: startTLS cannot be used with ldaps")
+		}
+	default:
+		return fmt.Errorf("invalid ldap: unsupported url scheme %q", u.Scheme)
+	}
+
+	if l.BindDN == "" && l.SearchBase == "" {
+		return errors.New("invalid ldap: either bindDN or searchBase must be set")
+	}
+
+	if l.BindDN != "" && !strings.Contains(l.BindDN, "{username}") {
+		return errors.New("invalid ldap: bindDN must contain {username}")
+	}
+
+	if strings.HasPrefix(l.SearchBindPassword, "{env}") {
+		env := strings.TrimPrefix(l.SearchBindPassword, "{env}")
+		l.SearchBindPassword = os.Getenv(env)
+		if l.SearchBindPassword == "" {
+			return errors.New("invalid ldap: search bind password environment variable is empty")
+		}
+	}
+
+	if l.CA != "" {
+		l.CA, err = filepath.Abs(l.CA)
+		if err != nil {
+			return fmt.Errorf("invalid ldap: %w", err)
+		}
+	}
+
+	if l.Timeout == 0 {
+		l.Timeout = DefaultLDAPTimeout
+	}
+
+	if l.SearchFilter == "" {
+		l.SearchFilter = DefaultLDAPSearchFilter
+	}
+
+	if l.GroupAttribute == "" {
+		l.GroupAttribute = DefaultLDAPGroupAttribute
+	}
+
+	if l.GroupFilter == "" {
+		l.GroupFilter = DefaultLDAPGroupFilter
+	}
+
+	for i := range l.Groups {
+		group := &l.Groups[i]
+		if _, err := ldap.ParseDN(group.DN); err != nil {
+			return fmt.Errorf("invalid ldap: group %q: %w", group.DN, err)
+		}
+
+		if err := group.UserPermissions.Validate(); err != nil {
+			return fmt.Errorf("invalid ldap: group %q: %w", group.DN, err)
+		}
+	}
+
+	return nil
+}
+
+// ldapConn is the subset of [ldap.Conn] used to authenticate, so that tests
+// can replace the directory server.
+type ldapConn interface {
+	StartTLS(config *tls.Config) error
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+type ldapAuthenticator struct {
+	LDAP
+	tlsConfig *tls.Config
+	dial      func(url string, opts ...ldap.DialOpt) (ldapConn, error)
+}
+
+func newLDAPAuthenticator(l LDAP) (*ldapAuthenticator, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if l.CA != "" {
+		data, err := os.ReadFile(l.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ldap ca: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("failed to read ldap ca: no certificates found")
+		}
+	}
+
+	return &ldapAuthenticator{
+		LDAP:      l,
+		tlsConfig: tlsConfig,
+		dial: func(url string, opts ...ldap.DialOpt) (ldapConn, error) {
+			return ldap.DialURL(url, opts...)
+		},
+	}, nil
+}
+
+// authenticate binds to the directory as username, returning the DNs of the
+// groups the user is a member of. It returns [errLDAPInvalidCredentials] if
+// the directory rejects the credentials.
+func (a *ldapAuthenticator) authenticate(username, password string) ([]string, error) {
+	// An empty password would result in an unauthenticated bind, which most
+	// servers accept.
+	if username == "" || password == "" {
+		return nil, errLDAPInvalidCredentials
+	}
+
+	conn, err := a.dial(a.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.Timeout}),
+		ldap.DialWithTLSConfig(a.tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if a.StartTLS {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			return nil, fmt.Errorf("failed to start tls: %w", err)
+		}
+	}
+
+	var (
+		userDN string
+		entry  *ldap.Entry
+	)
+
+	if a.BindDN != "" {
+		userDN = strings.ReplaceAll(a.BindDN, "{username}", ldap.EscapeDN(username))
+	} else {
+		if a.SearchBindDN != "" {
+			if err := conn.Bind(a.SearchBindDN, a.SearchBindPassword); err != nil {
+				return nil, fmt.Errorf("failed to bind for search: %w", err)
+			}
+		}
+
+		entry, err = a.searchOne(conn, a.SearchBase, ldap.ScopeWholeSubtree, strings.ReplaceAll(a.SearchFilter, "{username}", ldap.EscapeFilter(username)))
+		if err != nil {
+			return nil, err
+		}
+		userDN = entry.DN
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errLDAPInvalidCredentials
+		}
+		return nil, fmt.Errorf("failed to bind: %w", err)
+	}
+
+	if len(a.Groups) == 0 {
+		return nil, nil
+	}
+
+	if a.GroupSearchBase != "" {
+		result, err := conn.Search(ldap.NewSearchRequest(
+			a.GroupSearchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(a.Timeout.Seconds()), false,
+			strings.ReplaceAll(a.GroupFilter, "{dn}", ldap.EscapeFilter(userDN)), []string{"1.1"}, nil,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("failed to search groups: %w", err)
+		}
+
+		groups := make([]string, 0, len(result.Entries))
+		for _, group := range result.Entries {
+			groups = append(groups, group.DN)
+		}
+		return groups, nil
+	}
+
+	// Read the entry again after binding as the user, as the search may have
+	// been done by an account that cannot read the group attribute.
+	entry, err = a.searchOne(conn, userDN, ldap.ScopeBaseObject, "(objectClass=*)")
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.GetAttributeValues(a.GroupAttribute), nil
+}
+
+func (a *ldapAuthenticator) searchOne(conn ldapConn, base string, scope int, filter string) (*ldap.Entry, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		base, scope, ldap.NeverDerefAliases, 2, int(a.Timeout.Seconds()), false,
+		filter, []string{a.GroupAttribute}, nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, errLDAPInvalidCredentials
+		}
+		return nil, fmt.Errorf("failed to search user: %w", err)
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, errLDAPInvalidCredentials
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, errors.New("failed to search user: more than one entry found")
+	}
+}
+
+// group returns the first configured group that one of the given group DNs
+// refers to, if any.
+func (a *ldapAuthenticator) group(memberOf []string) (*LDAPGroup, bool) {
+	dns := make([]*ldap.DN, 0, len(memberOf))
+	for _, value := range memberOf {
+		dn, err := ldap.ParseDN(value)
+		if err != nil {
+			continue
+		}
+		dns = append(dns, dn)
+	}
+
+	for i := range a.Groups {
+		groupDN, err := ldap.ParseDN(a.Groups[i].DN)
+		if err != nil {
+			continue
+		}
+
+		for _, dn := range dns {
+			if groupDN.EqualFold(dn) {
+				return &a.Groups[i], true
+			}
+		}
+	}
+
+	return nil, false
+}
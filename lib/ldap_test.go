@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+// fakeDirectory is an in-process stand-in for an LDAP server. It supports
+// simple binds, and searches whose filter is made of equality assertions,
+// which are all treated as alternatives.
+type fakeDirectory struct {
+	mu        sync.Mutex
+	entries   map[string]map[string][]string
+	passwords map[string]string
+	startTLS  int
+}
+
+var fakeFilterRegexp = regexp.MustCompile(`\(([A-Za-z]+)=([^()]*)\)`)
+
+func (d *fakeDirectory) dial(string, ...ldap.DialOpt) (ldapConn, error) {
+	return &fakeLDAPConn{directory: d}, nil
+}
+
+type fakeLDAPConn struct {
+	directory *fakeDirectory
+	bound     string
+}
+
+func (c *fakeLDAPConn) StartTLS(*tls.Config) error {
+	c.directory.mu.Lock()
+	defer c.directory.mu.Unlock()
+	c.directory.startTLS++
+	return nil
+}
+
+func (c *fakeLDAPConn) Bind(username, password string) error {
+	if password == "" || c.directory.passwords[strings.ToLower(username)] != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.bound = username
+	return nil
+}
+
+func (c *fakeLDAPConn) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.bound == "" {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("anonymous search"))
+	}
+
+	result := &ldap.SearchResult{}
+	for dn, attributes := range c.directory.entries {
+		switch request.Scope {
+		case ldap.ScopeBaseObject:
+			if !strings.EqualFold(dn, request.BaseDN) {
+				continue
+			}
+		default:
+			if !strings.HasSuffix(strings.ToLower(dn), strings.ToLower(request.BaseDN)) {
+				continue
+			}
+
+			matched := false
+			for _, match := range fakeFilterRegexp.FindAllStringSubmatch(request.Filter, -1) {
+				for _, value := range attributes[match[1]] {
+					if strings.EqualFold(value, match[2]) {
+						matched = true
+					}
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		entry := &ldap.Entry{DN: dn}
+		for _, name := range request.Attributes {
+			entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(name, attributes[name]))
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+
+	if request.Scope == ldap.ScopeBaseObject && len(result.Entries) == 0 {
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+
+	return result, nil
+}
+
+func (c *fakeLDAPConn) Close() error {
+	return nil
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{
+		entries: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=org": {
+				"uid":      {"alice"},
+				"memberOf": {"cn=Admins,ou=groups,dc=example,dc=org"},
+			},
+			"uid=bob,ou=people,dc=example,dc=org": {
+				"uid": {"bob"},
+			},
+			"cn=admins,ou=groups,dc=example,dc=org": {
+				"member": {"uid=alice,ou=people,dc=example,dc=org"},
+			},
+		},
+		passwords: map[string]string{
+			"uid=alice,ou=people,dc=example,dc=org": "alice",
+			"uid=bob,ou=people,dc=example,dc=org":   "bob",
+			"cn=search,dc=example,dc=org":           "search",
+		},
+	}
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	groups := []LDAPGroup{{
+		UserPermissions: UserPermissions{RulesBehavior: RulesOverwrite},
+		DN:              "cn=admins,ou=groups,dc=example,dc=org",
+	}}
+
+	testCases := []struct {
+		name string
+		ldap LDAP
+	}{{
+		name: "Bind DN",
+		ldap: LDAP{
+			URL:      "ldap://ldap.example.org",
+			StartTLS: true,
+			BindDN:   "uid={username},ou=people,dc=example,dc=org",
+			Groups:   groups,
+		},
+	}, {
+		name: "Search",
+		ldap: LDAP{
+			URL:                "ldap://ldap.example.org",
+			SearchBase:         "ou=people,dc=example,dc=org",
+			SearchBindDN:       "cn=search,dc=example,dc=org",
+			SearchBindPassword: "search",
+			Groups:             groups,
+		},
+	}, {
+		name: "Group Search",
+		ldap: LDAP{
+			URL:             "ldap://ldap.example.org",
+			BindDN:          "uid={username},ou=people,dc=example,dc=org",
+			GroupSearchBase: "ou=groups,dc=example,dc=org",
+			Groups:          groups,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.NoError(t, tc.ldap.Validate())
+			authenticator, err := newLDAPAuthenticator(tc.ldap)
+			require.NoError(t, err)
+
+			directory := newFakeDirectory()
+			authenticator.dial = directory.dial
+
+			memberOf, err := authenticator.authenticate("alice", "alice")
+			require.NoError(t, err)
+			group, ok := authenticator.group(memberOf)
+			require.True(t, ok)
+			require.Equal(t, "cn=admins,ou=groups,dc=example,dc=org", group.DN)
+
+			memberOf, err = authenticator.authenticate("bob", "bob")
+			require.NoError(t, err)
+			_, ok = authenticator.group(memberOf)
+			require.False(t, ok)
+
+			for _, credentials := range [][2]string{
+				{"alice", "wrong"},
+				{"alice", ""},
+				{"mallory", "mallory"},
+				{"*", "alice"},
+			} {
+				_, err = authenticator.authenticate(credentials[0], credentials[1])
+				require.ErrorIs(t, err, errLDAPInvalidCredentials, credentials[0])
+			}
+
+			if tc.ldap.StartTLS {
+				require.Positive(t, directory.startTLS)
+			}
+		})
+	}
+}
+
+func TestLDAPValidate(t *testing.T) {
+	t.Parallel()
+
+	for message, l := range map[string]LDAP{
+		"unsupported url scheme":           {URL: "http://ldap.example.org", BindDN: "uid={username}"},
+		"either bindDN or searchBase":      {URL: "ldap://ldap.example.org"},
+		"bindDN must contain {username}":   {URL: "ldap://ldap.example.org", BindDN: "uid=alice"},
+		"startTLS cannot be used":          {URL: "ldaps://ldap.example.org", StartTLS: true, BindDN: "uid={username}"},
+		"groups require url to be set":     {Groups: []LDAPGroup{{DN: "cn=admins"}}},
+		"invalid ldap: group \"not a dn\"": {URL: "ldap://ldap.example.org", BindDN: "uid={username}", Groups: []LDAPGroup{{DN: "not a dn", UserPermissions: UserPermissions{RulesBehavior: RulesOverwrite}}}},
+	} {
+		require.ErrorContains(t, l.Validate(), message)
+	}
+}
+
+func TestServerAuthenticationLDAP(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"foo.txt":       []byte("foo"),
+		"local/bar.txt": []byte("bar"),
+	})
+
+	cfg := writeAndParseConfig(t, fmt.Sprintf(`
+directory: %s
+permissions: R
+
+ldap:
+  url: ldap://ldap.example.org
+  bindDN: "uid={username},ou=people,dc=example,dc=org"
+  groups:
+    - dn: cn=admins,ou=groups,dc=example,dc=org
+      permissions: CRUD
+
+users:
+  - username: bob
+    directory: %s/local
+`, dir, dir), ".yml")
+
+	handler, err := NewHandler(cfg)
+	require.NoError(t, err)
+	handler.(*Handler).ldap.dial = newFakeDirectory().dial
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// Alice gets the permissions of the admins group.
+	alice := gowebdav.NewClient(srv.URL, "alice", "alice")
+	require.NoError(t, alice.Write("/new.txt", []byte("new"), 0666))
+
+	// Bob has an entry in the configuration without a password, which gives
+	// his permissions and directory.
+	bob := gowebdav.NewClient(srv.URL, "bob", "bob")
+	data, err := bob.Read("/bar.txt")
+	require.NoError(t, err)
+	require.EqualValues(t, []byte("bar"), data)
+	require.ErrorContains(t, bob.Write("/new.txt", []byte("new"), 0666), "403")
+
+	for _, credentials := range [][2]string{{"alice", "wrong"}, {"bob", ""}, {"mallory", "mallory"}} {
+		req, err := http.NewRequest("GET", srv.URL+"/foo.txt", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth(credentials[0], credentials[1])
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode, credentials[0])
+	}
+}
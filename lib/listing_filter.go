@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"golang.org/x/net/webdav"
+)
+
+type listingFilterKey struct{}
+
+// listingFilter returns whether the entry with the given path is listed.
+type listingFilter func(name string, isDir bool) bool
+
+// withListingFilter returns a context in which [filteredFileSystem] only
+// lists the entries of collections for which filter returns true.
+func withListingFilter(ctx context.Context, filter listingFilter) context.Context {
+	return context.WithValue(ctx, listingFilterKey{}, filter)
+}
+
+// filteredFileSystem is a [webdav.FileSystem] that hides entries from the
+// listings of collections, according to the filter in the context, if any.
+// Entries are only hidden from listings, and can still be accessed directly
+// if the permissions allow it.
+type filteredFileSystem struct {
+	webdav.FileSystem
+}
+
+func (f filteredFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	file, err := f.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, ok := ctx.Value(listingFilterKey{}).(listingFilter)
+	if !ok {
+		return file, nil
+	}
+
+	return filteredFile{File: file, name: name, filter: filter}, nil
+}
+
+type filteredFile struct {
+	webdav.File
+	name   string
+	filter listingFilter
+}
+
+func (f filteredFile) Readdir(count int) ([]os.FileInfo, error) {
+	for {
+		fis, err := f.File.Readdir(count)
+
+		filtered := fis[:0]
+		for _, fi := range fis {
+			if f.filter(path.Join("/", f.name, fi.Name()), fi.IsDir()) {
+				filtered = append(filtered, fi)
+			}
+		}
+
+		// Reading a limited number of entries must not return none of them
+		// before the end of the collection, as that would end the listing.
+		if count <= 0 || len(filtered) > 0 || err != nil {
+			return filtered, err
+		}
+	}
+}
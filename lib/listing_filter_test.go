@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestServerHideUnreadable(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"public.txt":             []byte("public"),
+		"server.key":             []byte("key"),
+		"confidential/plans.txt": []byte("plans"),
+		"projects/a/notes.txt":   []byte("notes"),
+		"projects/a/secret.key":  []byte("key"),
+		"projects/b/notes.txt":   []byte("notes"),
+	})
+
+	config := `
+directory: %s
+hideUnreadable: %t
+permissions: R
+rules:
+  - path: /confidential/
+    permissions: none
+  - glob: "**/*.key"
+    permissions: none
+  - path: /projects/b/notes.txt
+    permissions: none
+`
+
+	readDir := func(client *gowebdav.Client, path string) []string {
+		files, err := client.ReadDir(path)
+		require.NoError(t, err)
+
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		return names
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestServer(t, fmt.Sprintf(config, dir, false))
+		defer srv.Close()
+
+		client := gowebdav.NewClient(srv.URL, "", "")
+		require.ElementsMatch(t, []string{"public.txt", "server.key", "confidential", "projects"}, readDir(client, "/"))
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestServer(t, fmt.Sprintf(config, dir, true))
+		defer srv.Close()
+
+		client := gowebdav.NewClient(srv.URL, "", "")
+		require.ElementsMatch(t, []string{"public.txt", "projects"}, readDir(client, "/"))
+		require.ElementsMatch(t, []string{"notes.txt"}, readDir(client, "/projects/a"))
+		require.Empty(t, readDir(client, "/projects/b"))
+
+		// Listings of the whole tree are filtered at every level.
+		req, err := http.NewRequest("PROPFIND", srv.URL+"/", nil)
+		require.NoError(t, err)
+		req.Header.Set("Depth", "infinity")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+
+		require.Contains(t, string(body), "/projects/a/notes.txt")
+		for _, hidden := range []string{"confidential", ".key", "/projects/b/notes.txt"} {
+			require.False(t, strings.Contains(string(body), hidden), hidden)
+		}
+
+		// Browsing a collection is filtered too.
+		resp, err = http.Get(srv.URL + "/")
+		require.NoError(t, err)
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.NotContains(t, string(body), "confidential")
+	})
+}
@@ -48,10 +48,7 @@ func newMultiDirLockSystem(ls webdav.LockSystem, mounts DirectoryMounts) *lockSy
 				return "", err
 			}
 
-			// filePath returns an OS-native path for real file operations; the
-			// lock namespace must stay slash-separated so descendant locks match
-			// on Windows.
-			return filepath.ToSlash(mount.filePath(rest)), nil
+			return mount.location(rest), nil
 		},
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -34,8 +35,11 @@ func (m multiDir) Mkdir(ctx context.Context, name string, perm os.FileMode) erro
 	if rest == "/" {
 		return os.ErrExist
 	}
+	if mount.ReadOnly {
+		return os.ErrPermission
+	}
 
-	return mount.dir(m.noSniff).Mkdir(ctx, rest, perm)
+	return mount.fileSystem(m.noSniff).Mkdir(ctx, rest, perm)
 }
 
 func (m multiDir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
@@ -54,11 +58,11 @@ func (m multiDir) OpenFile(ctx context.Context, name string, flag int, perm os.F
 	if err != nil {
 		return nil, err
 	}
-	if rest == "/" && writeFlag(flag) {
+	if (rest == "/" || mount.ReadOnly) && writeFlag(flag) {
 		return nil, os.ErrPermission
 	}
 
-	file, err := mount.dir(m.noSniff).OpenFile(ctx, rest, flag, perm)
+	file, err := mount.fileSystem(m.noSniff).OpenFile(ctx, rest, flag, perm)
 	if err != nil {
 		return nil, err
 	}
@@ -81,8 +85,11 @@ func (m multiDir) RemoveAll(ctx context.Context, name string) error {
 	if rest == "/" {
 		return os.ErrInvalid
 	}
+	if mount.ReadOnly {
+		return os.ErrPermission
+	}
 
-	return mount.dir(m.noSniff).RemoveAll(ctx, rest)
+	return mount.fileSystem(m.noSniff).RemoveAll(ctx, rest)
 }
 
 func (m multiDir) Rename(ctx context.Context, oldName, newName string) error {
@@ -97,9 +104,16 @@ func (m multiDir) Rename(ctx context.Context, oldName, newName string) error {
 	if oldRest == "/" || newRest == "/" {
 		return os.ErrInvalid
 	}
+	if oldMount.ReadOnly || newMount.ReadOnly {
+		return os.ErrPermission
+	}
 
 	if oldMount.Name == newMount.Name {
-		return oldMount.dir(m.noSniff).Rename(ctx, oldRest, newRest)
+		return oldMount.fileSystem(m.noSniff).Rename(ctx, oldRest, newRest)
+	}
+
+	if oldMount.Type == mountTypeS3 || newMount.Type == mountTypeS3 {
+		return renameAcrossFileSystems(ctx, oldMount.fileSystem(m.noSniff), oldRest, newMount.fileSystem(m.noSniff), newRest)
 	}
 
 	oldPath := oldMount.filePath(oldRest)
@@ -150,6 +164,45 @@ func renameAcrossMount(oldPath, newPath string) error {
 	return os.RemoveAll(oldPath)
 }
 
+// renameAcrossFileSystems moves the file or tree at oldName in src to newName
+// in dst by copying it, for mounts that cannot be renamed between natively.
+func renameAcrossFileSystems(ctx context.Context, src webdav.FileSystem, oldName string, dst webdav.FileSystem, newName string) error {
+	info, err := src.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	err = walkTree(ctx, src, oldName, info, func(name string, info os.FileInfo) error {
+		target := path.Join(newName, strings.TrimPrefix(name, oldName))
+		if info.IsDir() {
+			return dst.Mkdir(ctx, target, info.Mode().Perm())
+		}
+		return copyFileAcross(ctx, src, name, dst, target, info.Mode().Perm())
+	})
+	if err != nil {
+		_ = dst.RemoveAll(ctx, newName)
+		return err
+	}
+
+	return src.RemoveAll(ctx, oldName)
+}
+
+func copyFileAcross(ctx context.Context, src webdav.FileSystem, oldName string, dst webdav.FileSystem, newName string, perm os.FileMode) error {
+	source, err := src.OpenFile(ctx, oldName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	target, err := dst.OpenFile(ctx, newName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		_ = source.Close()
+		return err
+	}
+
+	_, copyErr := io.Copy(target, source)
+	return errors.Join(copyErr, target.Close(), source.Close())
+}
+
 func copyRegularFile(oldPath, newPath string) error {
 	source, err := os.Open(oldPath)
 	if err != nil {
@@ -202,7 +255,7 @@ func (m multiDir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 		return nil, err
 	}
 
-	info, err := mount.dir(m.noSniff).Stat(ctx, rest)
+	info, err := mount.fileSystem(m.noSniff).Stat(ctx, rest)
 	if err != nil {
 		return nil, err
 	}
@@ -235,7 +288,7 @@ func (m multiDir) resolve(name string) (DirectoryMount, string, error) {
 func (m multiDir) rootEntries(ctx context.Context) []os.FileInfo {
 	entries := make([]os.FileInfo, 0, len(m.mounts))
 	for _, mount := range m.mounts {
-		info, err := mount.dir(m.noSniff).Stat(ctx, "/")
+		info, err := mount.fileSystem(m.noSniff).Stat(ctx, "/")
 		if err != nil {
 			entries = append(entries, virtualDirInfo{name: mount.Name})
 			continue
@@ -250,13 +303,40 @@ func (m multiDir) rootEntries(ctx context.Context) []os.FileInfo {
 	return entries
 }
 
-func (d DirectoryMount) dir(noSniff bool) Dir {
+// fileSystem returns the file system of the mount. The noSniff setting of the
+// mount, if set, replaces the given one.
+func (d DirectoryMount) fileSystem(noSniff bool) webdav.FileSystem {
+	if d.NoSniff != nil {
+		noSniff = *d.NoSniff
+	}
+
+	if d.Type == mountTypeS3 {
+		return s3FileSystem{
+			client:  s3Client{S3: d.S3},
+			noSniff: noSniff,
+		}
+	}
+
 	return Dir{
 		Dir:     webdav.Dir(d.Path),
 		noSniff: noSniff,
 	}
 }
 
+// location returns a slash-separated name for name within the mount that is
+// the same for all mounts of the same directory or bucket, such as for locks
+// and quotas.
+func (d DirectoryMount) location(name string) string {
+	if d.Type == mountTypeS3 {
+		endpoint, _ := url.Parse(d.S3.Endpoint)
+		return "/s3/" + endpoint.Host + "/" + d.S3.Bucket + "/" + d.S3.Prefix + strings.TrimPrefix(name, "/")
+	}
+
+	// filePath returns an OS-native path for real file operations; locations
+	// must stay slash-separated so descendant locks match on Windows.
+	return filepath.ToSlash(d.filePath(name))
+}
+
 func (d DirectoryMount) filePath(name string) string {
 	return filepath.Join(d.Path, filepath.FromSlash(strings.TrimPrefix(name, "/")))
 }
@@ -1,6 +1,8 @@
 package lib
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -9,6 +11,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
 )
 
 func TestRenameAcrossMount(t *testing.T) {
@@ -70,3 +73,147 @@ func TestIsCrossDeviceError(t *testing.T) {
 	require.True(t, isCrossDeviceError(err))
 	require.False(t, isCrossDeviceError(os.ErrPermission))
 }
+
+func TestMultiDirReadOnly(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"a.txt": []byte("a")})
+	other := t.TempDir()
+	fs := multiDir{mounts: DirectoryMounts{
+		{Name: "ro", Path: dir, ReadOnly: true},
+		{Name: "rw", Path: other},
+	}}
+	ctx := context.Background()
+
+	f, err := fs.OpenFile(ctx, "/ro/a.txt", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = fs.OpenFile(ctx, "/ro/a.txt", os.O_RDWR, 0)
+	require.ErrorIs(t, err, os.ErrPermission)
+	_, err = fs.OpenFile(ctx, "/ro/b.txt", os.O_CREATE|os.O_WRONLY, 0666)
+	require.ErrorIs(t, err, os.ErrPermission)
+	require.ErrorIs(t, fs.Mkdir(ctx, "/ro/sub", 0777), os.ErrPermission)
+	require.ErrorIs(t, fs.RemoveAll(ctx, "/ro/a.txt"), os.ErrPermission)
+	require.ErrorIs(t, fs.Rename(ctx, "/ro/a.txt", "/rw/a.txt"), os.ErrPermission)
+	require.FileExists(t, filepath.Join(dir, "a.txt"))
+}
+
+func TestServerDirectoryMountSettings(t *testing.T) {
+	t.Parallel()
+
+	media := makeTestDirectory(t, map[string][]byte{
+		"a.txt":         []byte("a"),
+		"private/b.txt": []byte("b"),
+	})
+	archive := makeTestDirectory(t, map[string][]byte{"c.txt": []byte("c")})
+	inbox := makeTestDirectory(t, map[string][]byte{})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directories:
+  - name: media
+    path: %s
+    rules:
+      - path: /private/
+        permissions: none
+  - name: archive
+    path: %s
+    readOnly: true
+  - name: inbox
+    path: %s
+    permissions: C
+permissions: CRUD
+rules:
+  - path: /archive/
+    permissions: CRUD
+`, media, archive, inbox))
+	defer srv.Close()
+
+	client := gowebdav.NewClient(srv.URL, "", "")
+
+	// Rules of mounts are relative to the mount.
+	_, err := client.Read("/media/a.txt")
+	require.NoError(t, err)
+	_, err = client.Read("/media/private/b.txt")
+	require.ErrorContains(t, err, "403")
+
+	// Read-only mounts cannot be changed, even if rules allow it.
+	_, err = client.Read("/archive/c.txt")
+	require.NoError(t, err)
+	require.ErrorContains(t, client.Write("/archive/d.txt", []byte("d"), 0666), "403")
+	require.ErrorContains(t, client.Remove("/archive/c.txt"), "403")
+	require.ErrorContains(t, client.Copy("/media/a.txt", "/archive/a.txt", false), "403")
+	require.ErrorContains(t, client.Rename("/archive/c.txt", "/media/c.txt", false), "403")
+
+	// The permissions of mounts narrow those of the user.
+	require.NoError(t, client.Write("/inbox/e.txt", []byte("e"), 0666))
+	_, err = client.Read("/inbox/e.txt")
+	require.ErrorContains(t, err, "403")
+
+	// Even mounts inherited from the global settings cannot grant users more
+	// than they have.
+	srv = makeTestServer(t, fmt.Sprintf(`
+directories:
+  - name: inbox
+    path: %s
+    permissions: CRUD
+permissions: CRUD
+users:
+  - username: reader
+    password: reader
+    permissions: R
+`, inbox))
+	defer srv.Close()
+
+	client = gowebdav.NewClient(srv.URL, "reader", "reader")
+	_, err = client.Read("/inbox/e.txt")
+	require.NoError(t, err)
+	require.ErrorContains(t, client.Write("/inbox/f.txt", []byte("f"), 0666), "403")
+	require.ErrorContains(t, client.Remove("/inbox/e.txt"), "403")
+
+	// Nor can the rules that govern paths within them.
+	srv = makeTestServer(t, fmt.Sprintf(`
+directories:
+  - name: archive
+    path: %s
+    permissions: R
+permissions: CRUD
+rules:
+  - regex: ".*"
+    permissions: CRUD
+`, archive))
+	defer srv.Close()
+
+	client = gowebdav.NewClient(srv.URL, "", "")
+	_, err = client.Read("/archive/c.txt")
+	require.NoError(t, err)
+	require.ErrorContains(t, client.Write("/archive/d.txt", []byte("d"), 0666), "403")
+	require.ErrorContains(t, client.Remove("/archive/c.txt"), "403")
+
+	cfg := writeAndParseConfig(t, fmt.Sprintf(`
+directories:
+  - name: media
+    path: %s
+    noSniff: true
+    permissions: R
+`, media), ".yml")
+	require.Equal(t, &Permissions{Read: true}, cfg.Directories[0].Permissions)
+	require.True(t, *cfg.Directories[0].NoSniff)
+
+	writeAndParseConfigWithError(t, fmt.Sprintf(`
+directories:
+  - name: media
+    path: %s
+    readonly: yes
+    unknown: true
+`, media), ".yml", "unknown")
+
+	writeAndParseConfigWithError(t, fmt.Sprintf(`
+directories:
+  - name: media
+    path: %s
+    rules:
+      - path: /a/
+        retention: 1h
+`, media), ".yml", `mount "media"`)
+}
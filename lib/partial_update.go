@@ -40,8 +40,11 @@ func newPartialUpdateError(status int, message string) error {
 
 func writePartialUpdateError(w http.ResponseWriter, err error, fallbackStatus int) {
 	var httpErr partialUpdateError
+	var limitErr *bodyLimitError
 	if errors.As(err, &httpErr) {
 		fallbackStatus = httpErr.status
+	} else if errors.As(err, &limitErr) {
+		fallbackStatus = limitErr.status
 	}
 	http.Error(w, err.Error(), fallbackStatus)
 }
@@ -63,7 +66,7 @@ func (u *handlerUser) handleOptions(w http.ResponseWriter, r *http.Request, reqP
 	w.WriteHeader(http.StatusOK)
 }
 
-func (u *handlerUser) handlePartialUpdate(w http.ResponseWriter, r *http.Request, reqPath string) {
+func (u *handlerUser) handlePartialUpdate(w http.ResponseWriter, r *http.Request, reqPath string, uploads UploadFilter) {
 	contentRange := r.Header.Get("Content-Range")
 	isContentRangePut := r.Method == "PUT" && contentRange != ""
 
@@ -142,6 +145,30 @@ func (u *handlerUser) handlePartialUpdate(w http.ResponseWriter, r *http.Request
 		}
 	}
 
+	length := r.ContentLength
+	if updateRange.hasEnd {
+		length = updateRange.end - updateRange.offset + 1
+	}
+	status, err = checkPartialUpload(r, reqPath, uploads, currentSize, updateRange.offset, length)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	fits, err := u.checkPartialUpdateQuota(r, reqPath, exists, currentSize, updateRange.offset, length)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !fits {
+		http.Error(w, errQuotaExceeded.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
 	body := io.Reader(r.Body)
 	var cleanup func()
 	if updateRange.hasEnd {
@@ -151,6 +178,15 @@ func (u *handlerUser) handlePartialUpdate(w http.ResponseWriter, r *http.Request
 			return
 		}
 		defer cleanup()
+	} else if _, ok := r.Body.(*limitedBody); ok {
+		// Bodies that are cut at a limit are read completely before writing,
+		// so that one that goes beyond it leaves the file as it was.
+		body, cleanup, err = spoolBoundedBody(r.Body, -1)
+		if err != nil {
+			writePartialUpdateError(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		defer cleanup()
 	}
 
 	flag := os.O_RDWR
@@ -322,6 +358,8 @@ func parseByteRange(spec string, allowNegativeStart bool) (updateRange, error) {
 	return r, nil
 }
 
+// spoolBoundedBody copies body to a temporary file, and checks that it has the
+// expected length, unless it is negative.
 func spoolBoundedBody(body io.Reader, expected int64) (io.Reader, func(), error) {
 	tmp, err := os.CreateTemp("", "webdav-partial-update-*")
 	if err != nil {
@@ -339,11 +377,14 @@ func spoolBoundedBody(body io.Reader, expected int64) (io.Reader, func(), error)
 		}
 	}()
 
-	n, err := io.Copy(tmp, io.LimitReader(body, expected+1))
+	if expected >= 0 {
+		body = io.LimitReader(body, expected+1)
+	}
+	n, err := io.Copy(tmp, body)
 	if err != nil {
 		return nil, nil, err
 	}
-	if n != expected {
+	if expected >= 0 && n != expected {
 		return nil, nil, newPartialUpdateError(http.StatusRequestedRangeNotSatisfiable, "body length does not match byte range")
 	}
 
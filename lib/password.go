@@ -0,0 +1,538 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// passwordHasher verifies and generates the password hashes stored with a
+// "{name}" prefix, such as "{bcrypt}$2y$10$...".
+type passwordHasher interface {
+	// compare reports whether password matches hash.
+	compare(hash, password string) bool
+	// validate checks that hash is well-formed.
+	validate(hash string) error
+	// generate hashes password. A cost of zero selects the default cost.
+	generate(password string, cost int) (string, error)
+}
+
+// legacyHasher is implemented by the hashers that are only supported for
+// verifying existing passwords, such as those imported from htpasswd files.
+type legacyHasher interface {
+	legacy()
+}
+
+var errLegacyPasswordHash = errors.New("hash is only supported for existing passwords")
+
+// passwordHashers maps the lowercase prefix names to their implementation.
+var passwordHashers = map[string]passwordHasher{
+	"bcrypt":       bcryptHasher{},
+	"argon2id":     argon2idHasher{},
+	"scrypt":       scryptHasher{},
+	"sha256-crypt": shaCryptHasher{sha256Crypt},
+	"sha512-crypt": shaCryptHasher{sha512Crypt},
+	"ssha":         sshaHasher{},
+	"sha":          shaHasher{},
+	"md5-crypt":    cryptHasher{md5Crypt},
+	"des-crypt":    cryptHasher{desCrypt},
+}
+
+// maxPasswordLength is the maximum length of passwords, in bytes. Longer ones
+// never match, as some hashes, such as SHA-crypt, take time quadratic in the
+// length of the password, and the passwords come from unauthenticated clients.
+const maxPasswordLength = 4096
+
+// maxPasswordHashMemory is the maximum memory that verifying an argon2id or
+// scrypt hash may use, in bytes, and maxPasswordHashPasses the maximum number
+// of passes or lanes. The parameters come from the hashes themselves, which
+// would otherwise let a single one make every login attempt exhaust the
+// server.
+const (
+	maxPasswordHashMemory = 256 << 20
+	maxPasswordHashPasses = 64
+)
+
+var passwordPrefixRegexp = regexp.MustCompile(`^\{([A-Za-z0-9-]+)\}`)
+
+// splitPasswordHash splits a stored password into the name of its hash and
+// the hash itself. A password without a "{name}" prefix is plaintext, and
+// is returned with an empty name.
+func splitPasswordHash(password string) (name, hash string) {
+	match := passwordPrefixRegexp.FindStringSubmatch(password)
+	if match == nil {
+		return "", password
+	}
+
+	return strings.ToLower(match[1]), password[len(match[0]):]
+}
+
+// comparePassword reports whether input matches the stored password, which
+// is either plaintext or a hash with a known prefix. An empty stored password
+// never matches, and neither do inputs longer than [maxPasswordLength].
+func comparePassword(stored, input string) bool {
+	if stored == "" || len(input) > maxPasswordLength {
+		return false
+	}
+
+	name, hash := splitPasswordHash(stored)
+	if name == "" {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(input)) == 1
+	}
+
+	hasher, ok := passwordHashers[name]
+	if !ok {
+		return false
+	}
+
+	return hasher.compare(hash, input)
+}
+
+// validatePassword checks that a hashed password uses a known prefix and is
+// well-formed. Plaintext passwords are always valid.
+func validatePassword(stored string) error {
+	name, hash := splitPasswordHash(stored)
+	if name == "" {
+		return nil
+	}
+
+	hasher, ok := passwordHashers[name]
+	if !ok {
+		return fmt.Errorf("unknown password hash %q", name)
+	}
+
+	if err := hasher.validate(hash); err != nil {
+		return fmt.Errorf("invalid %s password hash: %w", name, err)
+	}
+
+	return nil
+}
+
+// PasswordAlgorithms returns the names of the password hashes that can be
+// used for new passwords.
+func PasswordAlgorithms() []string {
+	names := make([]string, 0, len(passwordHashers))
+	for name, hasher := range passwordHashers {
+		if _, ok := hasher.(legacyHasher); ok {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HashPassword hashes password with the given algorithm, returning it with
+// the "{name}" prefix so that it can be used directly in the configuration.
+// A cost of zero selects the default cost for the algorithm.
+func HashPassword(algorithm, password string, cost int) (string, error) {
+	algorithm = strings.ToLower(algorithm)
+	hasher, ok := passwordHashers[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unknown password hash %q", algorithm)
+	}
+
+	if _, ok := hasher.(legacyHasher); ok {
+		return "", fmt.Errorf("%s %w", algorithm, errLegacyPasswordHash)
+	}
+
+	if cost < 0 {
+		return "", errors.New("cost cannot be negative")
+	}
+
+	if len(password) > maxPasswordLength {
+		return "", fmt.Errorf("password cannot be longer than %d bytes", maxPasswordLength)
+	}
+
+	hash, err := hasher.generate(password, cost)
+	if err != nil {
+		return "", err
+	}
+
+	return "{" + algorithm + "}" + hash, nil
+}
+
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+type bcryptHasher struct{}
+
+func (bcryptHasher) compare(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (bcryptHasher) validate(hash string) error {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
+func (bcryptHasher) generate(password string, cost int) (string, error) {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	if cost < bcrypt.MinCost {
+		return "", fmt.Errorf("given cost cannot be under minimum cost of %d", bcrypt.MinCost)
+	}
+
+	if cost > bcrypt.MaxCost {
+		return "", fmt.Errorf("given cost cannot be over maximum cost of %d", bcrypt.MaxCost)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(hash), err
+}
+
+// argon2idHasher uses the PHC string format, as produced by the reference
+// implementation: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>. The cost is
+// the number of passes over the memory.
+type argon2idHasher struct{}
+
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func (argon2idHasher) parse(hash string) (argon2idParams, error) {
+	var p argon2idParams
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return p, errors.New("expected $argon2id$v=19$m=...,t=...,p=...$<salt>$<hash>")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, errors.New("invalid version")
+	}
+	if version != argon2.Version {
+		return p, fmt.Errorf("unsupported version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, errors.New("invalid parameters")
+	}
+	if p.memory == 0 || p.time == 0 || p.threads == 0 {
+		return p, errors.New("invalid parameters")
+	}
+	if uint64(p.memory)*1024 > maxPasswordHashMemory || p.time > maxPasswordHashPasses || p.threads > maxPasswordHashPasses {
+		return p, fmt.Errorf("parameters cannot use more than %d MiB of memory or %d passes or threads", maxPasswordHashMemory>>20, maxPasswordHashPasses)
+	}
+
+	var err error
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, errors.New("invalid salt")
+	}
+
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(p.key) == 0 {
+		return p, errors.New("invalid hash")
+	}
+
+	return p, nil
+}
+
+func (h argon2idHasher) compare(hash, password string) bool {
+	p, err := h.parse(hash)
+	if err != nil {
+		return false
+	}
+
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1
+}
+
+func (h argon2idHasher) validate(hash string) error {
+	_, err := h.parse(hash)
+	return err
+}
+
+func (argon2idHasher) generate(password string, cost int) (string, error) {
+	const (
+		memory  = 64 * 1024
+		threads = 4
+		keyLen  = 32
+	)
+
+	time := uint32(3)
+	if cost > 0 {
+		time = uint32(cost)
+	}
+	if time > maxPasswordHashPasses {
+		return "", fmt.Errorf("given cost cannot be over maximum cost of %d", maxPasswordHashPasses)
+	}
+
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// scryptHasher uses the format from passlib: $scrypt$ln=15,r=8,p=1$<salt>$<hash>,
+// where ln is the base-2 logarithm of the CPU/memory cost. The cost is ln.
+type scryptHasher struct{}
+
+type scryptParams struct {
+	logN int
+	r    int
+	p    int
+	salt []byte
+	key  []byte
+}
+
+func (scryptHasher) parse(hash string) (scryptParams, error) {
+	var p scryptParams
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "scrypt" {
+		return p, errors.New("expected $scrypt$ln=...,r=...,p=...$<salt>$<hash>")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.logN, &p.r, &p.p); err != nil {
+		return p, errors.New("invalid parameters")
+	}
+	if p.logN < 1 || p.logN > 30 || p.r < 1 || p.p < 1 {
+		return p, errors.New("invalid parameters")
+	}
+	if int64(p.r) > maxPasswordHashMemory/(128<<p.logN) || p.p > maxPasswordHashPasses {
+		return p, fmt.Errorf("parameters cannot use more than %d MiB of memory or %d passes", maxPasswordHashMemory>>20, maxPasswordHashPasses)
+	}
+
+	var err error
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return p, errors.New("invalid salt")
+	}
+
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(p.key) == 0 {
+		return p, errors.New("invalid hash")
+	}
+
+	return p, nil
+}
+
+func (h scryptHasher) compare(hash, password string) bool {
+	p, err := h.parse(hash)
+	if err != nil {
+		return false
+	}
+
+	key, err := scrypt.Key([]byte(password), p.salt, 1<<p.logN, p.r, p.p, len(p.key))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, p.key) == 1
+}
+
+func (h scryptHasher) validate(hash string) error {
+	_, err := h.parse(hash)
+	return err
+}
+
+func (scryptHasher) generate(password string, cost int) (string, error) {
+	const (
+		r      = 8
+		p      = 1
+		keyLen = 32
+	)
+
+	logN := 15
+	if cost > 0 {
+		logN = cost
+	}
+	if logN > 30 || int64(r) > maxPasswordHashMemory/(128<<logN) {
+		return "", errors.New("given cost cannot be over maximum cost of 18")
+	}
+
+	salt, err := randomSalt(16)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, keyLen)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		logN, r, p,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// shaCryptHasher uses the crypt(3) format: $6$rounds=5000$<salt>$<hash>, or
+// $5$ for SHA-256, where the rounds are optional. The cost is the number of
+// rounds.
+type shaCryptHasher struct {
+	variant shaCryptVariant
+}
+
+func (h shaCryptHasher) compare(hash, password string) bool {
+	computed, err := h.variant.crypt([]byte(password), hash)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+func (h shaCryptHasher) validate(hash string) error {
+	_, _, _, err := h.variant.parse(hash)
+	return err
+}
+
+func (h shaCryptHasher) generate(password string, cost int) (string, error) {
+	salt, err := randomSalt(12)
+	if err != nil {
+		return "", err
+	}
+
+	setting := h.variant.magic + cryptEncoding.EncodeToString(salt)[:16]
+	if cost > 0 {
+		if cost < shaCryptMinRounds || cost > shaCryptMaxRounds {
+			return "", fmt.Errorf("given cost must be between %d and %d", shaCryptMinRounds, shaCryptMaxRounds)
+		}
+		setting = h.variant.magic + "rounds=" + strconv.Itoa(cost) + "$" + setting[len(h.variant.magic):]
+	}
+
+	return h.variant.crypt([]byte(password), setting)
+}
+
+// sshaHasher uses the salted SHA-1 scheme from LDAP directories, where the
+// hash is base64(sha1(password + salt) + salt). It is only intended for
+// migrating existing users, and cannot be tuned.
+type sshaHasher struct{}
+
+func (sshaHasher) decode(hash string) ([]byte, []byte, error) {
+	data, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		return nil, nil, errors.New("invalid base64")
+	}
+
+	if len(data) <= sha1.Size {
+		return nil, nil, errors.New("missing salt")
+	}
+
+	return data[:sha1.Size], data[sha1.Size:], nil
+}
+
+func (h sshaHasher) compare(hash, password string) bool {
+	digest, salt, err := h.decode(hash)
+	if err != nil {
+		return false
+	}
+
+	sum := sha1.Sum(append([]byte(password), salt...))
+	return subtle.ConstantTimeCompare(sum[:], digest) == 1
+}
+
+func (h sshaHasher) validate(hash string) error {
+	_, _, err := h.decode(hash)
+	return err
+}
+
+func (sshaHasher) generate(password string, cost int) (string, error) {
+	if cost != 0 {
+		return "", errors.New("ssha does not support a cost")
+	}
+
+	salt, err := randomSalt(8)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha1.Sum(append([]byte(password), salt...))
+	return base64.StdEncoding.EncodeToString(append(sum[:], salt...)), nil
+}
+
+// shaHasher uses the unsalted SHA-1 scheme from htpasswd and LDAP directories,
+// where the hash is base64(sha1(password)).
+type shaHasher struct{}
+
+func (shaHasher) legacy() {}
+
+func (shaHasher) compare(hash, password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+}
+
+func (shaHasher) validate(hash string) error {
+	data, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		return errors.New("invalid base64")
+	}
+
+	if len(data) != sha1.Size {
+		return errors.New("invalid length")
+	}
+
+	return nil
+}
+
+func (shaHasher) generate(string, int) (string, error) {
+	return "", errLegacyPasswordHash
+}
+
+// cryptHasher uses the crypt(3) formats that are kept for existing users
+// only, such as the MD5 based "$apr1$" hashes from htpasswd.
+type cryptHasher struct {
+	crypt func(password []byte, setting string) (string, error)
+}
+
+func (cryptHasher) legacy() {}
+
+func (h cryptHasher) compare(hash, password string) bool {
+	computed, err := h.crypt([]byte(password), hash)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+func (h cryptHasher) validate(hash string) error {
+	// Hashing any password with the same setting must yield a hash of the
+	// same shape, otherwise the salt or the hash is malformed.
+	computed, err := h.crypt(nil, hash)
+	if err != nil {
+		return err
+	}
+
+	if len(computed) != len(hash) {
+		return errors.New("invalid length")
+	}
+
+	return nil
+}
+
+func (cryptHasher) generate(string, int) (string, error) {
+	return "", errLegacyPasswordHash
+}
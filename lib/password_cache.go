@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultPasswordCacheSize = 1000
+
+type PasswordCache struct {
+	// TTL is how long a verified password is remembered. Zero disables it.
+	TTL time.Duration
+
+	// Size is the maximum number of remembered passwords.
+	Size int
+}
+
+func (c *PasswordCache) enabled() bool {
+	return c.TTL > 0
+}
+
+func (c *PasswordCache) Validate() error {
+	if c.TTL < 0 {
+		return errors.New("invalid password cache: ttl cannot be negative")
+	}
+
+	if c.Size == 0 {
+		c.Size = DefaultPasswordCacheSize
+	}
+
+	if c.Size < 0 {
+		return errors.New("invalid password cache: size cannot be negative")
+	}
+
+	return nil
+}
+
+// passwordCache remembers successful password verifications, so that clients
+// that send the same credentials with every request do not pay for the
+// password hash every time. Only an HMAC of the username, the stored password
+// and the given password is kept, with a secret that only lives in memory.
+// Since the stored password is part of the key, entries stop matching as soon
+// as the password of the user changes.
+type passwordCache struct {
+	PasswordCache
+	secret []byte
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]time.Time
+	hits    uint64
+	misses  uint64
+}
+
+func newPasswordCache(c PasswordCache) (*passwordCache, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &passwordCache{
+		PasswordCache: c,
+		secret:        secret,
+		now:           time.Now,
+		entries:       map[[sha256.Size]byte]time.Time{},
+	}, nil
+}
+
+func (c *passwordCache) key(username, stored, input string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, c.secret)
+	for _, value := range []string{username, stored, input} {
+		mac.Write([]byte(value))
+		mac.Write([]byte{0})
+	}
+
+	var key [sha256.Size]byte
+	mac.Sum(key[:0])
+	return key
+}
+
+// cached returns whether input matches stored without hashing it: plaintext
+// passwords are compared, and hashed ones only match if the comparison
+// succeeded recently.
+func (c *passwordCache) cached(lZap *zap.Logger, username, stored, input string) bool {
+	if name, _ := splitPasswordHash(stored); name == "" {
+		// Plaintext passwords are cheap to compare.
+		return comparePassword(stored, input)
+	}
+
+	key := c.key(username, stored, input)
+	now := c.now()
+
+	c.mu.Lock()
+	expires, ok := c.entries[key]
+	if !ok || !now.Before(expires) {
+		c.mu.Unlock()
+		return false
+	}
+	c.hits++
+	hits, misses := c.hits, c.misses
+	c.mu.Unlock()
+
+	lZap.Debug("password cache hit", zap.String("username", username), zap.Uint64("hits", hits), zap.Uint64("misses", misses))
+	return true
+}
+
+// compare works like [comparePassword], but remembers successful comparisons
+// of hashed passwords. Failed comparisons are never remembered, so that
+// guessing passwords stays as expensive as the hash makes it.
+func (c *passwordCache) compare(lZap *zap.Logger, username, stored, input string) bool {
+	if c.cached(lZap, username, stored, input) {
+		return true
+	}
+	if name, _ := splitPasswordHash(stored); name == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+
+	if !comparePassword(stored, input) {
+		return false
+	}
+
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.Size {
+		c.prune(now)
+	}
+	c.entries[c.key(username, stored, input)] = now.Add(c.TTL)
+
+	return true
+}
+
+// prune removes the expired entries and, if the cache is still full, the ones
+// that expire first, to make room for a new entry.
+func (c *passwordCache) prune(now time.Time) {
+	var (
+		oldestKey     [sha256.Size]byte
+		oldestExpires time.Time
+	)
+
+	for key, expires := range c.entries {
+		if !now.Before(expires) {
+			delete(c.entries, key)
+		} else if oldestExpires.IsZero() || expires.Before(oldestExpires) {
+			oldestKey, oldestExpires = key, expires
+		}
+	}
+
+	if len(c.entries) >= c.Size {
+		delete(c.entries, oldestKey)
+	}
+}
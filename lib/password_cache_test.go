@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"go.uber.org/zap"
+)
+
+func TestPasswordCache(t *testing.T) {
+	t.Parallel()
+
+	const (
+		stored = "{bcrypt}$2a$12$222dfz8Nweoyvy8OwI8.me9nfaRfuz8lqGkiiYSMH1lLMHO26qWom"
+		other  = "{md5-crypt}$1$abcdefgh$irWbblnpmw.5z7wgBnprh0"
+	)
+
+	p := PasswordCache{TTL: time.Minute, Size: 2}
+	require.NoError(t, p.Validate())
+
+	c, err := newPasswordCache(p)
+	require.NoError(t, err)
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	compare := func(username, stored, input string) bool {
+		return c.compare(zap.NewNop(), username, stored, input)
+	}
+
+	// Failures are not remembered.
+	require.False(t, compare("john", stored, "wrong"))
+	require.False(t, compare("john", stored, "wrong"))
+	require.Empty(t, c.entries)
+	require.EqualValues(t, 0, c.hits)
+
+	require.True(t, compare("john", stored, "bcrypt"))
+	require.True(t, compare("john", stored, "bcrypt"))
+	require.EqualValues(t, 1, c.hits)
+	require.EqualValues(t, 3, c.misses)
+
+	// Entries are specific to the username and the stored password, so a
+	// changed password is verified again.
+	now = now.Add(time.Second)
+	require.True(t, compare("jane", stored, "bcrypt"))
+	require.False(t, compare("john", other, "bcrypt"))
+	require.EqualValues(t, 1, c.hits)
+
+	// Plaintext passwords are not cached.
+	require.True(t, compare("john", "plain", "plain"))
+	require.Len(t, c.entries, 2)
+
+	// The cache is bounded, and makes room by removing the entries that expire
+	// first.
+	now = now.Add(time.Second)
+	require.True(t, compare("john", other, "test"))
+	require.Len(t, c.entries, 2)
+	require.NotContains(t, c.entries, c.key("john", stored, "bcrypt"))
+	require.Contains(t, c.entries, c.key("jane", stored, "bcrypt"))
+
+	// Entries expire.
+	now = now.Add(time.Minute)
+	hits := c.hits
+	require.True(t, compare("john", other, "test"))
+	require.Equal(t, hits, c.hits)
+
+	require.ErrorContains(t, (&PasswordCache{TTL: -time.Minute}).Validate(), "ttl cannot be negative")
+}
+
+func TestServerPasswordCache(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"foo.txt": []byte("foo")})
+
+	cfg := writeAndParseConfig(t, fmt.Sprintf(`
+directory: %s
+
+passwordCache:
+  ttl: 1m
+
+users:
+  - username: john
+    password: "{bcrypt}$2a$12$222dfz8Nweoyvy8OwI8.me9nfaRfuz8lqGkiiYSMH1lLMHO26qWom"
+    appPasswords:
+      - name: phone
+        password: "{md5-crypt}$1$abcdefgh$irWbblnpmw.5z7wgBnprh0"
+`, dir), ".yml")
+	require.Equal(t, DefaultPasswordCacheSize, cfg.PasswordCache.Size)
+
+	handler, err := NewHandler(cfg)
+	require.NoError(t, err)
+	cache := handler.(*Handler).passwords
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, password := range []string{"bcrypt", "bcrypt", "test", "test"} {
+		_, err := gowebdav.NewClient(srv.URL, "john", password).Read("/foo.txt")
+		require.NoError(t, err)
+	}
+	// App passwords are found in the cache without hashing the password of the
+	// user first.
+	cache.mu.Lock()
+	require.EqualValues(t, 2, cache.hits)
+	require.EqualValues(t, 3, cache.misses)
+	cache.mu.Unlock()
+
+	_, err = gowebdav.NewClient(srv.URL, "john", "wrong").Read("/foo.txt")
+	require.ErrorContains(t, err, "401")
+}
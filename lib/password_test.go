@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComparePassword(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		stored   string
+		password string
+	}{{
+		name:     "plaintext",
+		stored:   "secret",
+		password: "secret",
+	}, {
+		name:     "bcrypt",
+		stored:   "{bcrypt}$2a$12$222dfz8Nweoyvy8OwI8.me9nfaRfuz8lqGkiiYSMH1lLMHO26qWom",
+		password: "bcrypt",
+	}, {
+		// From the test suite of the reference implementation.
+		name:     "argon2id",
+		stored:   "{argon2id}$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		password: "password",
+	}, {
+		name:     "argon2id low memory",
+		stored:   "{argon2id}$argon2id$v=19$m=256,t=2,p=1$c29tZXNhbHQ$nf65EOgLrQMR/uIPnA4rEsF5h7TKyQwu9U1bMCHGi/4",
+		password: "password",
+	}, {
+		name:     "scrypt",
+		stored:   "{scrypt}$scrypt$ln=10,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg$S7FwBvpu+z8K0PUVUagFRTUAB2dAxIZpzVHvLZir+98",
+		password: "secret",
+	}, {
+		name:     "sha512-crypt",
+		stored:   "{sha512-crypt}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		password: "Hello world!",
+	}, {
+		name:     "sha512-crypt rounds",
+		stored:   "{sha512-crypt}$6$rounds=6000$IN3mk1tXZkEvayjU$Ad/93NdfMBH4Ze38Qg9Ud5E.sFN9VBupxL3GgKqxm1yF88FUUlC7Qz67UZzYUZULtV51VLuEAVKw454BtvDpi.",
+		password: "x",
+	}, {
+		name:     "sha512-crypt long password",
+		stored:   "{sha512-crypt}$6$ab$o0NaOLklc3yabjF.Lfl2/c4Un6FuGELPfrgROFuWvVa.RXHx1iCuExGu5EIlU6hBP./pTnqDHSX.ZMjduvQhx0",
+		password: "a much longer password than the digest size of sha512 so that we go around the loop more than once xx",
+	}, {
+		name:     "sha256-crypt rounds",
+		stored:   "{sha256-crypt}$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA",
+		password: "Hello world!",
+	}, {
+		name:     "md5-crypt",
+		stored:   "{md5-crypt}$1$abcdefgh$irWbblnpmw.5z7wgBnprh0",
+		password: "test",
+	}, {
+		name:     "md5-crypt apr1",
+		stored:   "{md5-crypt}$apr1$abcdefgh$/cesMUEGhga5MgaTGywaW0",
+		password: "test",
+	}, {
+		name:     "des-crypt",
+		stored:   "{des-crypt}abgOeLfPimXQo",
+		password: "test",
+	}, {
+		name:     "des-crypt other salt",
+		stored:   "{des-crypt}Xy66mTkgaWMYA",
+		password: "secret",
+	}, {
+		name:     "sha",
+		stored:   "{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=",
+		password: "test",
+	}, {
+		name:     "ssha uppercase",
+		stored:   "{SSHA}1G904nLkTkGWjKNnQuB/hpWXC/hzYWx0c2FsdA==",
+		password: "secret",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.NoError(t, validatePassword(tc.stored))
+			require.True(t, comparePassword(tc.stored, tc.password))
+			require.False(t, comparePassword(tc.stored, tc.password+"x"))
+			require.False(t, comparePassword(tc.stored, ""))
+		})
+	}
+}
+
+func TestComparePasswordTooLong(t *testing.T) {
+	t.Parallel()
+
+	password := strings.Repeat("a", maxPasswordLength)
+	hash, err := HashPassword("sha512-crypt", password, 0)
+	require.NoError(t, err)
+	require.True(t, comparePassword(hash, password))
+	require.True(t, comparePassword(password, password))
+
+	// Longer passwords are rejected before hashing, even if they match.
+	password += "a"
+	require.False(t, comparePassword(password, password))
+
+	start := time.Now()
+	require.False(t, comparePassword(hash, strings.Repeat("a", 1<<20)))
+	require.Less(t, time.Since(start), time.Second)
+
+	_, err = HashPassword("sha512-crypt", password, 0)
+	require.ErrorContains(t, err, "cannot be longer than 4096 bytes")
+}
+
+func TestHashPassword(t *testing.T) {
+	t.Parallel()
+
+	for _, algorithm := range PasswordAlgorithms() {
+		t.Run(algorithm, func(t *testing.T) {
+			t.Parallel()
+
+			cost := 0
+			switch algorithm {
+			case "bcrypt":
+				cost = 4
+			case "scrypt":
+				cost = 10
+			case "argon2id":
+				cost = 1
+			}
+
+			hash, err := HashPassword(algorithm, "secret", cost)
+			require.NoError(t, err)
+			require.NoError(t, validatePassword(hash))
+			require.True(t, comparePassword(hash, "secret"))
+			require.False(t, comparePassword(hash, "wrong"))
+		})
+	}
+
+	_, err := HashPassword("md4", "secret", 0)
+	require.ErrorContains(t, err, "unknown password hash")
+
+	_, err = HashPassword("des-crypt", "secret", 0)
+	require.ErrorContains(t, err, "only supported for existing passwords")
+
+	_, err = HashPassword("bcrypt", "secret", 40)
+	require.ErrorContains(t, err, "maximum cost")
+
+	_, err = HashPassword("argon2id", "secret", 65)
+	require.ErrorContains(t, err, "maximum cost")
+
+	_, err = HashPassword("scrypt", "secret", 19)
+	require.ErrorContains(t, err, "maximum cost")
+}
+
+func TestValidatePassword(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validatePassword("plain"))
+	require.ErrorContains(t, validatePassword("{argon2}$argon2id$v=19$m=1,t=1,p=1$c2FsdA$aGFzaA"), "unknown password hash")
+	require.ErrorContains(t, validatePassword("{argon2id}$argon2i$v=19$m=1,t=1,p=1$c2FsdA$aGFzaA"), "invalid argon2id password hash")
+	require.ErrorContains(t, validatePassword("{bcrypt}nope"), "invalid bcrypt password hash")
+	require.ErrorContains(t, validatePassword("{sha512-crypt}$5$salt$hash"), "invalid sha512-crypt password hash")
+	require.ErrorContains(t, validatePassword("{ssha}c2hvcnQ="), "missing salt")
+	require.ErrorContains(t, validatePassword("{des-crypt}abgOeLf"), "invalid length")
+	require.ErrorContains(t, validatePassword("{md5-crypt}$2$abcdefgh$irWbblnpmw.5z7wgBnprh0"), "expected $1$ or $apr1$ prefix")
+
+	// Costs that would let verifying a single password exhaust the server are
+	// rejected.
+	require.ErrorContains(t, validatePassword("{argon2id}$argon2id$v=19$m=4194304,t=1,p=1$c2FsdA$aGFzaA"), "cannot use more than 256 MiB")
+	require.ErrorContains(t, validatePassword("{argon2id}$argon2id$v=19$m=256,t=1000,p=1$c2FsdA$aGFzaA"), "cannot use more than 256 MiB")
+	require.ErrorContains(t, validatePassword("{scrypt}$scrypt$ln=20,r=8,p=1$c2FsdA$aGFzaA"), "cannot use more than 256 MiB")
+	require.ErrorContains(t, validatePassword("{scrypt}$scrypt$ln=10,r=1000000000,p=1$c2FsdA$aGFzaA"), "cannot use more than 256 MiB")
+	require.False(t, comparePassword("{scrypt}$scrypt$ln=20,r=8,p=1$c2FsdA$aGFzaA", "secret"))
+}
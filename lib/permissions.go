@@ -3,27 +3,103 @@ package lib
 import (
 	"errors"
 	"fmt"
+	"net/netip"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
 )
 
 type Rule struct {
 	Permissions Permissions
 	Path        string
 	Regex       *regexp.Regexp
+
+	// Glob is a pattern with doublestar semantics: "*" and "?" match within a
+	// path segment, "**" matches any number of segments, and "{a,b}" matches
+	// either alternative.
+	Glob string
+
+	// SourceCIDRs and Schedule are conditions of the rule. A rule only applies
+	// to requests from one of the given addresses or networks, and made within
+	// the schedule. Otherwise, it is skipped.
+	SourceCIDRs []string
+	Schedule    *Schedule
+
+	// WORM makes the files the rule matches write-once: they can be created,
+	// but not changed, moved or deleted until their retention expires, even
+	// with the permissions to do so, from this rule or any other. Retention
+	// is counted from when a file was written, and zero means forever. The
+	// conditions of the rule do not apply to it.
+	WORM      bool
+	Retention time.Duration
+
+	// UploadFilter constrains the uploads to the paths the rule matches,
+	// instead of the constraints of the user, for those it defines. A rule
+	// without permissions that defines upload constraints only constrains
+	// uploads, and does not change the permissions of the paths it matches.
+	UploadFilter `mapstructure:",squash"`
+
+	sourcePrefixes []netip.Prefix
+}
+
+// String returns how the rule matches paths.
+func (r *Rule) String() string {
+	switch {
+	case r.Regex != nil:
+		return "regex " + r.Regex.String()
+	case r.Glob != "":
+		return "glob " + r.Glob
+	default:
+		return "path " + r.Path
+	}
 }
 
 func (r *Rule) Validate() error {
-	if r.Regex == nil && r.Path == "" {
-		return errors.New("invalid rule: must either define a path of a regex")
+	defined := 0
+	for _, set := range []bool{r.Path != "", r.Regex != nil, r.Glob != ""} {
+		if set {
+			defined++
+		}
+	}
+
+	if defined == 0 {
+		return errors.New("invalid rule: must either define a path of a regex or a glob")
 	}
 
 	if r.Regex != nil && r.Path != "" {
 		return errors.New("invalid rule: cannot define both regex and path")
 	}
 
-	return nil
+	if defined > 1 {
+		return errors.New("invalid rule: cannot define a glob with a path or a regex")
+	}
+
+	if r.Glob != "" {
+		if !doublestar.ValidatePattern(r.Glob) {
+			return fmt.Errorf("invalid rule: invalid glob %q", r.Glob)
+		}
+
+		if strings.HasSuffix(r.Glob, "/") {
+			return fmt.Errorf("invalid rule: glob %q cannot end with a slash, use %q to match the contents of a directory", r.Glob, r.Glob+"**")
+		}
+	}
+
+	if r.Retention < 0 {
+		return errors.New("invalid rule: retention cannot be negative")
+	}
+
+	if r.Retention > 0 && !r.WORM {
+		return errors.New("invalid rule: retention requires worm")
+	}
+
+	if err := r.UploadFilter.Validate(); err != nil {
+		return fmt.Errorf("invalid rule: %w", err)
+	}
+
+	return r.validateConditions()
 }
 
 // Matches checks if [Rule] matches the given path.
@@ -32,13 +108,25 @@ func (r *Rule) Matches(path string) bool {
 		return r.Regex.MatchString(path)
 	}
 
+	if r.Glob != "" {
+		// A glob ending in "/**" names the contents of a collection, like a
+		// path rule with a trailing slash, and leaves the collection itself to
+		// matchesCollection.
+		return matchGlob(r.Glob, path) && !r.matchesCollection(path)
+	}
+
 	return strings.HasPrefix(path, r.Path)
 }
 
 // matchesCollection checks if [Rule] names path as the collection it governs,
-// such as a rule for "/c/" and a request for "/c". Regex rules are matched
-// literally and are not considered here.
+// such as a rule for "/c/" or for the glob "/c/**", and a request for "/c".
+// Regex rules are matched literally and are not considered here.
 func (r *Rule) matchesCollection(path string) bool {
+	if r.Glob != "" {
+		base, ok := strings.CutSuffix(r.Glob, "/**")
+		return ok && base != "" && !strings.HasSuffix(path, "/") && matchGlob(base, path)
+	}
+
 	if r.Regex != nil || !strings.HasSuffix(r.Path, "/") {
 		return false
 	}
@@ -46,6 +134,17 @@ func (r *Rule) matchesCollection(path string) bool {
 	return path == strings.TrimSuffix(r.Path, "/")
 }
 
+// matchGlob matches a path against a glob. Globs match paths as if they had
+// no trailing slash, so that "/c/*" matches a request for "/c/d/" as well.
+func matchGlob(glob, path string) bool {
+	if path != "/" {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	ok, _ := doublestar.Match(glob, path)
+	return ok
+}
+
 type RulesBehavior string
 
 const (
@@ -59,58 +158,195 @@ type UserPermissions struct {
 	Permissions   Permissions
 	Rules         []*Rule
 	RulesBehavior RulesBehavior
+	Quota         Quota
+	UploadFilter  `mapstructure:",squash"`
 
 	directoryExplicit   bool
 	directoriesExplicit bool
 	useDirectories      bool
+
+	// homes are the directories that the {username} placeholder was replaced
+	// in, which are created if missing.
+	homes []string
 }
 
 type DirectoryMount struct {
 	Name string
 	Path string
+
+	// Type is the type of the mount: "local", the default, for the directory
+	// at Path, or "s3" for the bucket configured by the S3 settings, which are
+	// set alongside the others.
+	Type string
+	S3   S3 `mapstructure:",squash"`
+
+	// Permissions, if set, narrow the permissions of the user and of the rules
+	// that govern paths within the mount, and Rules apply within the mount
+	// after the rules of the user, with paths relative to the mount.
+	Permissions *Permissions
+	Rules       []*Rule
+
+	// ReadOnly denies all changes to the mount, whatever the permissions and
+	// rules. NoSniff, if set, replaces the global noSniff for the mount.
+	ReadOnly bool
+	NoSniff  *bool
 }
 
 type DirectoryMounts []DirectoryMount
 
+const (
+	mountTypeLocal = "local"
+	mountTypeS3    = "s3"
+)
+
 // Allowed checks if the user has permission to access a directory/file
 func (p UserPermissions) Allowed(r *request, fileExists func(string) bool) bool {
 	// For COPY and MOVE requests, we first check the permissions for the destination
 	// path. As soon as a rule matches and does not allow the operation at the destination,
 	// we fail immediately. If no rule matches, we check the global permissions.
 	if r.method == "COPY" || r.method == "MOVE" {
-		if !p.allowedAt(r.destination, func(perms Permissions) bool {
+		if !p.allowedAt(r, r.destination, func(perms Permissions) bool {
 			return perms.AllowedDestination(r, fileExists)
 		}) {
 			return false
 		}
 	}
 
-	return p.allowedAt(r.path, func(perms Permissions) bool {
+	return p.allowedAt(r, r.path, func(perms Permissions) bool {
 		return perms.Allowed(r, fileExists)
 	})
 }
 
 // allowedAt resolves the permissions that govern path and applies check to them.
-func (p UserPermissions) allowedAt(path string, check func(Permissions) bool) bool {
+func (p UserPermissions) allowedAt(r *request, path string, check func(Permissions) bool) bool {
+	restrict := func(perms Permissions) Permissions { return perms }
+	if mount, _, ok := p.mountAt(path); ok {
+		restrict = func(perms Permissions) Permissions {
+			return mount.restrict(mount.narrow(perms))
+		}
+	}
+
+	base := p.Permissions
+	rule, collection := p.ruleAt(r, path)
+	switch {
+	case rule == nil:
+		return check(restrict(base))
+	case collection:
+		// A rule written with a trailing slash also governs the collection it
+		// names, so that a rule for "/c/" cannot be evaded by asking for "/c".
+		// Such a request acts on an entry of the parent collection, so it needs
+		// the permissions that apply there too. Requiring both means the rule can
+		// restrict the collection without granting access that would otherwise
+		// not exist.
+		return check(restrict(rule.Permissions)) && check(restrict(base))
+	default:
+		return check(restrict(rule.Permissions))
+	}
+}
+
+// ruleAt returns the rule that governs path, if any, and whether it governs
+// it as the collection the rule names. The rules of users come after those of
+// their groups, which come after the global ones, and the rules of directory
+// mounts come after those, so the most specific settings are checked first.
+// Rules whose conditions are not met by r are skipped, and so are those that
+// only constrain uploads.
+func (p UserPermissions) ruleAt(r *request, path string) (*Rule, bool) {
+	rules := p.rulesAt(path)
+
 	// Go through rules beginning from the last one. The first matched rule returns.
-	for i := len(p.Rules) - 1; i >= 0; i-- {
-		if p.Rules[i].Matches(path) {
-			return check(p.Rules[i].Permissions)
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].Matches(rules[i].path) && rules[i].conditionsMet(r) && !rules[i].constrainsUploadsOnly() {
+			return rules[i].Rule, false
+		}
+	}
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].matchesCollection(rules[i].path) && rules[i].conditionsMet(r) && !rules[i].constrainsUploadsOnly() {
+			return rules[i].Rule, true
 		}
 	}
 
-	// A rule written with a trailing slash also governs the collection it names,
-	// so that a rule for "/c/" cannot be evaded by asking for "/c". Such a request
-	// acts on an entry of the parent collection, so it needs the permissions that
-	// apply there too. Requiring both means the rule can restrict the collection
-	// without granting access that would otherwise not exist.
-	for i := len(p.Rules) - 1; i >= 0; i-- {
-		if p.Rules[i].matchesCollection(path) {
-			return check(p.Rules[i].Permissions) && check(p.Permissions)
+	return nil, false
+}
+
+// scopedRule is a rule with the path that it is matched against.
+type scopedRule struct {
+	*Rule
+	path string
+}
+
+// rulesAt returns the rules that can govern path, in order. The rules of the
+// directory mount that path is in, if any, come last, and are matched against
+// the path within the mount.
+func (p UserPermissions) rulesAt(path string) []scopedRule {
+	mount, rest, ok := p.mountAt(path)
+
+	rules := make([]scopedRule, 0, len(p.Rules)+len(mount.Rules))
+	for _, rule := range p.Rules {
+		rules = append(rules, scopedRule{Rule: rule, path: path})
+	}
+
+	if ok {
+		for _, rule := range mount.Rules {
+			rules = append(rules, scopedRule{Rule: rule, path: rest})
 		}
 	}
 
-	return check(p.Permissions)
+	return rules
+}
+
+// allRules returns the rules of the user, followed by those of its directory
+// mounts.
+func (p UserPermissions) allRules() []*Rule {
+	rules := append([]*Rule{}, p.Rules...)
+	if p.useDirectories {
+		for _, mount := range p.Directories {
+			rules = append(rules, mount.Rules...)
+		}
+	}
+	return rules
+}
+
+// mountAt returns the directory mount that path is in, if any, and the path
+// within the mount, which keeps its trailing slash.
+func (p UserPermissions) mountAt(path string) (DirectoryMount, string, bool) {
+	if !p.useDirectories {
+		return DirectoryMount{}, "", false
+	}
+
+	name, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	for _, mount := range p.Directories {
+		if mount.Name == name {
+			return mount, "/" + rest, true
+		}
+	}
+
+	return DirectoryMount{}, "", false
+}
+
+// narrow returns the given permissions, of the user or of a rule, that the
+// mount also grants, if it defines permissions. Mounts inherited from the
+// global settings cannot grant users more than they have, and no rule can
+// grant more than the mount does.
+func (d DirectoryMount) narrow(perms Permissions) Permissions {
+	if d.Permissions == nil {
+		return perms
+	}
+
+	return Permissions{
+		Create: perms.Create && d.Permissions.Create,
+		Read:   perms.Read && d.Permissions.Read,
+		Update: perms.Update && d.Permissions.Update,
+		Delete: perms.Delete && d.Permissions.Delete,
+	}
+}
+
+// restrict returns perms without the permissions that the mount denies.
+func (d DirectoryMount) restrict(perms Permissions) Permissions {
+	if d.ReadOnly {
+		return Permissions{Read: perms.Read}
+	}
+	return perms
 }
 
 func (p *UserPermissions) Validate() error {
@@ -133,6 +369,14 @@ func (p *UserPermissions) Validate() error {
 		}
 	}
 
+	if err := p.Quota.Validate(); err != nil {
+		return fmt.Errorf("invalid permissions: %w", err)
+	}
+
+	if err := p.UploadFilter.Validate(); err != nil {
+		return fmt.Errorf("invalid permissions: %w", err)
+	}
+
 	switch p.RulesBehavior {
 	case RulesAppend, RulesOverwrite:
 		// Good to go
@@ -148,18 +392,39 @@ func (d *DirectoryMounts) Validate() error {
 
 	for i := range *d {
 		mount := &(*d)[i]
-		if mount.Path == "" {
-			return errors.New("invalid directories: path must be defined")
-		}
-
-		path, err := filepath.Abs(mount.Path)
-		if err != nil {
-			return fmt.Errorf("invalid directories: %w", err)
-		}
-		mount.Path = path
-
-		if mount.Name == "" {
-			mount.Name = filepath.Base(path)
+		switch mount.Type {
+		case "", mountTypeLocal:
+			if mount.Path == "" {
+				return errors.New("invalid directories: path must be defined")
+			}
+
+			if mount.S3 != (S3{}) {
+				return fmt.Errorf("invalid directories: mount %q: s3 settings require type %s", mount.Path, mountTypeS3)
+			}
+
+			path, err := filepath.Abs(mount.Path)
+			if err != nil {
+				return fmt.Errorf("invalid directories: %w", err)
+			}
+			mount.Path = path
+
+			if mount.Name == "" {
+				mount.Name = filepath.Base(path)
+			}
+		case mountTypeS3:
+			if mount.Name == "" {
+				return errors.New("invalid directories: s3 mounts must define name")
+			}
+
+			if mount.Path != "" {
+				return fmt.Errorf("invalid directories: mount %q: s3 mounts cannot define path", mount.Name)
+			}
+
+			if err := mount.S3.Validate(); err != nil {
+				return fmt.Errorf("invalid directories: mount %q: %w", mount.Name, err)
+			}
+		default:
+			return fmt.Errorf("invalid directories: unknown mount type %q", mount.Type)
 		}
 
 		if !validDirectoryMountName(mount.Name) {
@@ -170,6 +435,12 @@ func (d *DirectoryMounts) Validate() error {
 			return fmt.Errorf("invalid directories: duplicate mount name %q", mount.Name)
 		}
 		names[mount.Name] = struct{}{}
+
+		for _, r := range mount.Rules {
+			if err := r.Validate(); err != nil {
+				return fmt.Errorf("invalid directories: mount %q: %w", mount.Name, err)
+			}
+		}
 	}
 
 	return nil
@@ -214,6 +485,25 @@ func (p *Permissions) UnmarshalText(data []byte) error {
 	return nil
 }
 
+// String returns the permissions in the form they are configured, such as
+// "CRUD" or "none".
+func (p Permissions) String() string {
+	var sb strings.Builder
+	for _, perm := range []struct {
+		allowed bool
+		letter  byte
+	}{{p.Create, 'C'}, {p.Read, 'R'}, {p.Update, 'U'}, {p.Delete, 'D'}} {
+		if perm.allowed {
+			sb.WriteByte(perm.letter)
+		}
+	}
+
+	if sb.Len() == 0 {
+		return "none"
+	}
+	return sb.String()
+}
+
 // Allowed returns whether this permission set has permissions to execute this
 // request in the source directory. This applies to all requests with all methods.
 func (p Permissions) Allowed(r *request, fileExists func(string) bool) bool {
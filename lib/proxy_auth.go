@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type ProxyAuth struct {
+	// Header is the request header with the username, such as X-Remote-User.
+	Header string
+
+	// TrustedProxies are the addresses or CIDR ranges of the proxies that are
+	// allowed to set Header. The header is ignored in requests from any other
+	// address.
+	TrustedProxies []string
+	trustedProxies []netip.Prefix
+
+	// Template defines the permissions of the users that are not in the
+	// configuration. If it is not set, such users are rejected.
+	Template *UserPermissions
+}
+
+func (p *ProxyAuth) Validate() error {
+	if p.Header == "" {
+		if len(p.TrustedProxies) > 0 || p.Template != nil {
+			return errors.New("invalid proxy auth: header must be set")
+		}
+		return nil
+	}
+
+	p.Header = http.CanonicalHeaderKey(p.Header)
+	if p.Header == "Authorization" {
+		return errors.New("invalid proxy auth: header cannot be Authorization")
+	}
+
+	if len(p.TrustedProxies) == 0 {
+		return errors.New("invalid proxy auth: trustedProxies must be set")
+	}
+
+	p.trustedProxies = make([]netip.Prefix, 0, len(p.TrustedProxies))
+	for _, value := range p.TrustedProxies {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return fmt.Errorf("invalid proxy auth: %w", err)
+		}
+		p.trustedProxies = append(p.trustedProxies, prefix)
+	}
+
+	if p.Template != nil {
+		if err := p.Template.Validate(); err != nil {
+			return fmt.Errorf("invalid proxy auth: template: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// parsePrefix parses a CIDR range or a single address.
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// containsAddr reports whether the address, of the form returned by
+// [http.Request.RemoteAddr], is in one of the prefixes.
+func containsAddr(prefixes []netip.Prefix, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// username returns the username set by a trusted proxy, if any. The proxy
+// that sets the header is the one connecting, so it uses the address of the
+// connection, and not the client address taken from X-Forwarded-For.
+func (p *ProxyAuth) username(r *http.Request) (string, bool) {
+	username := strings.TrimSpace(r.Header.Get(p.Header))
+	if username == "" || !containsAddr(p.trustedProxies, r.RemoteAddr) {
+		return "", false
+	}
+
+	return username, true
+}
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainsAddr(t *testing.T) {
+	t.Parallel()
+
+	prefixes := []netip.Prefix{}
+	for _, value := range []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"} {
+		prefix, err := parsePrefix(value)
+		require.NoError(t, err)
+		prefixes = append(prefixes, prefix)
+	}
+
+	for addr, expected := range map[string]bool{
+		"10.1.2.3:1234":          true,
+		"192.168.1.1:80":         true,
+		"192.168.1.2:80":         false,
+		"[fd12::1]:443":          true,
+		"[::ffff:10.0.0.1]:8080": true,
+		"[2001:db8::1]:443":      false,
+		"127.0.0.1:80":           false,
+		"@":                      false,
+		"":                       false,
+	} {
+		require.Equal(t, expected, containsAddr(prefixes, addr), addr)
+	}
+
+	_, err := parsePrefix("10.0.0.0/33")
+	require.Error(t, err)
+}
+
+func TestServerAuthenticationProxy(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"foo.txt":      []byte("foo"),
+		"john/bar.txt": []byte("bar"),
+	})
+
+	do := func(t *testing.T, url, remoteUser, username, password string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		if remoteUser != "" {
+			req.Header.Set("X-Remote-User", remoteUser)
+		}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	t.Run("Trusted", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: R
+
+proxyAuth:
+  header: x-remote-user
+  trustedProxies:
+    - 127.0.0.1/8
+    - ::1
+  template:
+    permissions: none
+
+users:
+  - username: john
+    directory: %s/john
+`, dir, dir))
+		defer srv.Close()
+
+		require.Equal(t, http.StatusOK, do(t, srv.URL+"/bar.txt", "john", "", ""))
+		require.Equal(t, http.StatusForbidden, do(t, srv.URL+"/foo.txt", "alice", "", ""))
+		require.Equal(t, http.StatusUnauthorized, do(t, srv.URL+"/foo.txt", "", "", ""))
+		require.Equal(t, http.StatusUnauthorized, do(t, srv.URL+"/foo.txt", "", "john", ""))
+	})
+
+	t.Run("No Template", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+
+proxyAuth:
+  header: X-Remote-User
+  trustedProxies: 127.0.0.1, ::1
+
+users:
+  - username: john
+`, dir))
+		defer srv.Close()
+
+		require.Equal(t, http.StatusOK, do(t, srv.URL+"/foo.txt", "john", "", ""))
+		require.Equal(t, http.StatusUnauthorized, do(t, srv.URL+"/foo.txt", "alice", "", ""))
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		t.Parallel()
+
+		srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+
+proxyAuth:
+  header: X-Remote-User
+  trustedProxies:
+    - 10.0.0.0/8
+  template:
+    permissions: R
+
+users:
+  - username: john
+    password: john
+`, dir))
+		defer srv.Close()
+
+		require.Equal(t, http.StatusUnauthorized, do(t, srv.URL+"/foo.txt", "john", "", ""))
+		require.Equal(t, http.StatusUnauthorized, do(t, srv.URL+"/foo.txt", "alice", "", ""))
+		require.Equal(t, http.StatusOK, do(t, srv.URL+"/foo.txt", "alice", "john", "john"))
+	})
+}
+
+func TestConfigProxyAuth(t *testing.T) {
+	t.Parallel()
+
+	writeAndParseConfigWithError(t, `
+proxyAuth:
+  header: X-Remote-User
+`, ".yml", "trustedProxies must be set")
+
+	writeAndParseConfigWithError(t, `
+proxyAuth:
+  trustedProxies: 10.0.0.0/8
+`, ".yml", "header must be set")
+
+	writeAndParseConfigWithError(t, `
+proxyAuth:
+  header: authorization
+  trustedProxies: 10.0.0.0/8
+`, ".yml", "header cannot be Authorization")
+
+	writeAndParseConfigWithError(t, `
+proxyAuth:
+  header: X-Remote-User
+  trustedProxies: proxy.example.org
+`, ".yml", "invalid proxy auth")
+}
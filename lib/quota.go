@@ -0,0 +1,646 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// quotaUsageTTL is how long the usage of a directory is trusted before it is
+// counted again in the background, to account for changes made outside of the
+// server.
+const quotaUsageTTL = time.Minute
+
+var (
+	quotaUsedBytes      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+	quotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+)
+
+// ByteSize is a number of bytes. It can be written with a unit, such as
+// "500MB" or "1.5GiB".
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"B", 1},
+}
+
+func (s *ByteSize) UnmarshalText(data []byte) error {
+	text := strings.TrimSpace(string(data))
+	size := float64(1)
+
+	for _, unit := range byteSizeUnits {
+		if len(text) > len(unit.suffix) && strings.EqualFold(text[len(text)-len(unit.suffix):], unit.suffix) {
+			text = strings.TrimSpace(text[:len(text)-len(unit.suffix)])
+			size = unit.size
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || value < 0 || value*size >= math.MaxInt64 {
+		return fmt.Errorf("invalid size: %q", string(data))
+	}
+
+	*s = ByteSize(value * size)
+	return nil
+}
+
+type Quota struct {
+	// Bytes is the maximum total size of the files. Default is 0, which is
+	// unlimited.
+	Bytes ByteSize
+
+	// Files is the maximum number of files and directories. Default is 0,
+	// which is unlimited.
+	Files int64
+}
+
+func (q *Quota) Validate() error {
+	if q.Bytes < 0 || q.Files < 0 {
+		return errors.New("invalid quota: bytes and files cannot be negative")
+	}
+
+	return nil
+}
+
+func (q Quota) enabled() bool {
+	return q.Bytes > 0 || q.Files > 0
+}
+
+// quotaRoot is a directory whose contents count towards a quota.
+type quotaRoot struct {
+	key string
+	fs  webdav.FileSystem
+}
+
+// quotaRoot returns the directory whose usage counts towards the quota for
+// name, which is either the directory of the user, or the mount that name is
+// in. The virtual root of the mounts belongs to none.
+func (p UserPermissions) quotaRoot(name string) (quotaRoot, bool) {
+	if !p.useDirectories {
+		return quotaRoot{key: p.Directory, fs: webdav.Dir(p.Directory)}, true
+	}
+
+	mount, _, err := multiDir{mounts: p.Directories}.resolve(name)
+	if err != nil {
+		return quotaRoot{}, false
+	}
+
+	return quotaRoot{key: mount.location("/"), fs: mount.fileSystem(false)}, true
+}
+
+// quotaRoots returns all the directories whose usage counts towards the quota.
+func (p UserPermissions) quotaRoots() []quotaRoot {
+	if !p.useDirectories {
+		return []quotaRoot{{key: p.Directory, fs: webdav.Dir(p.Directory)}}
+	}
+
+	roots := make([]quotaRoot, 0, len(p.Directories))
+	for _, mount := range p.Directories {
+		roots = append(roots, quotaRoot{key: mount.location("/"), fs: mount.fileSystem(false)})
+	}
+	return roots
+}
+
+type quotaUsage struct {
+	bytes   int64
+	files   int64
+	counted time.Time
+}
+
+// quotaTracker keeps the usage of the directories of users with quotas. The
+// usage is shared by all users with the same directory.
+type quotaTracker struct {
+	mu       sync.Mutex
+	usage    map[string]quotaUsage
+	counting map[string]*quotaCount
+	now      func() time.Time
+}
+
+// quotaCount is a count of the usage of a directory that is in progress.
+type quotaCount struct {
+	done chan struct{}
+	err  error
+
+	// invalidated is set if the usage changed during the count, which makes
+	// its result unreliable.
+	invalidated bool
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		usage:    map[string]quotaUsage{},
+		counting: map[string]*quotaCount{},
+		now:      time.Now,
+	}
+}
+
+// get returns the usage of root. Usage that is too old is still returned,
+// while it is counted again in the background, so that requests do not wait
+// for large trees to be walked. Only unknown usage is waited for, which
+// [quotaTracker.prefetch] avoids.
+func (t *quotaTracker) get(ctx context.Context, root quotaRoot) (quotaUsage, error) {
+	for {
+		now := t.now()
+
+		t.mu.Lock()
+		usage, ok := t.usage[root.key]
+		if ok {
+			if now.Sub(usage.counted) >= quotaUsageTTL {
+				t.start(ctx, root, now)
+			}
+			t.mu.Unlock()
+			return usage, nil
+		}
+		count := t.start(ctx, root, now)
+		t.mu.Unlock()
+
+		select {
+		case <-count.done:
+		case <-ctx.Done():
+			return quotaUsage{}, ctx.Err()
+		}
+
+		if count.err != nil {
+			return quotaUsage{}, count.err
+		}
+
+		// The usage is known now, unless it was invalidated in the meantime,
+		// in which case it is counted again.
+	}
+}
+
+// prefetch starts counting the usage of the roots that is not known yet, so
+// that the first requests do not have to wait for it.
+func (t *quotaTracker) prefetch(roots []quotaRoot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, root := range roots {
+		if _, ok := t.usage[root.key]; !ok {
+			t.start(context.Background(), root, t.now())
+		}
+	}
+}
+
+// start counts the usage of root in the background, unless it is already
+// being counted, and returns the count. It must be called with the lock held.
+func (t *quotaTracker) start(ctx context.Context, root quotaRoot, now time.Time) *quotaCount {
+	if count, ok := t.counting[root.key]; ok {
+		return count
+	}
+
+	count := &quotaCount{done: make(chan struct{})}
+	t.counting[root.key] = count
+
+	go func() {
+		usage, err := t.count(context.WithoutCancel(ctx), root, now)
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.counting[root.key] == count {
+			delete(t.counting, root.key)
+		}
+		if err == nil && !count.invalidated {
+			t.usage[root.key] = usage
+		}
+		count.err = err
+		close(count.done)
+	}()
+
+	return count
+}
+
+// count walks root to find its usage at the given time.
+func (t *quotaTracker) count(ctx context.Context, root quotaRoot, now time.Time) (quotaUsage, error) {
+	info, err := root.fs.Stat(ctx, "/")
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	bytes, files, err := countTree(ctx, root.fs, "/", info)
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	// The root itself does not count.
+	return quotaUsage{bytes: bytes, files: files - 1, counted: now}, nil
+}
+
+// tracked returns whether the usage of root is known.
+func (t *quotaTracker) tracked(root quotaRoot) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.usage[root.key]
+	return ok
+}
+
+// adjust records a change in the usage of root, if it is known. The result of
+// a count in progress is dropped, as it may be from before the change.
+func (t *quotaTracker) adjust(root quotaRoot, bytes, files int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if usage, ok := t.usage[root.key]; ok {
+		usage.bytes = max(usage.bytes+bytes, 0)
+		usage.files = max(usage.files+files, 0)
+		t.usage[root.key] = usage
+		t.drop(root)
+	}
+}
+
+// invalidate forgets the usage of root, so that it is counted again. The
+// result of a count in progress is dropped too.
+func (t *quotaTracker) invalidate(root quotaRoot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.usage, root.key)
+	t.drop(root)
+}
+
+// drop makes the count of root in progress, if any, drop its result. It must
+// be called with the lock held.
+func (t *quotaTracker) drop(root quotaRoot) {
+	if count, ok := t.counting[root.key]; ok {
+		count.invalidated = true
+		delete(t.counting, root.key)
+	}
+}
+
+// countTree returns the total size of the files in the tree at name, and the
+// number of files and directories in it, including itself.
+func countTree(ctx context.Context, fs webdav.FileSystem, name string, info os.FileInfo) (bytes int64, files int64, err error) {
+	err = walkTree(ctx, fs, name, info, func(_ string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			bytes += info.Size()
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return bytes, files, nil
+}
+
+// quotaRemaining returns how many bytes and files can still be added to the
+// directory that name is in before the quota of the user is reached. It is
+// [math.MaxInt64] for what is not limited.
+func (u *handlerUser) quotaRemaining(ctx context.Context, name string) (bytes int64, files int64, err error) {
+	bytes, files = math.MaxInt64, math.MaxInt64
+	if !u.Quota.enabled() || u.quotas == nil {
+		return bytes, files, nil
+	}
+
+	root, ok := u.quotaRoot(name)
+	if !ok {
+		return bytes, files, nil
+	}
+
+	usage, err := u.quotas.get(ctx, root)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if u.Quota.Bytes > 0 {
+		bytes = max(int64(u.Quota.Bytes)-usage.bytes, 0)
+	}
+
+	if u.Quota.Files > 0 {
+		files = max(u.Quota.Files-usage.files, 0)
+	}
+
+	return bytes, files, nil
+}
+
+// checkQuota returns whether a PUT, MKCOL, COPY or MOVE request fits within
+// the quota of the user. Bodies of unknown length are limited to what fits
+// instead, and the returned writer reports if they go beyond it. Partial
+// updates are checked by [handlerUser.handlePartialUpdate].
+func (u *handlerUser) checkQuota(w http.ResponseWriter, r *http.Request, req *request) (http.ResponseWriter, bool, error) {
+	if !u.Quota.enabled() || u.quotas == nil {
+		return w, true, nil
+	}
+
+	ctx := r.Context()
+
+	switch r.Method {
+	case "MKCOL":
+		_, files, err := u.quotaRemaining(ctx, req.path)
+		return w, files >= 1, err
+
+	case "PUT":
+		if r.Header.Get("Content-Range") != "" {
+			return w, true, nil
+		}
+
+		bytes, files, err := u.quotaRemaining(ctx, req.path)
+		if err != nil {
+			return w, false, err
+		}
+
+		current := int64(0)
+		info, err := u.FileSystem.Stat(ctx, req.path)
+		if err == nil && !info.IsDir() {
+			current = info.Size()
+		} else if files < 1 {
+			return w, false, nil
+		}
+
+		if size := expectedBodySize(r); size >= 0 {
+			return w, size-current <= bytes, nil
+		}
+
+		if bytes == math.MaxInt64 {
+			return w, true, nil
+		}
+
+		return limitBody(w, r, bytes+current, errQuotaExceeded), true, nil
+
+	case "COPY", "MOVE":
+		source, sourceOK := u.quotaRoot(req.path)
+		destination, destinationOK := u.quotaRoot(req.destination)
+		if r.Method == "MOVE" && sourceOK && destinationOK && source.key == destination.key {
+			return w, true, nil
+		}
+
+		bytes, files, err := u.quotaRemaining(ctx, req.destination)
+		if err != nil {
+			return w, false, err
+		}
+
+		info, err := u.FileSystem.Stat(ctx, req.path)
+		if err != nil {
+			// Let the request fail as it would without a quota.
+			return w, true, nil
+		}
+
+		var addedBytes, addedFiles int64
+		if info.IsDir() && r.Method == "COPY" && r.Header.Get("Depth") == "0" {
+			addedFiles = 1
+		} else if addedBytes, addedFiles, err = countTree(ctx, u.FileSystem, req.path, info); err != nil {
+			return w, false, err
+		}
+
+		// What is overwritten at the destination makes room for the copy.
+		if r.Header.Get("Overwrite") != "F" {
+			if info, err := u.FileSystem.Stat(ctx, req.destination); err == nil {
+				removedBytes, removedFiles, err := countTree(ctx, u.FileSystem, req.destination, info)
+				if err != nil {
+					return w, false, err
+				}
+				addedBytes -= removedBytes
+				addedFiles -= removedFiles
+			}
+		}
+
+		return w, addedBytes <= bytes && addedFiles <= files, nil
+	}
+
+	return w, true, nil
+}
+
+// checkPartialUpdateQuota returns whether writing length bytes at offset of
+// a file with the given size fits within the quota of the user. A negative
+// length is unknown, and limits the body of r to what fits instead.
+func (u *handlerUser) checkPartialUpdateQuota(r *http.Request, name string, exists bool, size, offset, length int64) (bool, error) {
+	if !u.Quota.enabled() || u.quotas == nil {
+		return true, nil
+	}
+
+	bytes, files, err := u.quotaRemaining(r.Context(), name)
+	if err != nil {
+		return false, err
+	}
+
+	if !exists && files < 1 {
+		return false, nil
+	}
+
+	if length >= 0 {
+		return offset+length-size <= bytes, nil
+	}
+
+	if bytes != math.MaxInt64 {
+		r.Body = &limitedBody{ReadCloser: r.Body, remaining: bytes + max(size-offset, 0), err: errQuotaExceeded}
+	}
+
+	return true, nil
+}
+
+// trackQuota keeps the usage of the directories affected by a request up to
+// date. It returns a function to call once the request is done, if any.
+func (u *handlerUser) trackQuota(ctx context.Context, req *request) func() {
+	if u.quotas == nil {
+		return nil
+	}
+
+	root, ok := u.quotaRoot(req.path)
+	if !ok {
+		return nil
+	}
+
+	switch req.method {
+	case "PUT", "PATCH", "MKCOL":
+		if !u.quotas.tracked(root) {
+			return nil
+		}
+
+		// The change is measured on the file system, so that failed and
+		// partial writes are accounted for as well.
+		stat := func() (bytes int64, files int64) {
+			info, err := u.FileSystem.Stat(ctx, req.path)
+			if err != nil {
+				return 0, 0
+			}
+			if info.Mode().IsRegular() {
+				bytes = info.Size()
+			}
+			return bytes, 1
+		}
+
+		beforeBytes, beforeFiles := stat()
+		return func() {
+			afterBytes, afterFiles := stat()
+			u.quotas.adjust(root, afterBytes-beforeBytes, afterFiles-beforeFiles)
+		}
+
+	case "DELETE", "COPY", "MOVE":
+		return func() {
+			u.quotas.invalidate(root)
+			if destination, ok := u.quotaRoot(req.destination); ok && req.destination != "" {
+				u.quotas.invalidate(destination)
+			}
+		}
+	}
+
+	return nil
+}
+
+type quotaPropsKey struct{}
+
+// quotaPropfindMaxSize is how much of the body of a PROPFIND request is read
+// to find whether it asks for the quota properties.
+const quotaPropfindMaxSize = 64 << 10
+
+// withRequestedQuotaProps returns r with a context that holds the quota
+// properties that its PROPFIND body asks for by name, which are the only ones
+// that [quotaFileSystem] reports. RFC 4331 does not allow returning them for
+// allprop requests.
+func withRequestedQuotaProps(r *http.Request) *http.Request {
+	data, err := io.ReadAll(io.LimitReader(r.Body, quotaPropfindMaxSize))
+	if err != nil {
+		return r
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+
+	requested := map[xml.Name]bool{}
+	var parents []xml.Name
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			// The properties are named in <prop>, or in the <include> of
+			// allprop requests.
+			if (token.Name == quotaUsedBytes || token.Name == quotaAvailableBytes) && len(parents) == 2 &&
+				parents[1].Space == "DAV:" && (parents[1].Local == "prop" || parents[1].Local == "include") {
+				requested[token.Name] = true
+			}
+			parents = append(parents, token.Name)
+		case xml.EndElement:
+			parents = parents[:len(parents)-1]
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), quotaPropsKey{}, requested))
+}
+
+// quotaFileSystem is a [webdav.FileSystem] that reports the quota of the user
+// on collections, with the quota-available-bytes and quota-used-bytes
+// properties from RFC 4331, when a request from [withRequestedQuotaProps]
+// asks for them.
+type quotaFileSystem struct {
+	webdav.FileSystem
+	permissions UserPermissions
+	quotas      *quotaTracker
+}
+
+func (q quotaFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	file, err := q.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	requested, _ := ctx.Value(quotaPropsKey{}).(map[xml.Name]bool)
+	if len(requested) == 0 {
+		return file, nil
+	}
+
+	root, ok := q.permissions.quotaRoot(name)
+	if !ok {
+		return file, nil
+	}
+
+	if info, err := file.Stat(); err != nil || !info.IsDir() {
+		return file, nil
+	}
+
+	return quotaFile{File: file, ctx: ctx, fs: q, root: root, requested: requested}, nil
+}
+
+type quotaFile struct {
+	webdav.File
+	ctx       context.Context
+	fs        quotaFileSystem
+	root      quotaRoot
+	requested map[xml.Name]bool
+}
+
+// DeadProps returns the requested quota properties. They are live properties,
+// but the webdav package only allows adding properties as dead ones, which is
+// why they are only added when requested by name.
+func (f quotaFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := map[xml.Name]webdav.Property{}
+	if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		deadProps, err := holder.DeadProps()
+		if err != nil {
+			return nil, err
+		}
+		for name, prop := range deadProps {
+			props[name] = prop
+		}
+	}
+
+	usage, err := f.fs.quotas.get(f.ctx, f.root)
+	if err != nil {
+		// The properties are left out, rather than failing the listing.
+		return props, nil
+	}
+
+	if f.requested[quotaUsedBytes] {
+		props[quotaUsedBytes] = webdav.Property{
+			XMLName:  quotaUsedBytes,
+			InnerXML: []byte(strconv.FormatInt(usage.bytes, 10)),
+		}
+	}
+
+	if quota := int64(f.fs.permissions.Quota.Bytes); quota > 0 && f.requested[quotaAvailableBytes] {
+		props[quotaAvailableBytes] = webdav.Property{
+			XMLName:  quotaAvailableBytes,
+			InnerXML: []byte(strconv.FormatInt(max(quota-usage.bytes, 0), 10)),
+		}
+	}
+
+	return props, nil
+}
+
+func (f quotaFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return holder.Patch(patches)
+	}
+
+	// Same as the webdav package does for files without dead properties.
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
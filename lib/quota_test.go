@@ -0,0 +1,290 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
+)
+
+func TestByteSizeUnmarshalText(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		input    string
+		expected ByteSize
+		error    bool
+	}{
+		{"1024", 1024, false},
+		{"10B", 10, false},
+		{"1KB", 1000, false},
+		{"1kib", 1024, false},
+		{"1.5 GiB", 3 << 29, false},
+		{"2TB", 2e12, false},
+		{"", 0, true},
+		{"GB", 0, true},
+		{"-1MB", 0, true},
+		{"10PB", 0, true},
+		{"99999999TB", 0, true},
+	}
+
+	for _, tc := range testCases {
+		var size ByteSize
+		err := size.UnmarshalText([]byte(tc.input))
+		if tc.error {
+			require.Error(t, err, tc.input)
+		} else {
+			require.NoError(t, err, tc.input)
+			require.Equal(t, tc.expected, size, tc.input)
+		}
+	}
+
+	cfg := writeAndParseConfig(t, `
+quota:
+  bytes: 10MiB
+users:
+  - username: john
+    password: john
+  - username: jane
+    password: jane
+    quota:
+      bytes: 1024
+      files: 10
+`, ".yml")
+	require.Equal(t, Quota{Bytes: 10 << 20}, cfg.Quota)
+	require.Equal(t, Quota{Bytes: 10 << 20}, cfg.Users[0].Quota)
+	require.Equal(t, Quota{Bytes: 1024, Files: 10}, cfg.Users[1].Quota)
+}
+
+func TestConfigQuotaErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		config string
+		error  string
+	}{{
+		name: "negative files",
+		config: `
+quota:
+  files: -1
+`,
+		error: "cannot be negative",
+	}, {
+		name: "negative bytes",
+		config: `
+quota:
+  bytes: -1MB
+`,
+		error: "invalid size",
+	}, {
+		name: "negative user files",
+		config: `
+users:
+  - username: john
+    password: john
+    quota:
+      files: -1
+`,
+		error: "cannot be negative",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			writeAndParseConfigWithError(t, tc.config, ".yml", tc.error)
+		})
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"a.txt":     []byte("0123456789"),
+		"sub/b.txt": []byte("0123456789"),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+quota:
+  bytes: 40
+  files: 6
+`, dir))
+	defer srv.Close()
+
+	// 20 of 40 bytes, and 3 of 6 files and directories are used.
+	require.Equal(t, http.StatusInsufficientStorage, doTestRequest(t, srv, "PUT", "/c.txt", strings.NewReader(strings.Repeat("x", 21)), nil))
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/c.txt", strings.NewReader(strings.Repeat("x", 15)), nil))
+
+	// Overwriting a file only counts the difference in size.
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/c.txt", strings.NewReader(strings.Repeat("x", 20)), nil))
+	require.Equal(t, http.StatusInsufficientStorage, doTestRequest(t, srv, "PUT", "/c.txt", strings.NewReader(strings.Repeat("x", 21)), nil))
+
+	// 40 of 40 bytes are used. Shrinking a file is always allowed.
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/c.txt", strings.NewReader("x"), nil))
+
+	// Partial updates only count the growth of the file.
+	patch := map[string]string{"Content-Type": partialUpdateContentType, "X-Update-Range": "append"}
+	require.Equal(t, http.StatusInsufficientStorage, doTestRequest(t, srv, "PATCH", "/c.txt", strings.NewReader(strings.Repeat("x", 20)), patch))
+	require.Equal(t, http.StatusNoContent, doTestRequest(t, srv, "PATCH", "/c.txt", strings.NewReader(strings.Repeat("x", 19)), patch))
+	require.Equal(t, http.StatusNoContent, doTestRequest(t, srv, "PUT", "/c.txt", strings.NewReader("0123456789"), map[string]string{"Content-Range": "bytes 0-9/*"}))
+
+	// Bodies of unknown length are cut at the quota, and leave nothing behind.
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/c.txt", strings.NewReader("x"), nil))
+	require.Equal(t, http.StatusInsufficientStorage, doTestRequest(t, srv, "PUT", "/d.txt", io.MultiReader(strings.NewReader(strings.Repeat("x", 25))), nil))
+
+	client := gowebdav.NewClient(srv.URL, "", "")
+	_, err := client.Stat("/d.txt")
+	require.ErrorContains(t, err, "404")
+
+	// So are partial updates of unknown length.
+	chunked := func(n int) io.Reader { return io.MultiReader(strings.NewReader(strings.Repeat("x", n))) }
+	require.Equal(t, http.StatusInsufficientStorage, doTestRequest(t, srv, "PUT", "/c.txt", chunked(25), map[string]string{"Content-Range": "bytes 1-/*"}))
+	require.Equal(t, http.StatusInsufficientStorage, doTestRequest(t, srv, "PUT", "/d.txt", chunked(25), map[string]string{"Content-Range": "bytes 0-/*"}))
+
+	info, err := client.Stat("/c.txt")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, info.Size())
+	_, err = client.Stat("/d.txt")
+	require.ErrorContains(t, err, "404")
+
+	// Copies count the whole tree, and what they overwrite makes room for them.
+	require.NoError(t, client.Write("/d.txt", []byte("0123456789"), 0666))
+	require.ErrorContains(t, client.Copy("/sub", "/sub2", false), "507")
+	require.NoError(t, client.Copy("/sub/b.txt", "/a.txt", true))
+	require.NoError(t, client.Remove("/d.txt"))
+
+	// 4 of 6 files and directories are used.
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "MKCOL", "/e", nil, nil))
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "MKCOL", "/f", nil, nil))
+	require.Equal(t, http.StatusInsufficientStorage, doTestRequest(t, srv, "MKCOL", "/g", nil, nil))
+	require.Equal(t, http.StatusInsufficientStorage, doTestRequest(t, srv, "PUT", "/g.txt", strings.NewReader(""), nil))
+
+	// Deleting frees space.
+	require.Equal(t, http.StatusNoContent, doTestRequest(t, srv, "DELETE", "/sub", nil, nil))
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "MKCOL", "/g", nil, nil))
+
+	propfind := func(props string) string {
+		req, err := http.NewRequest("PROPFIND", srv.URL+"/", strings.NewReader(`<?xml version="1.0"?>
+<propfind xmlns="DAV:">`+props+`</propfind>`))
+		require.NoError(t, err)
+		req.Header.Set("Depth", "0")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+		return string(body)
+	}
+
+	// The quota is reported on collections, following RFC 4331, only when the
+	// properties are asked for by name.
+	body := propfind(`<prop><quota-available-bytes/><quota-used-bytes/></prop>`)
+	require.Contains(t, body, `<D:quota-used-bytes>11</D:quota-used-bytes>`)
+	require.Contains(t, body, `<D:quota-available-bytes>29</D:quota-available-bytes>`)
+
+	body = propfind(`<prop><quota-used-bytes/></prop>`)
+	require.Contains(t, body, `<D:quota-used-bytes>11</D:quota-used-bytes>`)
+	require.NotContains(t, body, `quota-available-bytes`)
+
+	require.NotContains(t, propfind(`<allprop/>`), `quota-`)
+	require.NotContains(t, propfind(`<propname/>`), `quota-`)
+	require.Contains(t, propfind(`<allprop/><include><quota-used-bytes/></include>`), `<D:quota-used-bytes>11</D:quota-used-bytes>`)
+}
+
+func TestQuotaTracker(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"a.txt": []byte("0123456789")})
+	root := quotaRoot{key: dir, fs: webdav.Dir(dir)}
+
+	now := time.Now()
+	tracker := newQuotaTracker()
+	tracker.now = func() time.Time { return now }
+
+	usage, err := tracker.get(context.Background(), root)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, usage.bytes)
+	require.EqualValues(t, 1, usage.files)
+
+	// Changes made outside of the server are found once the usage is too
+	// old, which is counted again in the background while the old usage is
+	// still returned.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("01234"), 0666))
+	usage, err = tracker.get(context.Background(), root)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, usage.bytes)
+
+	now = now.Add(quotaUsageTTL)
+	usage, err = tracker.get(context.Background(), root)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, usage.bytes)
+
+	require.Eventually(t, func() bool {
+		usage, err := tracker.get(context.Background(), root)
+		return err == nil && usage.bytes == 15 && usage.files == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Changes made during a count make it drop its result.
+	now = now.Add(quotaUsageTTL)
+	tracker.mu.Lock()
+	count := tracker.start(context.Background(), root, now)
+	tracker.mu.Unlock()
+	tracker.adjust(root, 5, 1)
+	<-count.done
+
+	usage, err = tracker.get(context.Background(), root)
+	require.NoError(t, err)
+	require.EqualValues(t, 20, usage.bytes)
+	require.EqualValues(t, 3, usage.files)
+
+	// The usage can be counted before it is needed.
+	other := makeTestDirectory(t, map[string][]byte{"a.txt": []byte("0123456789")})
+	otherRoot := quotaRoot{key: other, fs: webdav.Dir(other)}
+	tracker.prefetch([]quotaRoot{root, otherRoot})
+	require.Eventually(t, func() bool { return tracker.tracked(otherRoot) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerQuotaDirectories(t *testing.T) {
+	t.Parallel()
+
+	media := makeTestDirectory(t, map[string][]byte{"a.txt": []byte("0123456789")})
+	archive := makeTestDirectory(t, map[string][]byte{})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directories:
+  - name: media
+    path: %s
+  - name: archive
+    path: %s
+permissions: CRUD
+quota:
+  bytes: 15
+`, media, archive))
+	defer srv.Close()
+
+	client := gowebdav.NewClient(srv.URL, "", "")
+
+	// The usage of each mount is counted on its own.
+	require.ErrorContains(t, client.Write("/media/b.txt", []byte("0123456789"), 0666), "507")
+	require.NoError(t, client.Write("/archive/b.txt", []byte("0123456789"), 0666))
+
+	// Moving within a mount does not change the usage, but moving to another
+	// does.
+	require.NoError(t, client.Rename("/media/a.txt", "/media/c.txt", false))
+	require.ErrorContains(t, client.Rename("/media/c.txt", "/archive/c.txt", false), "507")
+}
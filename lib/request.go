@@ -3,9 +3,11 @@ package lib
 import (
 	"errors"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"path"
 	"strings"
+	"time"
 )
 
 // cleanPath resolves dot segments so that the permission checks see the same
@@ -41,6 +43,10 @@ type request struct {
 	method      string
 	path        string
 	destination string
+
+	// remoteAddr and time are checked against the conditions of rules.
+	remoteAddr netip.Addr
+	time       time.Time
 }
 
 func newRequest(r *http.Request, prefix string) (*request, error) {
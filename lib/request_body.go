@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// sniffLength is the number of bytes used to detect the type of contents, as
+// in [http.DetectContentType].
+const sniffLength = 512
+
+// bodyLimitError is the error of a request body that goes beyond a limit,
+// and the status to reply with.
+type bodyLimitError struct {
+	status  int
+	message string
+}
+
+func (e *bodyLimitError) Error() string {
+	return e.message
+}
+
+var (
+	errQuotaExceeded = &bodyLimitError{status: http.StatusInsufficientStorage, message: "quota exceeded"}
+	errFileTooLarge  = &bodyLimitError{status: http.StatusRequestEntityTooLarge, message: "file too large"}
+)
+
+// expectedBodySize returns the size of the body of r, or -1 if it is unknown.
+func expectedBodySize(r *http.Request) int64 {
+	if r.ContentLength >= 0 {
+		return r.ContentLength
+	}
+
+	// Some clients, such as macOS Finder, announce the size of uploads
+	// without a Content-Length.
+	size, err := strconv.ParseInt(r.Header.Get("X-Expected-Entity-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// limitBody limits the body of r to the given number of bytes, after which it
+// fails with err. It returns a writer that replies with the status of err if
+// that happens, instead of the reply of the handler that read the body.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64, err *bodyLimitError) http.ResponseWriter {
+	body := &limitedBody{ReadCloser: r.Body, remaining: limit, err: err}
+	r.Body = body
+	return &limitedResponseWriter{ResponseWriter: w, body: body}
+}
+
+// limitedBody is a request body that fails with err once it goes beyond the
+// remaining number of bytes. It is failed if it did that, or could not be read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       *bodyLimitError
+	exceeded  bool
+	failed    bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.exceeded, b.failed = true, true
+		n = int(b.remaining)
+		b.remaining = 0
+		return n, b.err
+	}
+
+	if err != nil && err != io.EOF {
+		b.failed = true
+	}
+
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// limitedResponseWriter replaces the error response of a request whose body
+// went beyond its limit.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	body    *limitedBody
+	replied bool
+}
+
+func (w *limitedResponseWriter) WriteHeader(status int) {
+	if !w.body.exceeded {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.replied = true
+	http.Error(w.ResponseWriter, w.body.err.Error(), w.body.err.status)
+}
+
+func (w *limitedResponseWriter) Write(data []byte) (int, error) {
+	if w.replied {
+		return len(data), nil
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+// sniffBody detects the type of the contents of the body of r from its first
+// bytes, which are kept for whoever reads the body next. It returns an empty
+// string for an empty body.
+func sniffBody(r *http.Request) (string, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r.Body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+	if n == 0 {
+		return "", nil
+	}
+	return http.DetectContentType(head), nil
+}
@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule limits a rule to certain days of the week and times of the day.
+type Schedule struct {
+	// Timezone is the IANA name of the timezone of the days and times, such as
+	// "Europe/Lisbon". Default is the timezone of the server.
+	Timezone string
+
+	// Days are days of the week, such as "mon", or ranges of them, such as
+	// "mon-fri". Default is every day.
+	Days []string
+
+	// Times are ranges of the time of the day, such as "09:00-17:00". A range
+	// that ends before it starts goes past midnight. Default is all day.
+	Times []string
+
+	location *time.Location
+	days     [7]bool
+	times    [][2]int
+}
+
+func (s *Schedule) Validate() error {
+	s.location = time.Local
+	if s.Timezone != "" {
+		var err error
+		s.location, err = time.LoadLocation(s.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+	}
+
+	s.days = [7]bool{}
+	if len(s.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	for _, value := range s.Days {
+		start, end, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(value)), "-")
+		if !isRange {
+			end = start
+		}
+
+		first, ok1 := weekdays[strings.TrimSpace(start)]
+		last, ok2 := weekdays[strings.TrimSpace(end)]
+		if !ok1 || !ok2 {
+			return fmt.Errorf("invalid schedule: invalid days %q", value)
+		}
+
+		for day := first; ; day = (day + 1) % 7 {
+			s.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	s.times = nil
+	for _, value := range s.Times {
+		start, end, ok := strings.Cut(value, "-")
+		if !ok {
+			return fmt.Errorf("invalid schedule: invalid times %q", value)
+		}
+
+		startMinute, err := parseTimeOfDay(start)
+		if err != nil {
+			return fmt.Errorf("invalid schedule: invalid times %q: %w", value, err)
+		}
+
+		endMinute, err := parseTimeOfDay(end)
+		if err != nil {
+			return fmt.Errorf("invalid schedule: invalid times %q: %w", value, err)
+		}
+
+		s.times = append(s.times, [2]int{startMinute, endMinute})
+	}
+
+	return nil
+}
+
+// parseTimeOfDay parses a time of the day, such as "09:30", into minutes
+// since midnight. "24:00" is the end of the day.
+func parseTimeOfDay(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.New("times must be of the form hh:mm")
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains returns whether the schedule includes the given time. Days are
+// checked against the day of t, even for times that go past midnight.
+func (s *Schedule) contains(t time.Time) bool {
+	t = t.In(s.location)
+	if !s.days[t.Weekday()] {
+		return false
+	}
+
+	if len(s.times) == 0 {
+		return true
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range s.times {
+		if r[0] <= r[1] {
+			if minute >= r[0] && minute < r[1] {
+				return true
+			}
+		} else if minute >= r[0] || minute < r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateConditions validates the conditions of the rule.
+func (r *Rule) validateConditions() error {
+	r.sourcePrefixes = make([]netip.Prefix, 0, len(r.SourceCIDRs))
+	for _, value := range r.SourceCIDRs {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return fmt.Errorf("invalid rule: invalid source %q: %w", value, err)
+		}
+		r.sourcePrefixes = append(r.sourcePrefixes, prefix)
+	}
+
+	if r.Schedule != nil {
+		if err := r.Schedule.Validate(); err != nil {
+			return fmt.Errorf("invalid rule: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// conditionsMet returns whether the request meets the conditions of the rule,
+// if any. Rules whose conditions are not met are skipped.
+func (r *Rule) conditionsMet(req *request) bool {
+	if len(r.SourceCIDRs) > 0 {
+		if !req.remoteAddr.IsValid() {
+			return false
+		}
+
+		addr := req.remoteAddr.Unmap()
+		found := false
+		for _, prefix := range r.sourcePrefixes {
+			if prefix.Contains(addr) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if r.Schedule != nil && !r.Schedule.contains(req.time) {
+		return false
+	}
+
+	return true
+}
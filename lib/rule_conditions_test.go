@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleContains(t *testing.T) {
+	t.Parallel()
+
+	lisbon, err := time.LoadLocation("Europe/Lisbon")
+	require.NoError(t, err)
+
+	// 2026-06-01 is a Monday.
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2026, 6, 1, hour, minute, 0, 0, lisbon)
+	}
+
+	testCases := []struct {
+		name     string
+		schedule Schedule
+		time     time.Time
+		expected bool
+	}{
+		{"empty", Schedule{}, monday(3, 0), true},
+		{"day", Schedule{Days: []string{"mon"}}, monday(3, 0), true},
+		{"other day", Schedule{Days: []string{"tue", "sat-sun"}}, monday(3, 0), false},
+		{"day range", Schedule{Days: []string{"Mon-Fri"}}, monday(3, 0), true},
+		{"day range past sunday", Schedule{Days: []string{"fri-mon"}}, monday(3, 0), true},
+		{"within times", Schedule{Timezone: "Europe/Lisbon", Times: []string{"09:00-17:00"}}, monday(9, 0), true},
+		{"end of times", Schedule{Timezone: "Europe/Lisbon", Times: []string{"09:00-17:00"}}, monday(17, 0), false},
+		{"second range", Schedule{Timezone: "Europe/Lisbon", Times: []string{"09:00-12:00", "13:00-17:00"}}, monday(14, 30), true},
+		{"between ranges", Schedule{Timezone: "Europe/Lisbon", Times: []string{"09:00-12:00", "13:00-17:00"}}, monday(12, 30), false},
+		{"past midnight", Schedule{Timezone: "Europe/Lisbon", Times: []string{"22:00-06:00"}}, monday(3, 0), true},
+		{"outside past midnight", Schedule{Timezone: "Europe/Lisbon", Times: []string{"22:00-06:00"}}, monday(12, 0), false},
+		{"until end of day", Schedule{Timezone: "Europe/Lisbon", Times: []string{"18:00-24:00"}}, monday(23, 59), true},
+		// 09:30 in Lisbon is 17:30 in Tokyo, and the days are of the timezone
+		// of the schedule too.
+		{"timezone", Schedule{Timezone: "Asia/Tokyo", Days: []string{"mon"}, Times: []string{"17:00-18:00"}}, monday(9, 30), true},
+		{"timezone day", Schedule{Timezone: "Asia/Tokyo", Days: []string{"mon"}}, monday(20, 0), false},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, tc.schedule.Validate(), tc.name)
+		require.Equal(t, tc.expected, tc.schedule.contains(tc.time), tc.name)
+	}
+
+	// Without a timezone, the days and times are of the timezone of the server.
+	local := Schedule{Days: []string{"mon"}, Times: []string{"09:00-17:00"}}
+	require.NoError(t, local.Validate())
+	require.Same(t, time.Local, local.location)
+	require.True(t, local.contains(time.Date(2026, 6, 1, 9, 0, 0, 0, time.Local)))
+	require.False(t, local.contains(time.Date(2026, 6, 1, 17, 0, 0, 0, time.Local)))
+
+	for _, schedule := range []Schedule{
+		{Timezone: "Mars/Olympus"},
+		{Days: []string{"monday"}},
+		{Days: []string{"mon-"}},
+		{Times: []string{"09:00"}},
+		{Times: []string{"9-17"}},
+		{Times: []string{"09:00-25:00"}},
+	} {
+		require.ErrorContains(t, schedule.Validate(), "invalid schedule", schedule)
+	}
+}
+
+func TestRuleConditionsMet(t *testing.T) {
+	t.Parallel()
+
+	rule := Rule{Path: "/", SourceCIDRs: []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"}}
+	require.NoError(t, rule.Validate())
+
+	for addr, expected := range map[string]bool{
+		"10.1.2.3":            true,
+		"::ffff:10.1.2.3":     true,
+		"192.168.1.10":        true,
+		"192.168.1.11":        false,
+		"fd00::1":             true,
+		"2001:db8::1":         false,
+		"":                    false,
+		"::ffff:192.168.1.11": false,
+	} {
+		remoteAddr, _ := netip.ParseAddr(addr)
+		require.Equal(t, expected, rule.conditionsMet(&request{remoteAddr: remoteAddr}), addr)
+	}
+
+	writeAndParseConfigWithError(t, `
+rules:
+  - path: /finance/
+    sourceCIDRs: [10.0.0.0/33]
+`, ".yml", "invalid source")
+
+	writeAndParseConfigWithError(t, `
+rules:
+  - path: /finance/
+    schedule:
+      days: [someday]
+`, ".yml", "invalid days")
+}
+
+func TestServerRulesConditions(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"finance/report.txt":       []byte("report"),
+		"finance/payroll/june.txt": []byte("june"),
+		"finance/ledger/2025.txt":  []byte("2025"),
+		"uploads/.keep":            []byte(""),
+		"dropbox/.keep":            []byte(""),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+behindProxy: true
+trustedProxies:
+  - 127.0.0.1
+  - 172.16.0.0/12
+permissions: R
+rules:
+  - path: /finance/
+    permissions: CRUD
+    sourceCIDRs:
+      - 10.0.0.0/8
+  - path: /finance/payroll/
+    permissions: none
+    sourceCIDRs:
+      - 192.0.2.0/24
+  - path: /finance/ledger/
+    permissions: CRU
+    sourceCIDRs:
+      - 192.0.2.0/24
+  - path: /uploads/
+    permissions: CR
+    schedule:
+      timezone: UTC
+      times: ["00:00-24:00"]
+  - path: /uploads/closed/
+    permissions: none
+    schedule:
+      timezone: UTC
+      times: ["12:00-12:00"]
+  - path: /dropbox/
+    permissions: CR
+    schedule:
+      timezone: UTC
+      times: ["12:00-12:00"]
+`, dir))
+	defer srv.Close()
+
+	do := func(method, path, forwardedFor string) int {
+		var body io.Reader
+		if method == "PUT" {
+			body = strings.NewReader("data")
+		}
+
+		req, err := http.NewRequest(method, srv.URL+path, body)
+		require.NoError(t, err)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	// Writes to /finance are only allowed from the office network. Elsewhere,
+	// the rule is skipped and the global permissions apply.
+	require.Equal(t, http.StatusCreated, do("PUT", "/finance/new.txt", "10.1.2.3, 172.16.0.1"))
+	require.Equal(t, http.StatusForbidden, do("PUT", "/finance/other.txt", "172.16.0.1"))
+	require.Equal(t, http.StatusForbidden, do("PUT", "/finance/other.txt", ""))
+	require.Equal(t, http.StatusOK, do("GET", "/finance/report.txt", "172.16.0.1"))
+
+	// The client can set the entries of X-Forwarded-For before the one that
+	// the proxy adds, so those are not used to meet the conditions of the
+	// rules, nor to avoid them.
+	require.Equal(t, http.StatusForbidden, do("PUT", "/finance/other.txt", "10.0.0.1, 192.0.2.7"))
+	require.Equal(t, http.StatusForbidden, do("GET", "/finance/payroll/june.txt", "10.0.0.1, 192.0.2.7"))
+	require.Equal(t, http.StatusForbidden, do("DELETE", "/finance/ledger/2025.txt", "10.0.0.1, 192.0.2.7"))
+	require.Equal(t, http.StatusOK, do("GET", "/finance/payroll/june.txt", "10.1.2.3"))
+	require.Equal(t, http.StatusNoContent, do("DELETE", "/finance/ledger/2025.txt", "10.1.2.3"))
+
+	// Outside of the schedule of a rule, the earlier rules apply. An empty time
+	// range is never within the schedule.
+	require.Equal(t, http.StatusCreated, do("PUT", "/uploads/new.txt", ""))
+	require.Equal(t, http.StatusCreated, do("MKCOL", "/uploads/closed/", ""))
+	require.Equal(t, http.StatusCreated, do("PUT", "/uploads/closed/new.txt", ""))
+	require.Equal(t, http.StatusForbidden, do("PUT", "/dropbox/new.txt", ""))
+	require.Equal(t, http.StatusOK, do("GET", "/dropbox/.keep", ""))
+}
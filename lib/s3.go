@@ -0,0 +1,999 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// s3MinPartSize is the minimum size of the parts of multipart uploads,
+	// except for the last one.
+	s3MinPartSize     = 5 << 20
+	s3DefaultPartSize = 16 << 20
+	s3DefaultRegion   = "us-east-1"
+	s3DefaultTimeout  = 5 * time.Minute
+
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+)
+
+var _ webdav.FileSystem = s3FileSystem{}
+
+// S3 configures a directory mount backed by a bucket of an S3-compatible
+// object storage. Collections are key prefixes that end with a slash.
+type S3 struct {
+	// Endpoint is the URL of the service, such as
+	// "https://s3.eu-west-1.amazonaws.com". Buckets are addressed by path.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// Prefix is prepended to the keys of all objects, so that only the
+	// objects under it are exposed.
+	Prefix string
+
+	// AccessKeyID and SecretAccessKey are the credentials for the bucket.
+	// Either can be read from an environment variable with "{env}NAME".
+	// Requests are not signed if they are empty.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// PartSize is the size of the parts that uploads larger than it are split
+	// into. Default is 16MiB, and it must be at least 5MiB.
+	PartSize ByteSize
+
+	// Timeout is how long requests to the service can take until it responds,
+	// including sending their bodies. Reading the responses is not limited, as
+	// they can be streamed to slow clients. Default is 5 minutes.
+	Timeout time.Duration
+}
+
+func (s *S3) Validate() error {
+	for _, value := range []*string{&s.AccessKeyID, &s.SecretAccessKey} {
+		if env, ok := strings.CutPrefix(*value, "{env}"); ok {
+			*value = os.Getenv(env)
+			if *value == "" {
+				return fmt.Errorf("invalid s3: environment variable %q is empty", env)
+			}
+		}
+	}
+
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid s3: invalid endpoint %q", s.Endpoint)
+	}
+
+	if s.Bucket == "" {
+		return errors.New("invalid s3: bucket must be defined")
+	}
+
+	if (s.AccessKeyID == "") != (s.SecretAccessKey == "") {
+		return errors.New("invalid s3: accessKeyID and secretAccessKey must be defined together")
+	}
+
+	if s.Region == "" {
+		s.Region = s3DefaultRegion
+	}
+
+	s.Prefix = strings.Trim(s.Prefix, "/")
+	if s.Prefix != "" {
+		s.Prefix += "/"
+	}
+
+	if s.PartSize == 0 {
+		s.PartSize = s3DefaultPartSize
+	} else if s.PartSize < s3MinPartSize {
+		return errors.New("invalid s3: partSize must be at least 5MiB")
+	}
+
+	if s.Timeout == 0 {
+		s.Timeout = s3DefaultTimeout
+	} else if s.Timeout < 0 {
+		return errors.New("invalid s3: timeout must be positive")
+	}
+
+	return nil
+}
+
+// s3Client makes signed requests to the bucket of an [S3].
+type s3Client struct {
+	S3
+}
+
+// s3Object is the metadata of an object.
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []s3Object
+	CommonPrefixes        []struct {
+		Prefix string
+	}
+}
+
+type s3ErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+// do sends a request for the object with the given key, or for the bucket if
+// key is empty. A nil body is empty. Bodies are not signed, so that they can be
+// streamed.
+func (c s3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	objectPath := strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket + "/" + key
+	u.Path = objectPath
+	u.RawPath = s3Escape(objectPath, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	// The request is canceled if there is no response within the timeout, and
+	// once the body of the response is closed otherwise.
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(c.Timeout, cancel)
+
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	payloadHash := s3EmptyPayloadHash
+	if body != nil {
+		r.ContentLength = size
+		payloadHash = s3UnsignedPayload
+	}
+	c.sign(r, payloadHash, time.Now())
+
+	resp, err := http.DefaultClient.Do(r)
+	if !timer.Stop() {
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		err = fmt.Errorf("s3: %s %q: no response within %s", method, key, c.Timeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = s3ResponseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// s3ResponseBody is the body of a response, which cancels the request when it
+// is closed.
+type s3ResponseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b s3ResponseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// sign signs r with AWS Signature Version 4.
+func (c s3Client) sign(r *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	if c.AccessKeyID == "" {
+		return
+	}
+
+	headers := map[string]string{"host": r.URL.Host}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := amzDate[:8] + "/" + c.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + c.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], c.Region, "s3", "aws4_request"} {
+		key = s3HMAC(key, part)
+	}
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes s as S3 expects: everything but unreserved characters is
+// percent-encoded, and slashes too if encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3CanonicalQuery encodes query with sorted keys, as S3 signs it.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3ResponseError returns the error of a failed response. Missing objects and
+// denied requests are reported as [os.ErrNotExist] and [os.ErrPermission].
+func s3ResponseError(op, key string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	case http.StatusForbidden:
+		return &os.PathError{Op: op, Path: key, Err: os.ErrPermission}
+	}
+
+	var s3Err s3ErrorResponse
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&s3Err); err == nil {
+		return fmt.Errorf("s3: %s %q: %s: %s", op, key, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("s3: %s %q: %s", op, key, resp.Status)
+}
+
+// send sends a request and returns the body of the response if it succeeds.
+// Some requests, such as copies, can fail after a successful status, with an
+// error in the body.
+func (c s3Client) send(ctx context.Context, op, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, []byte, error) {
+	resp, err := c.do(ctx, method, key, query, header, body, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 300 {
+		return nil, nil, s3ResponseError(op, key, resp)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<24))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var s3Err s3ErrorResponse
+	if method != http.MethodGet && xml.Unmarshal(data, &s3Err) == nil {
+		return nil, nil, fmt.Errorf("s3: %s %q: %s: %s", op, key, s3Err.Code, s3Err.Message)
+	}
+
+	return resp, data, nil
+}
+
+func (c s3Client) head(ctx context.Context, key string) (s3Object, error) {
+	resp, _, err := c.send(ctx, "head", http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return s3Object{}, err
+	}
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return s3Object{
+		Key:          key,
+		Size:         resp.ContentLength,
+		LastModified: lastModified,
+		ETag:         resp.Header.Get("ETag"),
+	}, nil
+}
+
+// get returns the contents of the object from offset on.
+func (c s3Client) get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		_ = resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	case resp.StatusCode >= 300:
+		defer func() { _ = resp.Body.Close() }()
+		return nil, s3ResponseError("get", key, resp)
+	}
+
+	return resp.Body, nil
+}
+
+func (c s3Client) put(ctx context.Context, key string, body io.Reader, size int64) error {
+	_, _, err := c.send(ctx, "put", http.MethodPut, key, nil, nil, body, size)
+	return err
+}
+
+func (c s3Client) delete(ctx context.Context, key string) error {
+	_, _, err := c.send(ctx, "delete", http.MethodDelete, key, nil, nil, nil, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// copy copies an object within the bucket on the server.
+func (c s3Client) copy(ctx context.Context, source, key string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", s3Escape("/"+c.Bucket+"/"+source, false))
+	_, _, err := c.send(ctx, "copy", http.MethodPut, key, nil, header, nil, 0)
+	return err
+}
+
+// list returns the objects with the given prefix and, if delimiter is set,
+// the common prefixes up to it, following continuations.
+func (c s3Client) list(ctx context.Context, prefix, delimiter string, maxKeys int) (s3ListResult, error) {
+	var result s3ListResult
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		if maxKeys > 0 {
+			query.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+
+		_, data, err := c.send(ctx, "list", http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return s3ListResult{}, err
+		}
+
+		var page s3ListResult
+		if err := xml.Unmarshal(data, &page); err != nil {
+			return s3ListResult{}, fmt.Errorf("s3: list %q: %w", prefix, err)
+		}
+
+		result.Contents = append(result.Contents, page.Contents...)
+		result.CommonPrefixes = append(result.CommonPrefixes, page.CommonPrefixes...)
+
+		if !page.IsTruncated || page.NextContinuationToken == "" || maxKeys > 0 {
+			return result, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// upload uploads size bytes of r as the object, in parts if it is larger than
+// the part size.
+func (c s3Client) upload(ctx context.Context, key string, r io.ReaderAt, size int64) error {
+	partSize := int64(c.PartSize)
+	if size <= partSize {
+		return c.put(ctx, key, io.NewSectionReader(r, 0, size), size)
+	}
+
+	_, data, err := c.send(ctx, "upload", http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &initiated); err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("s3: upload %q: invalid response", key)
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var parts []part
+
+	err = func() error {
+		for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+			length := min(partSize, size-offset)
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+
+			resp, _, err := c.send(ctx, "upload", http.MethodPut, key, query, nil, io.NewSectionReader(r, offset, length), length)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		}
+
+		complete, err := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []part   `xml:"Part"`
+		}{Parts: parts})
+		if err != nil {
+			return err
+		}
+
+		_, _, err = c.send(ctx, "upload", http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, nil, bytes.NewReader(complete), int64(len(complete)))
+		return err
+	}()
+	if err != nil {
+		// The parts uploaded so far are kept, and billed, until the upload is
+		// aborted.
+		_, _, abortErr := c.send(context.WithoutCancel(ctx), "upload", http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil, 0)
+		return errors.Join(err, abortErr)
+	}
+
+	return nil
+}
+
+// s3FileSystem is a [webdav.FileSystem] backed by a bucket.
+type s3FileSystem struct {
+	client  s3Client
+	noSniff bool
+}
+
+// key returns the key of the object with the given name.
+func (fs s3FileSystem) key(name string) string {
+	return fs.client.Prefix + strings.TrimPrefix(cleanName(name), "/")
+}
+
+func (fs s3FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fs.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.noSniff {
+		return noSniffFileInfo{info}, nil
+	}
+	return info, nil
+}
+
+func (fs s3FileSystem) stat(ctx context.Context, name string) (s3FileInfo, error) {
+	name = cleanName(name)
+	if name == "/" {
+		return s3FileInfo{name: "/", dir: true}, nil
+	}
+
+	key := fs.key(name)
+	object, err := fs.client.head(ctx, key)
+	if err == nil {
+		return s3FileInfo{name: path.Base(name), size: object.Size, modTime: object.LastModified, etag: object.ETag}, nil
+	}
+	if !os.IsNotExist(err) {
+		return s3FileInfo{}, err
+	}
+
+	// Collections exist as long as there are objects in them, or the marker
+	// object that creating them leaves.
+	result, err := fs.client.list(ctx, key+"/", "", 1)
+	if err != nil {
+		return s3FileInfo{}, err
+	}
+	if len(result.Contents) == 0 {
+		return s3FileInfo{}, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	info := s3FileInfo{name: path.Base(name), dir: true}
+	if result.Contents[0].Key == key+"/" {
+		info.modTime = result.Contents[0].LastModified
+	}
+	return info, nil
+}
+
+// statParent returns an error if the collection that name would be in does
+// not exist.
+func (fs s3FileSystem) statParent(ctx context.Context, name string) error {
+	parent, err := fs.stat(ctx, path.Dir(cleanName(name)))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (fs s3FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := fs.stat(ctx, name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := fs.statParent(ctx, name); err != nil {
+		return err
+	}
+
+	return fs.client.put(ctx, fs.key(name)+"/", bytes.NewReader(nil), 0)
+}
+
+func (fs s3FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = cleanName(name)
+
+	info, err := fs.stat(ctx, name)
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case err == nil && info.IsDir():
+		if writeFlag(flag) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+		}
+		return &s3Dir{fs: fs, ctx: ctx, name: name, info: info}, nil
+	case os.IsNotExist(err):
+		if flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		if err := fs.statParent(ctx, name); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	if !writeFlag(flag) {
+		return &s3ReadFile{fs: fs, ctx: ctx, name: name, info: info}, nil
+	}
+
+	// Objects cannot be changed in place, so they are written to a temporary
+	// file first, and uploaded when closed. New and truncated objects are
+	// uploaded even if nothing is written to them.
+	f := &s3WriteFile{fs: fs, ctx: ctx, name: name, info: info, flag: flag}
+	f.changed = err != nil || (info.size > 0 && flag&os.O_TRUNC != 0)
+	return f, nil
+}
+
+func (fs s3FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = cleanName(name)
+	if name == "/" {
+		return os.ErrInvalid
+	}
+
+	key := fs.key(name)
+	if err := fs.client.delete(ctx, key); err != nil {
+		return err
+	}
+
+	result, err := fs.client.list(ctx, key+"/", "", 0)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range result.Contents {
+		if err := fs.client.delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rename copies the objects to their new keys on the server, and then deletes
+// the old ones. It is not atomic: objects can be seen under both names while
+// a collection is renamed.
+func (fs s3FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	info, err := fs.stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err := fs.statParent(ctx, newName); err != nil {
+		return err
+	}
+
+	oldKey, newKey := fs.key(oldName), fs.key(newName)
+	if !info.IsDir() {
+		if err := fs.client.copy(ctx, oldKey, newKey); err != nil {
+			return err
+		}
+		return fs.client.delete(ctx, oldKey)
+	}
+
+	result, err := fs.client.list(ctx, oldKey+"/", "", 0)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range result.Contents {
+		if err := fs.client.copy(ctx, object.Key, newKey+strings.TrimPrefix(object.Key, oldKey)); err != nil {
+			return err
+		}
+	}
+
+	for _, object := range result.Contents {
+		if err := fs.client.delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	etag    string
+}
+
+func (fi s3FileInfo) Name() string       { return fi.name }
+func (fi s3FileInfo) Size() int64        { return fi.size }
+func (fi s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi s3FileInfo) Sys() any           { return nil }
+
+func (fi s3FileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ETag returns the ETag of the object, which changes with its contents.
+func (fi s3FileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.etag, nil
+}
+
+// s3ReadFile reads an object. The contents are requested from the current
+// offset on the first read after opening or seeking.
+type s3ReadFile struct {
+	fs     s3FileSystem
+	ctx    context.Context
+	name   string
+	info   s3FileInfo
+	body   io.ReadCloser
+	offset int64
+}
+
+func (f *s3ReadFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		body, err := f.fs.client.get(f.ctx, f.fs.key(f.name), f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3ReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	if offset != f.offset && f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3ReadFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: os.ErrInvalid}
+}
+
+func (f *s3ReadFile) Stat() (os.FileInfo, error) {
+	if f.fs.noSniff {
+		return noSniffFileInfo{f.info}, nil
+	}
+	return f.info, nil
+}
+
+func (f *s3ReadFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *s3ReadFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// s3WriteFile writes an object through a temporary file. The contents of the
+// object are only downloaded to it when the file is first read, written or
+// seeked, and it is only uploaded when closed if it was changed, so that
+// opening objects for writing does not transfer them by itself.
+type s3WriteFile struct {
+	fs      s3FileSystem
+	ctx     context.Context
+	name    string
+	info    s3FileInfo
+	flag    int
+	file    *os.File
+	changed bool
+}
+
+// open creates the temporary file on first use, with the existing contents
+// unless they are truncated, so that files can be updated partially.
+func (f *s3WriteFile) open() (*os.File, error) {
+	if f.file != nil {
+		return f.file, nil
+	}
+
+	tmp, err := os.CreateTemp("", "webdav-s3-*")
+	if err != nil {
+		return nil, err
+	}
+
+	err = func() error {
+		if f.info.size > 0 && f.flag&os.O_TRUNC == 0 {
+			body, err := f.fs.client.get(f.ctx, f.fs.key(f.name), 0)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = body.Close() }()
+
+			if _, err := io.Copy(tmp, body); err != nil {
+				return err
+			}
+			if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		if f.flag&os.O_APPEND != 0 {
+			_, err := tmp.Seek(0, io.SeekEnd)
+			return err
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, errors.Join(err, tmp.Close(), os.Remove(tmp.Name()))
+	}
+
+	f.file = tmp
+	return tmp, nil
+}
+
+func (f *s3WriteFile) Read(p []byte) (int, error) {
+	file, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return file.Read(p)
+}
+
+func (f *s3WriteFile) Write(p []byte) (int, error) {
+	file, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	f.changed = true
+	return file.Write(p)
+}
+
+func (f *s3WriteFile) Seek(offset int64, whence int) (int64, error) {
+	file, err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return file.Seek(offset, whence)
+}
+
+func (f *s3WriteFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: os.ErrInvalid}
+}
+
+func (f *s3WriteFile) Stat() (os.FileInfo, error) {
+	fi := f.info
+	fi.name = path.Base(f.name)
+	if f.file != nil {
+		info, err := f.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		fi = s3FileInfo{name: fi.name, size: info.Size(), modTime: info.ModTime()}
+	} else if f.changed {
+		fi = s3FileInfo{name: fi.name, modTime: time.Now()}
+	}
+
+	if f.fs.noSniff {
+		return noSniffFileInfo{fi}, nil
+	}
+	return fi, nil
+}
+
+func (f *s3WriteFile) Close() error {
+	if f.file == nil {
+		if !f.changed {
+			return nil
+		}
+		return f.fs.client.put(f.ctx, f.fs.key(f.name), bytes.NewReader(nil), 0)
+	}
+
+	var err error
+	if f.changed {
+		var info os.FileInfo
+		info, err = f.file.Stat()
+		if err == nil {
+			err = f.fs.client.upload(f.ctx, f.fs.key(f.name), f.file, info.Size())
+		}
+	}
+	return errors.Join(err, f.file.Close(), os.Remove(f.file.Name()))
+}
+
+// s3Dir is a collection, whose entries are listed on the first read.
+type s3Dir struct {
+	fs      s3FileSystem
+	ctx     context.Context
+	name    string
+	info    s3FileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *s3Dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	count = min(count, len(d.entries))
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+func (d *s3Dir) list() ([]os.FileInfo, error) {
+	prefix := d.fs.key(d.name)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	result, err := d.fs.client.list(d.ctx, prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]os.FileInfo, 0, len(result.Contents)+len(result.CommonPrefixes))
+	for _, object := range result.Contents {
+		name := strings.TrimPrefix(object.Key, prefix)
+		if name == "" {
+			// The marker of the collection itself.
+			continue
+		}
+		entries = append(entries, s3FileInfo{name: name, size: object.Size, modTime: object.LastModified, etag: object.ETag})
+	}
+	for _, common := range result.CommonPrefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/")
+		if name == "" {
+			continue
+		}
+		entries = append(entries, s3FileInfo{name: name, dir: true})
+	}
+
+	if d.fs.noSniff {
+		for i := range entries {
+			entries[i] = noSniffFileInfo{entries[i]}
+		}
+	}
+
+	return entries, nil
+}
+
+func (d *s3Dir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *s3Dir) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.name, Err: os.ErrInvalid}
+}
+
+func (d *s3Dir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &os.PathError{Op: "seek", Path: d.name, Err: os.ErrInvalid}
+	}
+	d.entries, d.listed = nil, false
+	return 0, nil
+}
+
+func (d *s3Dir) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: d.name, Err: os.ErrInvalid}
+}
+
+func (d *s3Dir) Close() error {
+	return nil
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ShareQueryParameter is the query parameter that holds the token of a share
+// link.
+const ShareQueryParameter = "share"
+
+const shareMinSecretLength = 16
+
+var (
+	errShareExpired = errors.New("share link has expired")
+	errShareRevoked = errors.New("share link has been revoked")
+)
+
+type Shares struct {
+	// Secret signs the share links. Changing it revokes all existing links.
+	Secret string
+
+	// Revoked has the IDs of the links that are no longer valid, even though
+	// they have not expired yet.
+	Revoked []string
+}
+
+func (s *Shares) enabled() bool {
+	return s.Secret != ""
+}
+
+func (s *Shares) Validate() error {
+	if env, ok := strings.CutPrefix(s.Secret, "{env}"); ok {
+		s.Secret = os.Getenv(env)
+		if s.Secret == "" {
+			return errors.New("invalid shares: secret environment variable is empty")
+		}
+	}
+
+	if s.Secret != "" && len(s.Secret) < shareMinSecretLength {
+		return fmt.Errorf("invalid shares: secret must have at least %d characters", shareMinSecretLength)
+	}
+
+	return nil
+}
+
+// ShareLink grants access to a file or directory, and everything within it,
+// until it expires. The path is relative to the directory of the user that
+// shares it, or to the global directory if there is no user. Links only grant
+// what that user is allowed to do.
+type ShareLink struct {
+	// ID identifies the link, so that it can be revoked.
+	ID       string `json:"i,omitempty"`
+	Username string `json:"u,omitempty"`
+	Path     string `json:"p"`
+	// Upload makes the link allow creating new files and directories instead
+	// of reading them.
+	Upload  bool  `json:"w,omitempty"`
+	Expires int64 `json:"e"`
+}
+
+// Token returns the signed token of the link, to be used in the
+// [ShareQueryParameter] query parameter.
+func (s *Shares) Token(link ShareLink) (string, error) {
+	if !s.enabled() {
+		return "", errors.New("shares are not enabled: secret must be set")
+	}
+
+	link.Path = strings.TrimSuffix(cleanPath(link.Path), "/")
+	payload, err := json.Marshal(link)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.sign(encoded)), nil
+}
+
+func (s *Shares) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(s.Secret))
+	mac.Write([]byte("webdav-share:" + payload))
+	return mac.Sum(nil)
+}
+
+// parseToken verifies the signature and the expiry of a token, and returns
+// its link.
+func (s *Shares) parseToken(token string, now time.Time) (*ShareLink, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("malformed share link")
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.sign(payload)) {
+		return nil, errors.New("invalid share link signature")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("malformed share link")
+	}
+
+	var link ShareLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		return nil, errors.New("malformed share link")
+	}
+
+	if !now.Before(time.Unix(link.Expires, 0)) {
+		return nil, errShareExpired
+	}
+
+	if link.ID != "" && slices.Contains(s.Revoked, link.ID) {
+		return nil, errShareRevoked
+	}
+
+	return &link, nil
+}
+
+// ShareToken returns the signed token of the link, after checking that it can
+// be used with the configuration. The user of the link must be defined, unless
+// users are read from a file, which only the server knows. Links without a
+// user use the global settings, so they cannot be used if those contain the
+// {username} placeholder.
+func (c *Config) ShareToken(link ShareLink) (string, error) {
+	if link.Username == "" {
+		if c.UserPermissions.hasUsernamePlaceholder() {
+			return "", fmt.Errorf("the global settings contain %s, so share links must be created for a user", UsernamePlaceholder)
+		}
+	} else if c.UsersFile == "" && !slices.ContainsFunc(c.Users, func(u User) bool { return u.Username == link.Username }) {
+		return "", fmt.Errorf("user %q is not defined in the configuration", link.Username)
+	}
+
+	return c.Shares.Token(link)
+}
+
+// permissions returns the permissions granted by the link: reading, or
+// creating, the shared path and everything within it, and nothing else.
+func (l *ShareLink) permissions() UserPermissions {
+	perms := Permissions{Read: true}
+	if l.Upload {
+		perms = Permissions{Create: true}
+	}
+
+	path := strings.TrimSuffix(l.Path, "/")
+	return UserPermissions{
+		Rules: []*Rule{{
+			Regex:       regexp.MustCompile("^" + regexp.QuoteMeta(path) + "(/.*)?$"),
+			Permissions: perms,
+		}},
+	}
+}
@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareToken(t *testing.T) {
+	t.Parallel()
+
+	s := Shares{Secret: "0123456789abcdef"}
+	require.NoError(t, s.Validate())
+
+	now := time.Now()
+	token, err := s.Token(ShareLink{ID: "abc", Username: "john", Path: "/docs/../shared/", Expires: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	link, err := s.parseToken(token, now)
+	require.NoError(t, err)
+	require.Equal(t, &ShareLink{ID: "abc", Username: "john", Path: "/shared", Expires: now.Add(time.Hour).Unix()}, link)
+
+	_, err = s.parseToken(token, now.Add(time.Hour))
+	require.ErrorIs(t, err, errShareExpired)
+
+	// Links are revoked by their ID.
+	revoked := Shares{Secret: s.Secret, Revoked: []string{"abc"}}
+	_, err = revoked.parseToken(token, now)
+	require.ErrorIs(t, err, errShareRevoked)
+
+	other := Shares{Secret: "fedcba9876543210"}
+	_, err = other.parseToken(token, now)
+	require.ErrorContains(t, err, "invalid share link signature")
+
+	// The payload cannot be changed without the signature.
+	payload, signature, _ := strings.Cut(token, ".")
+	forged, err := other.Token(ShareLink{Path: "/", Expires: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	require.NotEqual(t, payload, forgedPayload)
+	_, err = s.parseToken(forgedPayload+"."+signature, now)
+	require.ErrorContains(t, err, "invalid share link signature")
+
+	require.ErrorContains(t, (&Shares{Secret: "short"}).Validate(), "at least 16 characters")
+	_, err = (&Shares{}).Token(ShareLink{Path: "/"})
+	require.ErrorContains(t, err, "secret must be set")
+}
+
+func TestShareLinkPermissions(t *testing.T) {
+	t.Parallel()
+
+	exists := func(string) bool { return false }
+
+	testCases := []struct {
+		link     ShareLink
+		method   string
+		path     string
+		expected bool
+	}{
+		{ShareLink{Path: "/docs/a.txt"}, "GET", "/docs/a.txt", true},
+		{ShareLink{Path: "/docs/a.txt"}, "GET", "/docs/a.txt.bak", false},
+		{ShareLink{Path: "/docs/a.txt"}, "PUT", "/docs/a.txt", false},
+		{ShareLink{Path: "/docs"}, "PROPFIND", "/docs/", true},
+		{ShareLink{Path: "/docs"}, "GET", "/docs/sub/b.txt", true},
+		{ShareLink{Path: "/docs"}, "GET", "/docsfoo", false},
+		{ShareLink{Path: "/docs"}, "DELETE", "/docs/a.txt", false},
+		{ShareLink{Path: "/drop", Upload: true}, "PUT", "/drop/new.txt", true},
+		{ShareLink{Path: "/drop", Upload: true}, "MKCOL", "/drop/sub/", true},
+		{ShareLink{Path: "/drop", Upload: true}, "GET", "/drop/new.txt", false},
+		{ShareLink{Path: "/drop", Upload: true}, "PROPFIND", "/drop/", false},
+		{ShareLink{Path: ""}, "GET", "/anything", true},
+	}
+
+	for _, tc := range testCases {
+		p := tc.link.permissions()
+		r := &request{method: tc.method, path: tc.path}
+		require.Equal(t, tc.expected, p.Allowed(r, exists), "%s %s with %+v", tc.method, tc.path, tc.link)
+	}
+}
+
+func TestServerShares(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"docs/a.txt":    []byte("a"),
+		"secret.txt":    []byte("secret"),
+		"john/note.txt": []byte("note"),
+		"drop/.keep":    []byte(""),
+	})
+
+	config := fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+
+shares:
+  secret: 0123456789abcdef0123
+  revoked: [revoked]
+
+users:
+  - username: john
+    password: john
+    directory: %s/john
+    permissions: R
+`, dir, dir)
+
+	cfg := writeAndParseConfig(t, config, ".yml")
+	srv := makeTestServer(t, config)
+	defer srv.Close()
+
+	expires := time.Now().Add(time.Hour).Unix()
+	token := func(link ShareLink) string {
+		if link.Expires == 0 {
+			link.Expires = expires
+		}
+		token, err := cfg.Shares.Token(link)
+		require.NoError(t, err)
+		return token
+	}
+
+	do := func(method, path, token string) int {
+		req, err := http.NewRequest(method, srv.URL+path+"?"+url.Values{ShareQueryParameter: {token}}.Encode(), strings.NewReader("new"))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	// Read links only give access to the shared path, without credentials.
+	docs := token(ShareLink{Path: "/docs"})
+	require.Equal(t, http.StatusOK, do("GET", "/docs/a.txt", docs))
+	require.Equal(t, http.StatusForbidden, do("GET", "/secret.txt", docs))
+	require.Equal(t, http.StatusForbidden, do("PUT", "/docs/b.txt", docs))
+
+	// Upload links only allow creating new files.
+	drop := token(ShareLink{Path: "/drop", Upload: true})
+	require.Equal(t, http.StatusCreated, do("PUT", "/drop/new.txt", drop))
+	require.Equal(t, http.StatusForbidden, do("PUT", "/drop/new.txt", drop))
+	require.Equal(t, http.StatusForbidden, do("GET", "/drop/new.txt", drop))
+
+	// Links of users are relative to their directory, and cannot grant more
+	// than the user is allowed to do.
+	require.Equal(t, http.StatusOK, do("GET", "/note.txt", token(ShareLink{Username: "john", Path: "/"})))
+	require.Equal(t, http.StatusForbidden, do("PUT", "/new.txt", token(ShareLink{Username: "john", Path: "/", Upload: true})))
+
+	// Expired, forged and unknown links are rejected.
+	require.Equal(t, http.StatusForbidden, do("GET", "/docs/a.txt", token(ShareLink{Path: "/docs", Expires: time.Now().Add(-time.Minute).Unix()})))
+	require.Equal(t, http.StatusForbidden, do("GET", "/docs/a.txt", docs+"x"))
+	require.Equal(t, http.StatusForbidden, do("GET", "/", token(ShareLink{Username: "jane", Path: "/"})))
+	require.Equal(t, http.StatusForbidden, do("GET", "/docs/a.txt", token(ShareLink{ID: "revoked", Path: "/docs"})))
+
+	_, err := cfg.ShareToken(ShareLink{Username: "jane", Path: "/"})
+	require.ErrorContains(t, err, `user "jane" is not defined`)
+
+	// Without a link, credentials are still required.
+	resp, err := http.Get(srv.URL + "/docs/a.txt")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServerSharesUsernamePlaceholder(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"john/note.txt":         []byte("note"),
+		"{username}/secret.txt": []byte("secret"),
+	})
+
+	config := fmt.Sprintf(`
+directory: %s/{username}
+permissions: R
+
+shares:
+  secret: 0123456789abcdef0123
+
+users:
+  - username: john
+    password: john
+`, dir)
+
+	cfg := writeAndParseConfig(t, config, ".yml")
+	srv := makeTestServer(t, config)
+	defer srv.Close()
+
+	do := func(link ShareLink, path string) int {
+		link.Expires = time.Now().Add(time.Hour).Unix()
+		token, err := cfg.Shares.Token(link)
+		require.NoError(t, err)
+
+		resp, err := http.Get(srv.URL + path + "?" + url.Values{ShareQueryParameter: {token}}.Encode())
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	// The placeholders of the global settings are only expanded for users, so
+	// links need one.
+	require.Equal(t, http.StatusOK, do(ShareLink{Username: "john", Path: "/"}, "/note.txt"))
+	require.Equal(t, http.StatusForbidden, do(ShareLink{Path: "/"}, "/secret.txt"))
+
+	_, err := cfg.ShareToken(ShareLink{Path: "/"})
+	require.ErrorContains(t, err, "must be created for a user")
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path"
+
+	"golang.org/x/net/webdav"
+)
+
+type stagedUploadKey struct{}
+
+// withStagedUpload returns a context in which [stagedFileSystem] writes the
+// files that are truncated when opened to a temporary file next to them, which
+// only replaces them once body has been read completely. Otherwise, a body
+// that fails partway, such as one that goes beyond a limit, would leave the
+// file truncated.
+func withStagedUpload(ctx context.Context, body *limitedBody) context.Context {
+	return context.WithValue(ctx, stagedUploadKey{}, body)
+}
+
+// stagedFileSystem is a [webdav.FileSystem] that stages the uploads of the
+// requests whose context has a body from [withStagedUpload].
+type stagedFileSystem struct {
+	webdav.FileSystem
+}
+
+func (fs stagedFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	body, ok := ctx.Value(stagedUploadKey{}).(*limitedBody)
+	if !ok || flag&os.O_TRUNC == 0 {
+		return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+
+	// Collections cannot be replaced by files, which opening them reports.
+	if info, err := fs.FileSystem.Stat(ctx, name); err == nil && info.IsDir() {
+		return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+".upload-"+rand.Text()[:10])
+	file, err := fs.FileSystem.OpenFile(ctx, tmp, flag|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stagedFile{File: file, fs: fs.FileSystem, ctx: ctx, name: name, tmp: tmp, body: body}, nil
+}
+
+// stagedFile is a temporary file that replaces the file at name when it is
+// closed, unless the body or a write failed. It is removed otherwise.
+type stagedFile struct {
+	webdav.File
+	fs     webdav.FileSystem
+	ctx    context.Context
+	name   string
+	tmp    string
+	body   *limitedBody
+	failed bool
+}
+
+func (f *stagedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		f.failed = true
+	}
+	return n, err
+}
+
+func (f *stagedFile) Close() error {
+	// The request may have been canceled, but the temporary file must still
+	// be moved or removed.
+	ctx := context.WithoutCancel(f.ctx)
+
+	err := f.File.Close()
+	if err == nil && !f.failed && !f.body.failed {
+		err = f.fs.Rename(ctx, f.tmp, f.name)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return errors.Join(err, f.fs.RemoveAll(ctx, f.tmp))
+}
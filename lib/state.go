@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// State is the server state that is kept across restarts in the state file.
+type State struct {
+	Bans []Ban `json:"bans,omitempty"`
+
+	// LastLogins holds the time of the last successful login of each user.
+	LastLogins map[string]time.Time `json:"lastLogins,omitempty"`
+}
+
+// ReadState reads the state file. A missing file is an empty state.
+func ReadState(filename string) (*State, error) {
+	state := &State{}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %q: %w", filename, err)
+	}
+
+	return state, nil
+}
+
+// writeState writes the state file, replacing it atomically so that readers
+// never see a partial file.
+func writeState(filename string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+// stateStore guards the state shared by the parts of the handler that persist
+// it. If filename is empty, the state is only kept in memory.
+//
+// The state file is written in the background, so that requests, such as
+// failed logins, do not wait for it. Updates made while it is written are
+// written together afterwards.
+type stateStore struct {
+	filename string
+	changed  chan struct{}
+	done     chan struct{}
+
+	mu     sync.Mutex
+	state  *State
+	closed bool
+}
+
+func newStateStore(filename string) (*stateStore, error) {
+	s := &stateStore{filename: filename, state: &State{}}
+
+	if filename != "" {
+		var err error
+		s.state, err = ReadState(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		s.changed = make(chan struct{}, 1)
+		s.done = make(chan struct{})
+		go s.write()
+	}
+
+	return s, nil
+}
+
+// write writes the state file whenever the state changes, until the store is
+// closed.
+func (s *stateStore) write() {
+	defer close(s.done)
+
+	for range s.changed {
+		s.mu.Lock()
+		data, err := json.MarshalIndent(s.state, "", "  ")
+		s.mu.Unlock()
+
+		if err == nil {
+			err = writeState(s.filename, data)
+		}
+		if err != nil {
+			zap.L().Error("failed to write state file", zap.String("path", s.filename), zap.Error(err))
+		}
+	}
+}
+
+// close waits for the pending changes to be written. Later changes are only
+// kept in memory.
+func (s *stateStore) close() {
+	if s.filename == "" {
+		return
+	}
+
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.changed)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+}
+
+// get calls fn with the current state, which must not be modified.
+func (s *stateStore) get(fn func(*State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.state)
+}
+
+// update calls fn to modify the state, and then has the state file written.
+func (s *stateStore) update(fn func(*State)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(s.state)
+
+	if s.filename == "" || s.closed {
+		return
+	}
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+		// A write is already pending, and will include this change.
+	}
+}
@@ -0,0 +1,342 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/webdav"
+)
+
+// UploadFilter constrains the files that can be uploaded.
+type UploadFilter struct {
+	// MaxFileSize is the maximum size of uploaded files. Default is 0, which
+	// is unlimited.
+	MaxFileSize ByteSize
+
+	// AllowedExtensions and BlockedExtensions are extensions, such as ".pdf"
+	// or ".tar.gz", that the names of uploaded files must, or must not, have.
+	// They also apply to the destinations of copies and moves.
+	AllowedExtensions []string
+	BlockedExtensions []string
+
+	// AllowedMimeTypes and BlockedMimeTypes are media types, such as
+	// "application/pdf" or "image/*", that the contents of uploaded files
+	// must, or must not, have. The type is detected from the first bytes of
+	// the contents.
+	AllowedMimeTypes []string
+	BlockedMimeTypes []string
+}
+
+func (f *UploadFilter) Validate() error {
+	if f.MaxFileSize < 0 {
+		return errors.New("invalid upload filter: maxFileSize cannot be negative")
+	}
+
+	for _, extensions := range []*[]string{&f.AllowedExtensions, &f.BlockedExtensions} {
+		for i, extension := range *extensions {
+			extension = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(extension), "."))
+			if extension == "" || strings.Contains(extension, "/") {
+				return fmt.Errorf("invalid upload filter: invalid extension %q", (*extensions)[i])
+			}
+			(*extensions)[i] = "." + extension
+		}
+	}
+
+	for _, types := range []*[]string{&f.AllowedMimeTypes, &f.BlockedMimeTypes} {
+		for i, mediaType := range *types {
+			mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+			main, sub, ok := strings.Cut(mediaType, "/")
+			if !ok || main == "" || sub == "" || strings.Contains(sub, "/") || (main == "*" && sub != "*") {
+				return fmt.Errorf("invalid upload filter: invalid media type %q", (*types)[i])
+			}
+			(*types)[i] = mediaType
+		}
+	}
+
+	return nil
+}
+
+// cascade sets the constraints of f that are not defined under key to the
+// ones in inherited.
+func (f *UploadFilter) cascade(v *viper.Viper, key string, inherited UploadFilter) {
+	if !v.IsSet(key + ".MaxFileSize") {
+		f.MaxFileSize = inherited.MaxFileSize
+	}
+
+	if !v.IsSet(key + ".AllowedExtensions") {
+		f.AllowedExtensions = inherited.AllowedExtensions
+	}
+
+	if !v.IsSet(key + ".BlockedExtensions") {
+		f.BlockedExtensions = inherited.BlockedExtensions
+	}
+
+	if !v.IsSet(key + ".AllowedMimeTypes") {
+		f.AllowedMimeTypes = inherited.AllowedMimeTypes
+	}
+
+	if !v.IsSet(key + ".BlockedMimeTypes") {
+		f.BlockedMimeTypes = inherited.BlockedMimeTypes
+	}
+}
+
+// override returns f with the constraints that o defines instead.
+func (f UploadFilter) override(o UploadFilter) UploadFilter {
+	if o.MaxFileSize > 0 {
+		f.MaxFileSize = o.MaxFileSize
+	}
+
+	if o.AllowedExtensions != nil {
+		f.AllowedExtensions = o.AllowedExtensions
+	}
+
+	if o.BlockedExtensions != nil {
+		f.BlockedExtensions = o.BlockedExtensions
+	}
+
+	if o.AllowedMimeTypes != nil {
+		f.AllowedMimeTypes = o.AllowedMimeTypes
+	}
+
+	if o.BlockedMimeTypes != nil {
+		f.BlockedMimeTypes = o.BlockedMimeTypes
+	}
+
+	return f
+}
+
+// allowsName returns whether a file can have the given name.
+func (f UploadFilter) allowsName(name string) bool {
+	name = strings.ToLower(path.Base(name))
+	hasExtension := func(extensions []string) bool {
+		for _, extension := range extensions {
+			if strings.HasSuffix(name, extension) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(f.AllowedExtensions) > 0 && !hasExtension(f.AllowedExtensions) {
+		return false
+	}
+
+	return !hasExtension(f.BlockedExtensions)
+}
+
+// sniffs returns whether the type of the contents of files is constrained.
+func (f UploadFilter) sniffs() bool {
+	return len(f.AllowedMimeTypes) > 0 || len(f.BlockedMimeTypes) > 0
+}
+
+// allowsType returns whether a file can have contents of the given type.
+func (f UploadFilter) allowsType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	hasType := func(types []string) bool {
+		for _, t := range types {
+			if t == "*/*" || t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(f.AllowedMimeTypes) > 0 && !hasType(f.AllowedMimeTypes) {
+		return false
+	}
+
+	return !hasType(f.BlockedMimeTypes)
+}
+
+// defines returns whether f defines any constraint.
+func (f UploadFilter) defines() bool {
+	return f.MaxFileSize > 0 ||
+		f.AllowedExtensions != nil || f.BlockedExtensions != nil ||
+		f.AllowedMimeTypes != nil || f.BlockedMimeTypes != nil
+}
+
+// constrainsUploadsOnly returns whether the rule only constrains uploads. A
+// rule that grants no permissions leaves nothing to upload, so one that
+// defines upload constraints is taken to leave the permissions as they are.
+func (r *Rule) constrainsUploadsOnly() bool {
+	return r.Permissions == (Permissions{}) && r.UploadFilter.defines()
+}
+
+// uploadFilterAt returns the upload constraints for path, which are those of
+// the user, with the ones of the rules that match path instead, whether they
+// govern its permissions or not. Later rules replace the constraints of
+// earlier ones, for those they define.
+func (p UserPermissions) uploadFilterAt(r *request, path string) UploadFilter {
+	filter := p.UploadFilter
+	for _, rule := range p.rulesAt(path) {
+		if (rule.Matches(rule.path) || rule.matchesCollection(rule.path)) && rule.conditionsMet(r) {
+			filter = filter.override(rule.UploadFilter)
+		}
+	}
+	return filter
+}
+
+// filtersNames returns whether the names of files are constrained anywhere.
+func (p UserPermissions) filtersNames() bool {
+	if len(p.AllowedExtensions) > 0 || len(p.BlockedExtensions) > 0 {
+		return true
+	}
+
+	for _, rule := range p.allRules() {
+		if len(rule.AllowedExtensions) > 0 || len(rule.BlockedExtensions) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkUpload returns the status with which to reject a PUT, COPY or MOVE
+// request that the upload constraints of the user do not allow, or 0 if they
+// allow it. Bodies of unknown length are limited to the maximum file size
+// instead, and the returned writer reports if they go beyond it. Partial
+// updates are checked by [handlerUser.handlePartialUpdate].
+func (u *handlerUser) checkUpload(w http.ResponseWriter, r *http.Request, req *request) (http.ResponseWriter, int, error) {
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("Content-Range") != "" {
+			return w, 0, nil
+		}
+
+		filter := u.uploadFilterAt(req, req.path)
+		if !filter.allowsName(req.path) {
+			return w, http.StatusUnsupportedMediaType, nil
+		}
+
+		if filter.sniffs() {
+			contentType, err := sniffBody(r)
+			if err != nil {
+				return w, http.StatusBadRequest, nil
+			}
+			if contentType != "" && !filter.allowsType(contentType) {
+				return w, http.StatusUnsupportedMediaType, nil
+			}
+		}
+
+		if filter.MaxFileSize > 0 {
+			size := expectedBodySize(r)
+			if size > int64(filter.MaxFileSize) {
+				return w, http.StatusRequestEntityTooLarge, nil
+			}
+			if size < 0 {
+				return limitBody(w, r, int64(filter.MaxFileSize), errFileTooLarge), 0, nil
+			}
+		}
+
+	case "COPY", "MOVE":
+		if !u.filtersNames() {
+			return w, 0, nil
+		}
+
+		info, err := u.FileSystem.Stat(r.Context(), req.path)
+		if err != nil {
+			// Let the request fail as it would without constraints.
+			return w, 0, nil
+		}
+
+		// The names of all files that end up at the destination are checked,
+		// so that files cannot be moved in along with their collection.
+		errNotAllowed := errors.New("not allowed")
+		err = walkTree(r.Context(), u.FileSystem, req.path, info, func(name string, info os.FileInfo) error {
+			if info.IsDir() {
+				return nil
+			}
+
+			destination := strings.TrimSuffix(req.destination, "/") + strings.TrimPrefix(name, strings.TrimSuffix(req.path, "/"))
+			if !u.uploadFilterAt(req, destination).allowsName(destination) {
+				return errNotAllowed
+			}
+			return nil
+		})
+		if errors.Is(err, errNotAllowed) {
+			return w, http.StatusUnsupportedMediaType, nil
+		}
+		if err != nil {
+			return w, 0, err
+		}
+	}
+
+	return w, 0, nil
+}
+
+// checkPartialUpload returns the status with which to reject writing length
+// bytes of r at offset of a file with the given size, according to filter, or
+// 0 if it is allowed. A negative length is unknown, and limits the body of r
+// to the maximum file size instead. The contents are only checked when they
+// are written at the start of the file.
+func checkPartialUpload(r *http.Request, name string, filter UploadFilter, size, offset, length int64) (int, error) {
+	if !filter.allowsName(name) {
+		return http.StatusUnsupportedMediaType, nil
+	}
+
+	if filter.sniffs() && offset == 0 {
+		contentType, err := sniffBody(r)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		if contentType != "" && !filter.allowsType(contentType) {
+			return http.StatusUnsupportedMediaType, nil
+		}
+	}
+
+	if filter.MaxFileSize > 0 {
+		if length >= 0 && max(size, offset+length) > int64(filter.MaxFileSize) {
+			return http.StatusRequestEntityTooLarge, nil
+		}
+		if length < 0 {
+			r.Body = &limitedBody{ReadCloser: r.Body, remaining: max(int64(filter.MaxFileSize)-offset, 0), err: errFileTooLarge}
+		}
+	}
+
+	return 0, nil
+}
+
+// walkTree calls fn for name and, if it is a collection, for everything in
+// it, depth first.
+func walkTree(ctx context.Context, fs webdav.FileSystem, name string, info os.FileInfo, fn func(name string, info os.FileInfo) error) error {
+	if err := fn(name, info); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	children, err := f.Readdir(0)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := walkTree(ctx, fs, path.Join(name, child.Name()), child, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestUploadFilter(t *testing.T) {
+	t.Parallel()
+
+	f := UploadFilter{
+		AllowedExtensions: []string{"PDF", ".tar.gz", " txt"},
+		BlockedExtensions: []string{".secret.txt"},
+		AllowedMimeTypes:  []string{"Image/*", "text/plain", "application/pdf"},
+		BlockedMimeTypes:  []string{"image/svg+xml"},
+	}
+	require.NoError(t, f.Validate())
+	require.Equal(t, []string{".pdf", ".tar.gz", ".txt"}, f.AllowedExtensions)
+
+	for name, expected := range map[string]bool{
+		"/report.pdf":       true,
+		"/docs/REPORT.PDF":  true,
+		"/backup.tar.gz":    true,
+		"/backup.gz":        false,
+		"/notes.txt":        true,
+		"/notes.secret.txt": false,
+		"/run.exe":          false,
+		"/pdf":              false,
+	} {
+		require.Equal(t, expected, f.allowsName(name), name)
+	}
+
+	for contentType, expected := range map[string]bool{
+		"image/png":                 true,
+		"image/svg+xml":             false,
+		"text/plain; charset=utf-8": true,
+		"text/html; charset=utf-8":  false,
+		"application/pdf":           true,
+		"application/octet-stream":  false,
+	} {
+		require.Equal(t, expected, f.allowsType(contentType), contentType)
+	}
+
+	// Rules override what they define only.
+	o := f.override(UploadFilter{MaxFileSize: 10, BlockedExtensions: []string{".exe"}})
+	require.EqualValues(t, 10, o.MaxFileSize)
+	require.Equal(t, f.AllowedExtensions, o.AllowedExtensions)
+	require.Equal(t, []string{".exe"}, o.BlockedExtensions)
+
+	cfg := writeAndParseConfig(t, `
+maxFileSize: 1GB
+blockedExtensions: [exe]
+rules:
+  - path: /videos/
+    maxFileSize: 10GB
+users:
+  - username: john
+    password: john
+  - username: jane
+    password: jane
+    blockedExtensions: [exe, bat]
+`, ".yml")
+	require.EqualValues(t, 1e9, cfg.MaxFileSize)
+	require.EqualValues(t, 1e10, cfg.Rules[0].MaxFileSize)
+	require.Equal(t, []string{".exe"}, cfg.Users[0].BlockedExtensions)
+	require.EqualValues(t, 1e9, cfg.Users[1].MaxFileSize)
+	require.Equal(t, []string{".exe", ".bat"}, cfg.Users[1].BlockedExtensions)
+}
+
+func TestConfigUploadFilterErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		config string
+		error  string
+	}{{
+		name: "empty extension",
+		config: `
+allowedExtensions: ["."]
+`,
+		error: "invalid extension",
+	}, {
+		name: "media type without subtype",
+		config: `
+blockedMimeTypes: [image]
+`,
+		error: "invalid media type",
+	}, {
+		name: "media type with wildcard type",
+		config: `
+rules:
+  - path: /images/
+    allowedMimeTypes: ["*/png"]
+`,
+		error: "invalid media type",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			writeAndParseConfigWithError(t, tc.config, ".yml", tc.error)
+		})
+	}
+}
+
+func TestServerUploadFilter(t *testing.T) {
+	t.Parallel()
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 42)
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"a.txt":           []byte("a"),
+		"tools/run.exe":   []byte("exe"),
+		"tools/notes.txt": []byte("notes"),
+		"images/.keep":    []byte(""),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+maxFileSize: 10
+blockedExtensions: [.exe]
+rules:
+  - path: /images/
+    permissions: CRUD
+    maxFileSize: 100
+    allowedMimeTypes: [image/*]
+`, dir))
+	defer srv.Close()
+
+	// Extensions and sizes.
+	require.Equal(t, http.StatusUnsupportedMediaType, doTestRequest(t, srv, "PUT", "/b.exe", strings.NewReader("b"), nil))
+	require.Equal(t, http.StatusUnsupportedMediaType, doTestRequest(t, srv, "PUT", "/B.EXE", strings.NewReader("b"), nil))
+	require.Equal(t, http.StatusRequestEntityTooLarge, doTestRequest(t, srv, "PUT", "/b.txt", strings.NewReader(strings.Repeat("b", 11)), nil))
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/b.txt", strings.NewReader(strings.Repeat("b", 10)), nil))
+
+	// Bodies of unknown length are cut at the maximum size, and leave the file
+	// as it was.
+	require.Equal(t, http.StatusRequestEntityTooLarge, doTestRequest(t, srv, "PUT", "/c.txt", io.MultiReader(strings.NewReader(strings.Repeat("c", 11))), nil))
+	require.NoFileExists(t, filepath.Join(dir, "c.txt"))
+	require.Equal(t, http.StatusRequestEntityTooLarge, doTestRequest(t, srv, "PUT", "/tools/notes.txt", io.MultiReader(strings.NewReader(strings.Repeat("c", 11))), nil))
+	data, err := os.ReadFile(filepath.Join(dir, "tools/notes.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "notes", string(data))
+
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/tools/notes.txt", io.MultiReader(strings.NewReader(strings.Repeat("c", 10))), nil))
+	data, err = os.ReadFile(filepath.Join(dir, "tools/notes.txt"))
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("c", 10), string(data))
+
+	entries, err := os.ReadDir(filepath.Join(dir, "tools"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// Partial updates cannot grow files beyond the maximum size.
+	patch := map[string]string{"Content-Type": partialUpdateContentType, "X-Update-Range": "append"}
+	require.Equal(t, http.StatusRequestEntityTooLarge, doTestRequest(t, srv, "PATCH", "/a.txt", strings.NewReader(strings.Repeat("a", 10)), patch))
+	require.Equal(t, http.StatusNoContent, doTestRequest(t, srv, "PATCH", "/a.txt", strings.NewReader(strings.Repeat("a", 9)), patch))
+	require.Equal(t, http.StatusUnsupportedMediaType, doTestRequest(t, srv, "PATCH", "/d.exe", strings.NewReader("d"), patch))
+
+	// Rules replace the constraints they define, and types are detected from
+	// the contents.
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/images/a.png", strings.NewReader(png), nil))
+	require.Equal(t, http.StatusUnsupportedMediaType, doTestRequest(t, srv, "PUT", "/images/b.png", strings.NewReader("not an image"), nil))
+	require.Equal(t, http.StatusUnsupportedMediaType, doTestRequest(t, srv, "PUT", "/images/c.exe", strings.NewReader(png), nil))
+	require.Equal(t, http.StatusUnsupportedMediaType, doTestRequest(t, srv, "PUT", "/images/d.png", strings.NewReader("not an image"), map[string]string{"Content-Range": "bytes 0-11/12"}))
+
+	// Copies and moves cannot give files a blocked extension, including the
+	// files within collections.
+	client := gowebdav.NewClient(srv.URL, "", "")
+	require.ErrorContains(t, client.Rename("/a.txt", "/a.exe", false), "415")
+	require.ErrorContains(t, client.Copy("/tools", "/tools2", false), "415")
+	require.NoError(t, client.Copy("/tools/notes.txt", "/notes.txt", false))
+	require.NoError(t, client.Rename("/images/a.png", "/a.png", false))
+}
+
+func TestServerUploadFilterRules(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"docs/a.txt":  []byte("a"),
+		"small/a.txt": []byte("a"),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+allowedExtensions: [.txt]
+rules:
+  - path: /docs/
+    permissions: CRUD
+    allowedExtensions: []
+  - path: /small/
+    maxFileSize: 5
+  - regex: "^/small/b\\.txt$"
+    permissions: CRU
+`, dir))
+	defer srv.Close()
+
+	// Rules that only define upload constraints keep the permissions of the
+	// user, and those of the rules before them.
+	require.Equal(t, http.StatusOK, doTestRequest(t, srv, "GET", "/small/a.txt", nil, nil))
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/small/c.txt", strings.NewReader("c"), nil))
+	require.Equal(t, http.StatusRequestEntityTooLarge, doTestRequest(t, srv, "PUT", "/small/c.txt", strings.NewReader("012345"), nil))
+	require.Equal(t, http.StatusUnsupportedMediaType, doTestRequest(t, srv, "PUT", "/small/c.bin", strings.NewReader("c"), nil))
+	require.Equal(t, http.StatusNoContent, doTestRequest(t, srv, "DELETE", "/small/c.txt", nil, nil))
+
+	// Constraints apply within the rules that match, even when another rule
+	// governs the permissions.
+	require.Equal(t, http.StatusRequestEntityTooLarge, doTestRequest(t, srv, "PUT", "/small/b.txt", strings.NewReader("012345"), nil))
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/small/b.txt", strings.NewReader("b"), nil))
+	require.Equal(t, http.StatusForbidden, doTestRequest(t, srv, "DELETE", "/small/b.txt", nil, nil))
+
+	// An empty list lifts the one of the user.
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/docs/b.bin", strings.NewReader("b"), nil))
+	require.Equal(t, http.StatusUnsupportedMediaType, doTestRequest(t, srv, "PUT", "/b.bin", strings.NewReader("b"), nil))
+}
@@ -5,23 +5,70 @@ import (
 	"fmt"
 	"os"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
 type User struct {
 	UserPermissions `mapstructure:",squash"`
 	Username        string
 	Password        string
+
+	// Groups are the names of the groups whose settings the user gets, in
+	// order, before its own.
+	Groups []string
+
+	// Digest holds the credentials for Digest authentication: HA1 values
+	// prefixed with their algorithm, such as "{sha-256}...", or a plaintext
+	// password.
+	Digest []string
+
+	// AppPasswords are additional passwords of the user, such as one for each
+	// device, each with its own restrictions.
+	AppPasswords []AppPassword
+
+	// Disabled users cannot log in, but keep their configuration. ValidFrom
+	// and ValidUntil, if set, limit when the user can log in.
+	Disabled   bool
+	ValidFrom  time.Time
+	ValidUntil time.Time
+}
+
+// CheckActive returns an error if the user cannot log in at the given time,
+// because it is disabled or outside of its validity period.
+func (u User) CheckActive(now time.Time) error {
+	switch {
+	case u.Disabled:
+		return errors.New("user is disabled")
+	case !u.ValidFrom.IsZero() && now.Before(u.ValidFrom):
+		return fmt.Errorf("user is not valid until %s", u.ValidFrom.Format(time.RFC3339))
+	case !u.ValidUntil.IsZero() && !now.Before(u.ValidUntil):
+		return fmt.Errorf("user expired at %s", u.ValidUntil.Format(time.RFC3339))
+	}
+
+	return nil
 }
 
 func (u User) checkPassword(input string) bool {
-	if strings.HasPrefix(u.Password, "{bcrypt}") {
-		savedPassword := strings.TrimPrefix(u.Password, "{bcrypt}")
-		return bcrypt.CompareHashAndPassword([]byte(savedPassword), []byte(input)) == nil
+	_, ok := u.matchPassword(input, time.Now(), comparePassword)
+	return ok
+}
+
+// matchPassword checks the input against the password and the app passwords
+// of the user with compare. It returns the app password that matched, or nil
+// if it was the password of the user. Expired app passwords never match.
+func (u User) matchPassword(input string, now time.Time, compare func(stored, input string) bool) (*AppPassword, bool) {
+	if compare(u.Password, input) {
+		return nil, true
+	}
+
+	for i := range u.AppPasswords {
+		app := &u.AppPasswords[i]
+		if !app.expired(now) && compare(app.Password, input) {
+			return app, true
+		}
 	}
 
-	return u.Password == input
+	return nil, false
 }
 
 func (u *User) Validate(noPassword bool) error {
@@ -39,7 +86,7 @@ func (u *User) Validate(noPassword bool) error {
 		}
 	}
 
-	if u.Password == "" && !noPassword {
+	if u.Password == "" && len(u.Digest) == 0 && len(u.AppPasswords) == 0 && !noPassword {
 		return fmt.Errorf("invalid user %q: password must be set", u.Username)
 	} else if strings.HasPrefix(u.Password, "{env}") {
 		env := strings.TrimPrefix(u.Password, "{env}")
@@ -53,6 +100,41 @@ func (u *User) Validate(noPassword bool) error {
 		}
 	}
 
+	if err := validatePassword(u.Password); err != nil {
+		return fmt.Errorf("invalid user %q: %w", u.Username, err)
+	}
+
+	for i, credential := range u.Digest {
+		if env, ok := strings.CutPrefix(credential, "{env}"); ok {
+			credential = os.Getenv(env)
+			if credential == "" {
+				return fmt.Errorf("invalid user %q: digest environment variable is empty", u.Username)
+			}
+			u.Digest[i] = credential
+		}
+
+		if err := validateDigestCredential(credential); err != nil {
+			return fmt.Errorf("invalid user %q: %w", u.Username, err)
+		}
+	}
+
+	if !u.ValidFrom.IsZero() && !u.ValidUntil.IsZero() && !u.ValidUntil.After(u.ValidFrom) {
+		return fmt.Errorf("invalid user %q: validUntil must be after validFrom", u.Username)
+	}
+
+	names := map[string]struct{}{}
+	for i := range u.AppPasswords {
+		app := &u.AppPasswords[i]
+		if err := app.Validate(); err != nil {
+			return fmt.Errorf("invalid user %q: %w", u.Username, err)
+		}
+
+		if _, ok := names[app.Name]; ok {
+			return fmt.Errorf("invalid user %q: app password %q is defined more than once", u.Username, app.Name)
+		}
+		names[app.Name] = struct{}{}
+	}
+
 	if err := u.UserPermissions.Validate(); err != nil {
 		return fmt.Errorf("invalid user %q: %w", u.Username, err)
 	}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestUserCheckActive(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name  string
+		user  User
+		now   time.Time
+		error string
+	}{
+		{"no limits", User{}, now, ""},
+		{"disabled", User{Disabled: true}, now, "user is disabled"},
+		{"within validity", User{ValidFrom: from, ValidUntil: until}, now, ""},
+		{"before validity", User{ValidFrom: from}, from.Add(-time.Second), "not valid until 2026-01-01T00:00:00Z"},
+		{"start of validity", User{ValidFrom: from}, from, ""},
+		{"end of validity", User{ValidUntil: until}, until, "expired at 2027-01-01T00:00:00Z"},
+	}
+
+	for _, tc := range testCases {
+		err := tc.user.CheckActive(tc.now)
+		if tc.error == "" {
+			require.NoError(t, err, tc.name)
+		} else {
+			require.ErrorContains(t, err, tc.error, tc.name)
+		}
+	}
+
+	writeAndParseConfigWithError(t, `
+users:
+  - username: john
+    password: john
+    validFrom: 2027-01-01T00:00:00Z
+    validUntil: 2026-01-01T00:00:00Z
+`, ".yml", "validUntil must be after validFrom")
+}
+
+func TestServerUserLifecycle(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{"foo.txt": []byte("foo")})
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+stateFile: %s
+
+shares:
+  secret: 0123456789abcdef0123
+
+users:
+  - username: active
+    password: active
+    validFrom: 2020-01-01T00:00:00Z
+  - username: disabled
+    password: disabled
+    disabled: true
+  - username: expired
+    password: expired
+    validUntil: 2020-01-01T00:00:00Z
+  - username: future
+    password: future
+    validFrom: 2999-01-01T00:00:00Z
+`, dir, stateFile))
+	defer srv.Close()
+
+	before := time.Now()
+
+	_, err := gowebdav.NewClient(srv.URL, "active", "active").Read("/foo.txt")
+	require.NoError(t, err)
+
+	for _, username := range []string{"disabled", "expired", "future"} {
+		req, err := http.NewRequest("GET", srv.URL+"/foo.txt", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth(username, username)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode, username)
+	}
+
+	// Only successful logins are recorded. The state file is written in the
+	// background.
+	var state *State
+	require.Eventually(t, func() bool {
+		state, err = ReadState(stateFile)
+		return err == nil && len(state.LastLogins) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, state.LastLogins, 1)
+	require.WithinRange(t, state.LastLogins["active"], before.Add(-time.Second), time.Now())
+
+	// Share links of inactive users stop working as well.
+	cfg := writeAndParseConfig(t, `
+shares:
+  secret: 0123456789abcdef0123
+`, ".yml")
+	token, err := cfg.Shares.Token(ShareLink{Username: "disabled", Path: "/", Expires: time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	resp, err := http.Get(srv.URL + "/foo.txt?share=" + token)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestHandlerRecordLogin(t *testing.T) {
+	t.Parallel()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	cfg := writeAndParseConfig(t, fmt.Sprintf(`
+stateFile: %s
+users:
+  - username: john
+    password: john
+`, stateFile), ".yml")
+
+	handler, err := NewHandler(cfg)
+	require.NoError(t, err)
+	h := handler.(*Handler)
+
+	// Logins are only written again once the previous one is old enough.
+	old := time.Now().Add(-lastLoginResolution / 2)
+	h.state.update(func(s *State) { s.LastLogins = map[string]time.Time{"john": old} })
+
+	h.recordLogin("john")
+	h.state.get(func(s *State) { require.True(t, old.Equal(s.LastLogins["john"])) })
+
+	old = time.Now().Add(-2 * lastLoginResolution)
+	h.state.update(func(s *State) { s.LastLogins["john"] = old })
+
+	h.recordLogin("john")
+
+	// Closing the handler waits for the state file to be written.
+	require.NoError(t, h.Close())
+	state, err := ReadState(stateFile)
+	require.NoError(t, err)
+	require.True(t, state.LastLogins["john"].After(old.Add(lastLoginResolution)))
+}
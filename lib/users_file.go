@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// usersFileReloadDelay is how long to wait after a change to the users file
+// before reloading it. Editors and tools often write a file in several steps,
+// and reloading too early would read a partial file.
+const usersFileReloadDelay = 100 * time.Millisecond
+
+// readUsersFile reads the users from an Apache htpasswd file. Every user is
+// given the permissions p, which are the global permissions.
+func readUsersFile(filename string, p UserPermissions) ([]User, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	users, err := parseHtpasswd(f, p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid users file %q: %w", filename, err)
+	}
+
+	return users, nil
+}
+
+func parseHtpasswd(r io.Reader, p UserPermissions) ([]User, error) {
+	var (
+		users   []User
+		seen    = map[string]struct{}{}
+		scanner = bufio.NewScanner(r)
+		line    = 0
+	)
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", line)
+		}
+
+		if _, ok := seen[username]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", line, username)
+		}
+		seen[username] = struct{}{}
+
+		password, err := htpasswdPassword(hash)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: user %q: %w", line, username, err)
+		}
+
+		if err := validatePassword(password); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: %w", line, username, err)
+		}
+
+		users = append(users, User{
+			UserPermissions: p,
+			Username:        username,
+			Password:        password,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// htpasswdPassword converts a hash from an htpasswd file into a password with
+// the prefix of the matching hash.
+func htpasswdPassword(hash string) (string, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return "{bcrypt}" + hash, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		return hash, nil
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		return "{md5-crypt}" + hash, nil
+	case strings.HasPrefix(hash, "$5$"):
+		return "{sha256-crypt}" + hash, nil
+	case strings.HasPrefix(hash, "$6$"):
+		return "{sha512-crypt}" + hash, nil
+	case len(hash) == 13 && strings.Trim(hash, cryptAlphabet) == "":
+		return "{des-crypt}" + hash, nil
+	default:
+		return "", fmt.Errorf("unsupported hash %q", hash)
+	}
+}
+
+// usersFileWatcher calls reload whenever the users file changes. It watches
+// the parent directory instead of the file itself, so that files replaced with
+// a rename, as most tools do, are picked up too. If the file is a symbolic
+// link, changes to its target, or to where it points to, are picked up as
+// well, such as when a Kubernetes ConfigMap swaps its "..data" directory.
+type usersFileWatcher struct {
+	filename string
+	target   string
+	watcher  *fsnotify.Watcher
+	reload   func()
+	done     chan struct{}
+}
+
+// watchUsersFile starts watching filename. Reloads run one at a time, until
+// the watcher is closed.
+func watchUsersFile(filename string, reload func()) (*usersFileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	w := &usersFileWatcher{
+		filename: filename,
+		target:   filename,
+		watcher:  watcher,
+		reload:   reload,
+		done:     make(chan struct{}),
+	}
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		w.watchTarget(target)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+func (w *usersFileWatcher) run() {
+	defer close(w.done)
+
+	// Reloads are delayed until there have been no changes for a while, and
+	// run here, so that they never overlap.
+	var delay <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if event.Op != fsnotify.Chmod && w.changed(event.Name) {
+				delay = time.After(usersFileReloadDelay)
+			}
+		case <-delay:
+			delay = nil
+			w.reload()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			zap.L().Error("users file watcher failed", zap.String("path", w.filename), zap.Error(err))
+		}
+	}
+}
+
+// changed reports whether the change to name can have changed the users file.
+func (w *usersFileWatcher) changed(name string) bool {
+	name = filepath.Clean(name)
+
+	target, err := filepath.EvalSymlinks(w.filename)
+	if err == nil && target != w.target {
+		w.watchTarget(target)
+		return true
+	}
+
+	return name == w.filename || name == w.target
+}
+
+// watchTarget watches the directory of target, the file that the users file
+// resolves to, if it is not the directory of the users file.
+func (w *usersFileWatcher) watchTarget(target string) {
+	dir, oldDir := filepath.Dir(target), filepath.Dir(w.target)
+	w.target = target
+
+	if dir == oldDir {
+		return
+	}
+
+	if oldDir != filepath.Dir(w.filename) {
+		_ = w.watcher.Remove(oldDir)
+	}
+
+	if dir != filepath.Dir(w.filename) {
+		if err := w.watcher.Add(dir); err != nil {
+			zap.L().Error("users file watcher failed", zap.String("path", dir), zap.Error(err))
+		}
+	}
+}
+
+// Close stops watching, and waits for a running reload to finish.
+func (w *usersFileWatcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
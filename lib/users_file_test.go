@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	t.Parallel()
+
+	p := UserPermissions{Directory: "/data", Permissions: Permissions{Read: true}}
+
+	users, err := parseHtpasswd(strings.NewReader(`
+# Comments and empty lines are ignored.
+bcrypt:$2a$12$222dfz8Nweoyvy8OwI8.me9nfaRfuz8lqGkiiYSMH1lLMHO26qWom
+sha:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=
+
+apr1:$apr1$abcdefgh$/cesMUEGhga5MgaTGywaW0
+crypt:abgOeLfPimXQo
+sha512:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1
+`), p)
+	require.NoError(t, err)
+	require.Len(t, users, 5)
+
+	passwords := map[string]string{
+		"bcrypt": "bcrypt",
+		"sha":    "test",
+		"apr1":   "test",
+		"crypt":  "test",
+		"sha512": "Hello world!",
+	}
+	for _, u := range users {
+		require.Equal(t, p, u.UserPermissions, u.Username)
+		require.True(t, u.checkPassword(passwords[u.Username]), u.Username)
+		require.False(t, u.checkPassword("wrong"), u.Username)
+	}
+
+	for content, message := range map[string]string{
+		"missing":               "line 1: expected username:hash",
+		"user:":                 "line 1: expected username:hash",
+		"user:plaintext":        `line 1: user "user": unsupported hash`,
+		"a:abgOeLfPimXQo\na:ab": `line 2: duplicate user "a"`,
+	} {
+		_, err := parseHtpasswd(strings.NewReader(content), p)
+		require.ErrorContains(t, err, message, content)
+	}
+}
+
+func TestWatchUsersFile(t *testing.T) {
+	t.Parallel()
+
+	// The layout of a Kubernetes ConfigMap volume, whose files are symbolic
+	// links through a "..data" link that is swapped on updates.
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..v1"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "..v1", "htpasswd"), []byte("v1"), 0644))
+	require.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "htpasswd"), filepath.Join(dir, "htpasswd")))
+
+	var reloads, running, overlaps atomic.Int32
+	w, err := watchUsersFile(filepath.Join(dir, "htpasswd"), func() {
+		if running.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		time.Sleep(3 * usersFileReloadDelay)
+		running.Add(-1)
+		reloads.Add(1)
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..v2"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "..v2", "htpasswd"), []byte("v2"), 0644))
+	require.NoError(t, os.Symlink("..v2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "..v1")))
+
+	require.Eventually(t, func() bool { return reloads.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Changes while a reload runs are reloaded after it, not alongside it.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "..v2", "htpasswd"), []byte("v3"), 0644))
+	time.Sleep(2 * usersFileReloadDelay)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "..v2", "htpasswd"), []byte("v4"), 0644))
+
+	require.Eventually(t, func() bool { return reloads.Load() == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, overlaps.Load())
+
+	require.NoError(t, w.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "..v2", "htpasswd"), []byte("v5"), 0644))
+	time.Sleep(3 * usersFileReloadDelay)
+	require.EqualValues(t, 3, reloads.Load())
+}
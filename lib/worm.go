@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+)
+
+var errWORMLocked = errors.New("write-once file")
+
+// hasWORMRules returns whether any of the rules is a write-once rule.
+func (p UserPermissions) hasWORMRules() bool {
+	for _, rule := range p.allRules() {
+		if rule.WORM {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wormLocked returns whether the file at name cannot be changed, because a
+// write-once rule matches it, and its retention has not expired yet. The
+// retention of a file starts when it was last written. Write-once rules
+// protect the files they match even if other rules govern their permissions,
+// and whether their conditions are met or not.
+func (p UserPermissions) wormLocked(r *request, name string, info os.FileInfo) bool {
+	if info.IsDir() {
+		return false
+	}
+
+	for _, rule := range p.rulesAt(name) {
+		if !rule.WORM || !(rule.Matches(rule.path) || rule.matchesCollection(rule.path)) {
+			continue
+		}
+
+		if rule.Retention <= 0 || r.time.Before(info.ModTime().Add(rule.Retention)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkWORM returns whether the request leaves the files that write-once
+// rules protect untouched. Files can be created, but not overwritten, updated,
+// moved or deleted, and neither can the collections that contain them.
+func (u *handlerUser) checkWORM(ctx context.Context, r *request, overwrite bool) (bool, error) {
+	if !u.hasWORMRules() {
+		return true, nil
+	}
+
+	// locked returns whether name is protected, or anything in it if tree is
+	// set.
+	locked := func(name string, tree bool) (bool, error) {
+		info, err := u.FileSystem.Stat(ctx, name)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if !tree || !info.IsDir() {
+			return u.wormLocked(r, name, info), nil
+		}
+
+		err = walkTree(ctx, u.FileSystem, path.Clean(name), info, func(name string, info os.FileInfo) error {
+			if u.wormLocked(r, name, info) {
+				return errWORMLocked
+			}
+			return nil
+		})
+		if errors.Is(err, errWORMLocked) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	switch r.method {
+	case "PUT", "PATCH", "PROPPATCH":
+		isLocked, err := locked(r.path, false)
+		return !isLocked, err
+	case "DELETE":
+		isLocked, err := locked(r.path, true)
+		return !isLocked, err
+	case "MOVE", "COPY":
+		if r.method == "MOVE" {
+			if isLocked, err := locked(r.path, true); isLocked || err != nil {
+				return false, err
+			}
+		}
+
+		if overwrite {
+			isLocked, err := locked(r.destination, true)
+			return !isLocked, err
+		}
+	}
+
+	return true, nil
+}
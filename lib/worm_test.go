@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+)
+
+func TestServerWORM(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"compliance/a.txt": []byte("a"),
+		"archive/old.txt":  []byte("old"),
+		"archive/new.txt":  []byte("new"),
+	})
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "archive/old.txt"), old, old))
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+rules:
+  - path: /compliance/
+    permissions: CRUD
+    worm: true
+  - path: /archive/
+    permissions: CRUD
+    worm: true
+    retention: 1h
+`, dir))
+	defer srv.Close()
+
+	// Files can be created, but not changed afterwards.
+	require.Equal(t, http.StatusCreated, doTestRequest(t, srv, "PUT", "/compliance/b.txt", strings.NewReader("b"), nil))
+	require.Equal(t, http.StatusForbidden, doTestRequest(t, srv, "PUT", "/compliance/b.txt", strings.NewReader("c"), nil))
+	require.Equal(t, http.StatusForbidden, doTestRequest(t, srv, "PATCH", "/compliance/a.txt", strings.NewReader("a"), map[string]string{"Content-Type": partialUpdateContentType, "X-Update-Range": "append"}))
+	require.Equal(t, http.StatusForbidden, doTestRequest(t, srv, "PROPPATCH", "/compliance/a.txt", strings.NewReader(`<?xml version="1.0"?>
+<propertyupdate xmlns="DAV:"><set><prop><foo xmlns="urn:test">bar</foo></prop></set></propertyupdate>`), nil))
+	require.Equal(t, http.StatusForbidden, doTestRequest(t, srv, "DELETE", "/compliance/a.txt", nil, nil))
+
+	// Neither can the collections that contain them be deleted or moved.
+	client := gowebdav.NewClient(srv.URL, "", "")
+	require.ErrorContains(t, client.Remove("/compliance"), "403")
+	require.ErrorContains(t, client.Rename("/compliance", "/other", false), "403")
+	require.ErrorContains(t, client.Rename("/compliance/a.txt", "/a.txt", false), "403")
+
+	// Copying out is allowed, but onto protected files is not.
+	require.NoError(t, client.Copy("/compliance/a.txt", "/a.txt", false))
+	require.ErrorContains(t, client.Copy("/a.txt", "/compliance/b.txt", true), "403")
+	require.NoError(t, client.Copy("/a.txt", "/compliance/c.txt", false))
+
+	// Files can be changed once their retention expires.
+	require.Equal(t, http.StatusForbidden, doTestRequest(t, srv, "DELETE", "/archive/new.txt", nil, nil))
+	require.Equal(t, http.StatusNoContent, doTestRequest(t, srv, "DELETE", "/archive/old.txt", nil, nil))
+}
+
+func TestServerWORMOtherRules(t *testing.T) {
+	t.Parallel()
+
+	dir := makeTestDirectory(t, map[string][]byte{
+		"compliance/a.txt": []byte("a"),
+		"office/a.txt":     []byte("a"),
+	})
+
+	srv := makeTestServer(t, fmt.Sprintf(`
+directory: %s
+permissions: CRUD
+rules:
+  - path: /compliance/
+    permissions: R
+    worm: true
+  - path: /office/
+    permissions: CRUD
+    worm: true
+    sourceCIDRs:
+      - 10.0.0.0/8
+users:
+  - username: basic
+    password: basic
+    rulesBehavior: append
+    rules:
+      - regex: ".*"
+        permissions: CRUD
+`, dir))
+	defer srv.Close()
+
+	// Write-once rules protect files even when a later rule governs their
+	// permissions, or their own conditions are not met.
+	client := gowebdav.NewClient(srv.URL, "basic", "basic")
+	require.NoError(t, client.Write("/compliance/b.txt", []byte("b"), 0666))
+	require.ErrorContains(t, client.Write("/compliance/b.txt", []byte("c"), 0666), "403")
+	require.ErrorContains(t, client.Remove("/compliance/a.txt"), "403")
+	require.ErrorContains(t, client.Rename("/compliance/a.txt", "/a.txt", false), "403")
+	require.ErrorContains(t, client.Remove("/office/a.txt"), "403")
+
+	data, err := os.ReadFile(filepath.Join(dir, "compliance/b.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "b", string(data))
+}
+
+func TestConfigWORMErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		config string
+		error  string
+	}{{
+		name: "negative retention",
+		config: `
+rules:
+  - path: /archive/
+    worm: true
+    retention: -1h
+`,
+		error: "retention cannot be negative",
+	}, {
+		name: "retention without worm",
+		config: `
+rules:
+  - path: /archive/
+    retention: 1h
+`,
+		error: "retention requires worm",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			writeAndParseConfigWithError(t, tc.config, ".yml", tc.error)
+		})
+	}
+}